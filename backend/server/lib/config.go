@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the backend. It is loaded from a YAML or TOML file, and then individual options can
+// be overridden with flags.
+type Config struct {
+	// Set to prod for the server behind api.hishtory.dev, which enables checks that only make sense with a large DB
+	Environment   string              `yaml:"environment" toml:"environment"`
+	ListenAddress string              `yaml:"listen_address" toml:"listen_address"`
+	TLS           TLSConfig           `yaml:"tls" toml:"tls"`
+	Timeouts      TimeoutsConfig      `yaml:"timeouts" toml:"timeouts"`
+	Database      DatabaseConfig      `yaml:"database" toml:"database"`
+	Limits        LimitsConfig        `yaml:"limits" toml:"limits"`
+	Retention     RetentionConfig     `yaml:"retention" toml:"retention"`
+	Observability ObservabilityConfig `yaml:"observability" toml:"observability"`
+}
+
+type TLSConfig struct {
+	// Paths to the PEM encoded certificate and private key. If neither is set, the server uses plain HTTP.
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+}
+
+type TimeoutsConfig struct {
+	// The maximum time to read a request, including the body
+	Read Duration `yaml:"read" toml:"read"`
+	// The maximum time to write a response, which needs to be long enough to stream a bootstrap of a large history
+	Write Duration `yaml:"write" toml:"write"`
+	// How long to keep idle keep-alive connections open
+	Idle Duration `yaml:"idle" toml:"idle"`
+	// How long to wait for in-flight requests to finish when shutting down
+	Shutdown Duration `yaml:"shutdown" toml:"shutdown"`
+}
+
+type DatabaseConfig struct {
+	// Either postgres or sqlite
+	Driver string `yaml:"driver" toml:"driver"`
+	// The postgres connection string, or the path to the SQLite DB
+	DSN string `yaml:"dsn" toml:"dsn"`
+}
+
+type LimitsConfig struct {
+	// The maximum number of users that can register, or 0 to allow registrations with no cap
+	MaxNumUsers int `yaml:"max_num_users" toml:"max_num_users"`
+	// Token bucket rate limits on requests from each user and each IP. Up to burst requests can be made at once, and
+	// then requests_per_second after that. A rate of 0 disables the limit.
+	UserRequestsPerSecond float64 `yaml:"user_requests_per_second" toml:"user_requests_per_second"`
+	UserBurst             int     `yaml:"user_burst" toml:"user_burst"`
+	IpRequestsPerSecond   float64 `yaml:"ip_requests_per_second" toml:"ip_requests_per_second"`
+	IpBurst               int     `yaml:"ip_burst" toml:"ip_burst"`
+	// The IPs (or CIDR ranges) of the reverse proxies in front of the backend. The per-IP limits and logs use the
+	// X-Real-Ip header of requests from these proxies, and the address of the connection for all other requests.
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	// Quotas on the entries stored for each user, summed across all of their devices, or 0 for no limit. Entries are
+	// only stored until every device has synced them, so these only need to fit the entries that are waiting to sync.
+	MaxEntriesPerUser int64 `yaml:"max_entries_per_user" toml:"max_entries_per_user"`
+	MaxBytesPerUser   int64 `yaml:"max_bytes_per_user" toml:"max_bytes_per_user"`
+}
+
+type RetentionConfig struct {
+	// How often to delete entries and deletion requests that have already been retrieved
+	CleanupInterval Duration `yaml:"cleanup_interval" toml:"cleanup_interval"`
+	// Entries and deletion requests are deleted once they've been read more than this many times
+	MaxEntryReadCount           int `yaml:"max_entry_read_count" toml:"max_entry_read_count"`
+	MaxDeletionRequestReadCount int `yaml:"max_deletion_request_read_count" toml:"max_deletion_request_read_count"`
+	// Whether to look for stale entries from users that have been inactive for longer than InactiveUserAge on
+	// startup. This is only supported for postgres.
+	DeepClean       bool     `yaml:"deep_clean" toml:"deep_clean"`
+	InactiveUserAge Duration `yaml:"inactive_user_age" toml:"inactive_user_age"`
+}
+
+type ObservabilityConfig struct {
+	// Where metrics are reported, one of datadog, prometheus (served at /metrics) or none
+	Metrics string `yaml:"metrics" toml:"metrics"`
+	// Whether to send traces and profiles to the local Datadog agent, and serve pprof at /debug/pprof/
+	Tracing bool `yaml:"tracing" toml:"tracing"`
+}
+
+// Duration is a time.Duration that is written in config files as a string such as "10m"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// GLOBAL_CONFIG is the config that is used by all of the handlers and background jobs
+var GLOBAL_CONFIG Config = DefaultConfig()
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddress: ":8080",
+		Timeouts: TimeoutsConfig{
+			Read:     Duration{time.Minute},
+			Write:    Duration{5 * time.Minute},
+			Idle:     Duration{2 * time.Minute},
+			Shutdown: Duration{30 * time.Second},
+		},
+		Database: DatabaseConfig{Driver: "postgres"},
+		Retention: RetentionConfig{
+			CleanupInterval:             Duration{10 * time.Minute},
+			MaxEntryReadCount:           10,
+			MaxDeletionRequestReadCount: 100,
+			InactiveUserAge:             Duration{90 * 24 * time.Hour},
+		},
+		Observability: ObservabilityConfig{Metrics: "none"},
+	}
+}
+
+// LoadConfigFile reads the YAML or TOML (based on the file extension) config file at the given path into cfg. Options
+// that aren't set in the file are left unchanged, and unknown options are rejected.
+func LoadConfigFile(path string, cfg *Config) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+		if errors.Is(err, io.EOF) {
+			// The file is empty
+			err = nil
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(contents))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+		var strictErr *toml.StrictMissingError
+		if errors.As(err, &strictErr) {
+			// The default message doesn't say which options are unknown
+			err = fmt.Errorf("unknown options:\n%s", strictErr.String())
+		}
+	default:
+		return fmt.Errorf("unsupported config file %#v, expected a .yaml, .yml or .toml file", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %#v: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks that the config is usable, and returns an error listing every problem with it
+func (cfg Config) Validate() error {
+	var problems []string
+	if cfg.Environment != "" && cfg.Environment != "dev" && cfg.Environment != "prod" {
+		problems = append(problems, fmt.Sprintf("environment must be one of dev or prod, got %#v", cfg.Environment))
+	}
+	if _, _, err := net.SplitHostPort(cfg.ListenAddress); err != nil {
+		problems = append(problems, fmt.Sprintf("listen_address must be of the form host:port, got %#v", cfg.ListenAddress))
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		problems = append(problems, "tls.cert_file and tls.key_file must be set together")
+	}
+	for _, file := range []string{cfg.TLS.CertFile, cfg.TLS.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to read TLS file: %v", err))
+		}
+	}
+	for _, timeout := range []struct {
+		name  string
+		value Duration
+	}{{"read", cfg.Timeouts.Read}, {"write", cfg.Timeouts.Write}, {"idle", cfg.Timeouts.Idle}, {"shutdown", cfg.Timeouts.Shutdown}} {
+		if timeout.value.Duration <= 0 {
+			problems = append(problems, fmt.Sprintf("timeouts.%s must be positive, got %s", timeout.name, timeout.value))
+		}
+	}
+	switch cfg.Database.Driver {
+	case "postgres", "sqlite":
+		if cfg.Database.DSN == "" {
+			problems = append(problems, "database.dsn must be set")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("database.driver must be one of postgres or sqlite, got %#v", cfg.Database.Driver))
+	}
+	if cfg.Limits.MaxNumUsers < 0 {
+		problems = append(problems, fmt.Sprintf("limits.max_num_users must not be negative, got %d", cfg.Limits.MaxNumUsers))
+	}
+	for _, limit := range []struct {
+		name              string
+		requestsPerSecond float64
+		burst             int
+	}{{"user", cfg.Limits.UserRequestsPerSecond, cfg.Limits.UserBurst}, {"ip", cfg.Limits.IpRequestsPerSecond, cfg.Limits.IpBurst}} {
+		if limit.requestsPerSecond < 0 {
+			problems = append(problems, fmt.Sprintf("limits.%s_requests_per_second must not be negative, got %v", limit.name, limit.requestsPerSecond))
+		}
+		if limit.requestsPerSecond > 0 && limit.burst < 1 {
+			problems = append(problems, fmt.Sprintf("limits.%s_burst must be at least 1 when limits.%s_requests_per_second is set, got %d", limit.name, limit.name, limit.burst))
+		}
+	}
+	for _, proxy := range cfg.Limits.TrustedProxies {
+		if parseTrustedProxy(proxy) == nil {
+			problems = append(problems, fmt.Sprintf("limits.trusted_proxies must contain IPs or CIDR ranges, got %#v", proxy))
+		}
+	}
+	if cfg.Limits.MaxEntriesPerUser < 0 {
+		problems = append(problems, fmt.Sprintf("limits.max_entries_per_user must not be negative, got %d", cfg.Limits.MaxEntriesPerUser))
+	}
+	if cfg.Limits.MaxBytesPerUser < 0 {
+		problems = append(problems, fmt.Sprintf("limits.max_bytes_per_user must not be negative, got %d", cfg.Limits.MaxBytesPerUser))
+	}
+	if cfg.Retention.CleanupInterval.Duration <= 0 {
+		problems = append(problems, fmt.Sprintf("retention.cleanup_interval must be positive, got %s", cfg.Retention.CleanupInterval))
+	}
+	if cfg.Retention.MaxEntryReadCount <= 0 {
+		problems = append(problems, fmt.Sprintf("retention.max_entry_read_count must be positive, got %d", cfg.Retention.MaxEntryReadCount))
+	}
+	if cfg.Retention.MaxDeletionRequestReadCount <= 0 {
+		problems = append(problems, fmt.Sprintf("retention.max_deletion_request_read_count must be positive, got %d", cfg.Retention.MaxDeletionRequestReadCount))
+	}
+	if cfg.Retention.DeepClean {
+		if cfg.Database.Driver != "postgres" {
+			problems = append(problems, "retention.deep_clean is only supported for postgres")
+		}
+		if cfg.Retention.InactiveUserAge.Duration < time.Hour {
+			problems = append(problems, fmt.Sprintf("retention.inactive_user_age must be at least 1h, got %s", cfg.Retention.InactiveUserAge))
+		}
+	}
+	switch cfg.Observability.Metrics {
+	case "datadog", "prometheus", "none":
+	default:
+		problems = append(problems, fmt.Sprintf("observability.metrics must be one of datadog, prometheus or none, got %#v", cfg.Observability.Metrics))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid server config:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
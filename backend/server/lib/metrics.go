@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// StatsClient is the subset of the statsd client that is used for reporting metrics. Tags are of the form
+// KEY:value (or KEY=value).
+type StatsClient interface {
+	Count(name string, value int64, tags []string, rate float64) error
+	Incr(name string, tags []string, rate float64) error
+	Gauge(name string, value float64, tags []string, rate float64) error
+	Distribution(name string, value float64, tags []string, rate float64) error
+	Flush() error
+}
+
+// PrometheusStats is a StatsClient that keeps metrics in memory so that Prometheus can scrape them from Handler.
+// Metrics are created the first time they're reported, and each metric must always be reported with the same set
+// of tag keys.
+type PrometheusStats struct {
+	registry   *prometheus.Registry
+	lock       sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+func NewPrometheusStats() *PrometheusStats {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector())
+	registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return &PrometheusStats{
+		registry:   registry,
+		counters:   make(map[string]*prometheus.CounterVec),
+		gauges:     make(map[string]*prometheus.GaugeVec),
+		histograms: make(map[string]*prometheus.HistogramVec),
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (p *PrometheusStats) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+func (p *PrometheusStats) Count(name string, value int64, tags []string, rate float64) error {
+	labels := parseTags(tags)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	counter, ok := p.counters[name]
+	if !ok {
+		counter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: prometheusName(name) + "_total", Help: name}, labelNames(labels))
+		if err := p.registry.Register(counter); err != nil {
+			return fmt.Errorf("failed to register counter %#v: %v", name, err)
+		}
+		p.counters[name] = counter
+	}
+	c, err := counter.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	c.Add(float64(value))
+	return nil
+}
+
+func (p *PrometheusStats) Incr(name string, tags []string, rate float64) error {
+	return p.Count(name, 1, tags, rate)
+}
+
+func (p *PrometheusStats) Gauge(name string, value float64, tags []string, rate float64) error {
+	labels := parseTags(tags)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	gauge, ok := p.gauges[name]
+	if !ok {
+		gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: prometheusName(name), Help: name}, labelNames(labels))
+		if err := p.registry.Register(gauge); err != nil {
+			return fmt.Errorf("failed to register gauge %#v: %v", name, err)
+		}
+		p.gauges[name] = gauge
+	}
+	g, err := gauge.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	g.Set(value)
+	return nil
+}
+
+func (p *PrometheusStats) Distribution(name string, value float64, tags []string, rate float64) error {
+	labels := parseTags(tags)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	histogram, ok := p.histograms[name]
+	if !ok {
+		// Distributions are either latencies in milliseconds or numbers of entries, which both fit in 1 to 32768
+		histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: prometheusName(name), Help: name, Buckets: prometheus.ExponentialBuckets(1, 2, 16)}, labelNames(labels))
+		if err := p.registry.Register(histogram); err != nil {
+			return fmt.Errorf("failed to register histogram %#v: %v", name, err)
+		}
+		p.histograms[name] = histogram
+	}
+	h, err := histogram.GetMetricWith(labels)
+	if err != nil {
+		return err
+	}
+	h.Observe(value)
+	return nil
+}
+
+// Flush is a no-op since Prometheus pulls metrics rather than having them pushed
+func (p *PrometheusStats) Flush() error {
+	return nil
+}
+
+var invalidPrometheusChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func prometheusName(name string) string {
+	return invalidPrometheusChars.ReplaceAllString(name, "_")
+}
+
+func parseTags(tags []string) prometheus.Labels {
+	labels := make(prometheus.Labels)
+	for _, tag := range tags {
+		key, value := tag, ""
+		if i := strings.IndexAny(tag, ":="); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		labels[prometheusName(strings.ToLower(key))] = value
+	}
+	return labels
+}
+
+func labelNames(labels prometheus.Labels) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const dbStartTimeKey = "hishtory:start_time"
+
+// registerDbMetrics adds callbacks to the DB that report how long each query takes
+func registerDbMetrics(db *gorm.DB) error {
+	start := func(db *gorm.DB) {
+		db.InstanceSet(dbStartTimeKey, time.Now())
+	}
+	finish := func(operation string) func(*gorm.DB) {
+		return func(db *gorm.DB) {
+			startTime, ok := db.InstanceGet(dbStartTimeKey)
+			if !ok || GLOBAL_STATSD == nil {
+				return
+			}
+			duration := time.Since(startTime.(time.Time))
+			GLOBAL_STATSD.Distribution("hishtory.db.duration", float64(duration.Microseconds())/1_000, []string{"OPERATION:" + operation}, 1.0)
+		}
+	}
+	callback := db.Callback()
+	for _, err := range []error{
+		callback.Create().Before("gorm:create").Register("hishtory:start_create", start),
+		callback.Create().After("gorm:create").Register("hishtory:finish_create", finish("create")),
+		callback.Query().Before("gorm:query").Register("hishtory:start_query", start),
+		callback.Query().After("gorm:query").Register("hishtory:finish_query", finish("query")),
+		callback.Update().Before("gorm:update").Register("hishtory:start_update", start),
+		callback.Update().After("gorm:update").Register("hishtory:finish_update", finish("update")),
+		callback.Delete().Before("gorm:delete").Register("hishtory:start_delete", start),
+		callback.Delete().After("gorm:delete").Register("hishtory:finish_delete", finish("delete")),
+		callback.Row().Before("gorm:row").Register("hishtory:start_row", start),
+		callback.Row().After("gorm:row").Register("hishtory:finish_row", finish("row")),
+		callback.Raw().Before("gorm:raw").Register("hishtory:start_raw", start),
+		callback.Raw().After("gorm:raw").Register("hishtory:finish_raw", finish("raw")),
+	} {
+		if err != nil {
+			return fmt.Errorf("failed to register DB metrics callback: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ddworken/hishtory/shared"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter holds a token bucket for each user and IP that has recently made requests
+type rateLimiter struct {
+	lock      sync.Mutex
+	buckets   map[string]*rateLimiterBucket
+	lastSweep time.Time
+}
+
+type rateLimiterBucket struct {
+	limiter *rate.Limiter
+	// Once the bucket is full again, it is equivalent to a new bucket so it can be forgotten
+	fullAt time.Time
+}
+
+var requestRateLimiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*rateLimiterBucket)}
+}
+
+// reserve takes a token from the bucket for the given key. If the bucket is empty, it returns how long until a token
+// is available.
+func (r *rateLimiter) reserve(key string, limit rate.Limit, burst int) (bool, time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if now.Sub(r.lastSweep) > time.Minute {
+		for k, bucket := range r.buckets {
+			if now.After(bucket.fullAt) {
+				delete(r.buckets, k)
+			}
+		}
+		r.lastSweep = now
+	}
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &rateLimiterBucket{limiter: rate.NewLimiter(limit, burst)}
+		r.buckets[key] = bucket
+	}
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	bucket.fullAt = now.Add(time.Duration(float64(burst) / float64(limit) * float64(time.Second)))
+	return true, 0
+}
+
+func checkRateLimit(w http.ResponseWriter, key, description string, requestsPerSecond float64, burst int) error {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+	ok, delay := requestRateLimiter.reserve(key, rate.Limit(requestsPerSecond), burst)
+	if ok {
+		return nil
+	}
+	retryAfter := int(math.Ceil(delay.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return newApiError(http.StatusTooManyRequests, shared.ErrorCodeRateLimited, "too many requests from this %s, retry in %ds", description, retryAfter)
+}
+
+func checkIpRateLimit(w http.ResponseWriter, r *http.Request) error {
+	return checkRateLimit(w, "ip:"+getRemoteAddr(r), "IP", GLOBAL_CONFIG.Limits.IpRequestsPerSecond, GLOBAL_CONFIG.Limits.IpBurst)
+}
+
+func checkUserRateLimit(w http.ResponseWriter, userId string) error {
+	return checkRateLimit(w, "user:"+userId, "user", GLOBAL_CONFIG.Limits.UserRequestsPerSecond, GLOBAL_CONFIG.Limits.UserBurst)
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range GLOBAL_CONFIG.Limits.TrustedProxies {
+		if ipNet := parseTrustedProxy(proxy); ipNet != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses an entry of limits.trusted_proxies, which is either a CIDR range or a single IP. Returns nil if it is neither.
+func parseTrustedProxy(proxy string) *net.IPNet {
+	if _, ipNet, err := net.ParseCIDR(proxy); err == nil {
+		return ipNet
+	}
+	ip := net.ParseIP(proxy)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// storageUsageCache remembers how much each user is storing, so that the quotas can be checked without scanning all of
+// the user's entries on every submission. Submissions add to the cached usage, and entries are only ever deleted
+// otherwise, so the cached usage can only overestimate how much is stored. A submission that would exceed a quota
+// based on the cached usage recomputes it first, so that entries that have since been deleted aren't counted.
+type storageUsageCache struct {
+	lock      sync.Mutex
+	usages    map[string]*storageUsage
+	lastSweep time.Time
+}
+
+type storageUsage struct {
+	NumEntries int64
+	NumBytes   int64
+	// When the usage was computed from the DB
+	computedAt time.Time
+}
+
+const (
+	// How long the cached usage is used for before it is recomputed, since other backend instances may have stored
+	// entries for the user in the meantime
+	storageUsageMaxAge = time.Minute
+	// A submission that exceeds a quota only recomputes the usage if it is older than this, so that a user who is
+	// over their quota can't trigger a scan on every request
+	storageUsageRecheckInterval = 10 * time.Second
+)
+
+var storageUsages = newStorageUsageCache()
+
+func newStorageUsageCache() *storageUsageCache {
+	return &storageUsageCache{usages: make(map[string]*storageUsage)}
+}
+
+// get returns the cached usage for the user, if there is one that isn't too old to use
+func (c *storageUsageCache) get(userId string) (storageUsage, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > storageUsageMaxAge {
+		for k, usage := range c.usages {
+			if now.Sub(usage.computedAt) > storageUsageMaxAge {
+				delete(c.usages, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	usage, ok := c.usages[userId]
+	if !ok || now.Sub(usage.computedAt) > storageUsageMaxAge {
+		return storageUsage{}, false
+	}
+	return *usage, true
+}
+
+func (c *storageUsageCache) set(userId string, usage storageUsage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.usages[userId] = &usage
+}
+
+// add records that entries were stored for the user. This updates the cached usage in place rather than overwriting
+// it, so that concurrent submissions are all counted.
+func (c *storageUsageCache) add(userId string, numEntries, numBytes int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if usage, ok := c.usages[userId]; ok {
+		usage.NumEntries += numEntries
+		usage.NumBytes += numBytes
+	}
+}
+
+// checkStorageQuota returns an error if storing the given entries for the given number of devices would exceed the
+// per-user quotas. Concurrent submissions may each pass the check, so the quotas can be exceeded by a few requests.
+func checkStorageQuota(ctx context.Context, userId string, entries []*shared.EncHistoryEntry, numDevices int) error {
+	maxEntries := GLOBAL_CONFIG.Limits.MaxEntriesPerUser
+	maxBytes := GLOBAL_CONFIG.Limits.MaxBytesPerUser
+	if maxEntries <= 0 && maxBytes <= 0 {
+		return nil
+	}
+	var newBytes int64
+	for _, entry := range entries {
+		newBytes += int64(len(entry.EncryptedData) + len(entry.Nonce))
+	}
+	newEntries := int64(len(entries) * numDevices)
+	newBytes *= int64(numDevices)
+
+	usage, ok := storageUsages.get(userId)
+	if !ok || (checkQuotas(usage, newEntries, newBytes) != nil && time.Since(usage.computedAt) > storageUsageRecheckInterval) {
+		usage = storageUsage{computedAt: time.Now()}
+		if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Raw("SELECT COUNT(*) AS num_entries, COALESCE(SUM(LENGTH(encrypted_data) + LENGTH(nonce)), 0) AS num_bytes FROM enc_history_entries WHERE user_id = ?", userId).Scan(&usage)); err != nil {
+			return err
+		}
+		storageUsages.set(userId, usage)
+	}
+	if err := checkQuotas(usage, newEntries, newBytes); err != nil {
+		return err
+	}
+	storageUsages.add(userId, newEntries, newBytes)
+	return nil
+}
+
+func checkQuotas(usage storageUsage, newEntries, newBytes int64) error {
+	maxEntries := GLOBAL_CONFIG.Limits.MaxEntriesPerUser
+	maxBytes := GLOBAL_CONFIG.Limits.MaxBytesPerUser
+	const explanation = "Entries are deleted from the server once all of your devices have synced them, so make sure your other devices are online or revoke the ones you no longer use with `hishtory devices revoke`"
+	if maxEntries > 0 && usage.NumEntries+newEntries > maxEntries {
+		return newApiError(http.StatusForbidden, shared.ErrorCodeQuotaExceeded, "this server stores at most %d entries per user and %d are already waiting to be synced. %s", maxEntries, usage.NumEntries, explanation)
+	}
+	if maxBytes > 0 && usage.NumBytes+newBytes > maxBytes {
+		return newApiError(http.StatusForbidden, shared.ErrorCodeQuotaExceeded, "this server stores at most %s of entries per user and %s are already waiting to be synced. %s", byteCountToString(int(maxBytes)), byteCountToString(int(usage.NumBytes)), explanation)
+	}
+	return nil
+}
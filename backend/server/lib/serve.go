@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Serve serves the handler on the configured address, over TLS if a certificate is configured. Once the context is
+// cancelled, it stops accepting new connections and waits for in-flight requests to finish (for up to the shutdown
+// timeout) before returning.
+func Serve(ctx context.Context, cfg Config, handler http.Handler) error {
+	listener, err := net.Listen("tcp", cfg.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", cfg.ListenAddress, err)
+	}
+	return serveListener(ctx, listener, cfg, handler)
+}
+
+func serveListener(ctx context.Context, listener net.Listener, cfg Config, handler http.Handler) error {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       cfg.Timeouts.Read.Duration,
+		WriteTimeout:      cfg.Timeouts.Write.Duration,
+		IdleTimeout:       cfg.Timeouts.Idle.Duration,
+	}
+	if cfg.TLS.CertFile != "" {
+		reloader, err := newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate, so no files are passed here
+			serveErr <- server.ServeTLS(listener, "", "")
+		} else {
+			serveErr <- server.Serve(listener)
+		}
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down, waiting for in-flight requests to finish")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown.Duration)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		// Some requests (e.g. streaming bootstraps) didn't finish in time, so cut them off
+		server.Close()
+		return fmt.Errorf("failed to gracefully shut down: %v", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// certReloader serves the TLS certificate from disk, and reloads it whenever the files are modified so that renewed
+// certificates are picked up without restarting the server
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	err = r.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat TLS file: %v", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	// Even if loading fails, remember the modification time so that a bad certificate isn't retried on every request
+	r.modTime = modTime
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	r.cert = &cert
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	modTime, err := r.latestModTime()
+	if err == nil && modTime.After(r.modTime) {
+		err = r.load(modTime)
+	}
+	if err != nil {
+		// Keep serving the previous certificate, since it is likely that the files are in the middle of being replaced
+		fmt.Printf("Error while reloading the TLS certificate, continuing to use the previous one: %v\n", err)
+	}
+	return r.cert, nil
+}
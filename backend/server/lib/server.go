@@ -0,0 +1,1639 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/shared"
+	"github.com/glebarez/sqlite"
+	"github.com/rodaine/table"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	// The header used to prove knowledge of the user secret when registering a device
+	UserTokenHeader = "X-Hishtory-User-Token"
+)
+
+var (
+	GLOBAL_DB      *gorm.DB
+	GLOBAL_STATSD  StatsClient
+	ReleaseVersion string = "UNKNOWN"
+	// Whether the cron updates ReleaseVersion to the latest release on GitHub. Self-hosted servers instead keep
+	// serving the version that they were started with, so that they don't depend on reaching GitHub.
+	TrackLatestRelease bool = true
+)
+
+// StartSpan starts tracing the named operation and returns a function that finishes the span. By default nothing
+// is traced, since tracing is only configured for the production server.
+var StartSpan = func(ctx context.Context, operationName string) (context.Context, func(error)) {
+	return ctx, func(error) {}
+}
+
+type UsageData struct {
+	UserId            string    `json:"user_id" gorm:"not null; uniqueIndex:usageDataUniqueIndex"`
+	DeviceId          string    `json:"device_id"  gorm:"not null; uniqueIndex:usageDataUniqueIndex"`
+	LastUsed          time.Time `json:"last_used"`
+	LastIp            string    `json:"last_ip"`
+	NumEntriesHandled int       `json:"num_entries_handled"`
+	LastQueried       time.Time `json:"last_queried"`
+	NumQueries        int       `json:"num_queries"`
+	Version           string    `json:"version"`
+}
+
+// newApiError builds an error that is sent to the client as a JSON shared.ApiError
+func newApiError(statusCode int, code, format string, args ...interface{}) *shared.ApiError {
+	return &shared.ApiError{StatusCode: statusCode, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func getRequiredQueryParam(r *http.Request, queryParam string) (string, error) {
+	val := r.URL.Query().Get(queryParam)
+	if val == "" {
+		return "", newApiError(http.StatusBadRequest, shared.ErrorCodeBadRequest, "request is missing required query param=%#v", queryParam)
+	}
+	return val, nil
+}
+
+// Returns an error unless the request uses the given method, for endpoints that modify state so that they can't be
+// triggered by a GET
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) error {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		return newApiError(http.StatusMethodNotAllowed, shared.ErrorCodeBadRequest, "%s requires a %s request, got %s", r.URL.Path, method, r.Method)
+	}
+	return nil
+}
+
+func getHishtoryVersion(r *http.Request) string {
+	return r.Header.Get("X-Hishtory-Version")
+}
+
+func updateUsageData(ctx context.Context, r *http.Request, userId, deviceId string, numEntriesHandled int, isQuery bool) {
+	var usageData []UsageData
+	GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND device_id = ?", userId, deviceId).Find(&usageData)
+	if len(usageData) == 0 {
+		GLOBAL_DB.WithContext(ctx).Create(&UsageData{UserId: userId, DeviceId: deviceId, LastUsed: time.Now(), NumEntriesHandled: numEntriesHandled, Version: getHishtoryVersion(r)})
+	} else {
+		usage := usageData[0]
+		GLOBAL_DB.WithContext(ctx).Model(&UsageData{}).Where("user_id = ? AND device_id = ?", userId, deviceId).Update("last_used", time.Now()).Update("last_ip", getRemoteAddr(r))
+		if numEntriesHandled > 0 {
+			GLOBAL_DB.WithContext(ctx).Exec("UPDATE usage_data SET num_entries_handled = COALESCE(num_entries_handled, 0) + ? WHERE user_id = ? AND device_id = ?", numEntriesHandled, userId, deviceId)
+		}
+		if usage.Version != getHishtoryVersion(r) {
+			GLOBAL_DB.WithContext(ctx).Exec("UPDATE usage_data SET version = ? WHERE user_id = ? AND device_id = ?", getHishtoryVersion(r), userId, deviceId)
+		}
+	}
+	if isQuery {
+		GLOBAL_DB.WithContext(ctx).Exec("UPDATE usage_data SET num_queries = COALESCE(num_queries, 0) + 1, last_queried = ? WHERE user_id = ? AND device_id = ?", time.Now(), userId, deviceId)
+	}
+}
+
+func usageStatsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	query := `
+	SELECT 
+		MIN(devices.registration_date) as registration_date, 
+		COUNT(DISTINCT devices.device_id) as num_devices,
+		SUM(usage_data.num_entries_handled) as num_history_entries,
+		MAX(usage_data.last_used) as last_active,
+		COALESCE(STRING_AGG(DISTINCT usage_data.last_ip, ', ') FILTER (WHERE usage_data.last_ip != 'Unknown' AND usage_data.last_ip != 'UnknownIp'), 'Unknown')  as ip_addresses,
+		COALESCE(SUM(usage_data.num_queries), 0) as num_queries,
+		COALESCE(MAX(usage_data.last_queried), 'January 1, 1970') as last_queried,
+		STRING_AGG(DISTINCT usage_data.version, ', ') as versions
+	FROM devices
+	INNER JOIN usage_data ON devices.device_id = usage_data.device_id
+	GROUP BY devices.user_id
+	ORDER BY registration_date
+	`
+	rows, err := GLOBAL_DB.WithContext(ctx).Raw(query).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tbl := table.New("Registration Date", "Num Devices", "Num Entries", "Num Queries", "Last Active", "Last Query", "Versions", "IPs")
+	tbl.WithWriter(w)
+	for rows.Next() {
+		var registrationDate time.Time
+		var numDevices int
+		var numEntries int
+		var lastUsedDate time.Time
+		var ipAddresses string
+		var numQueries int
+		var lastQueried time.Time
+		var versions string
+		err = rows.Scan(&registrationDate, &numDevices, &numEntries, &lastUsedDate, &ipAddresses, &numQueries, &lastQueried, &versions)
+		if err != nil {
+			return err
+		}
+		versions = strings.ReplaceAll(strings.ReplaceAll(versions, "Unknown", ""), ", ", "")
+		lastQueryStr := strings.ReplaceAll(lastQueried.Format("2006-01-02"), "1970-01-01", "")
+		tbl.AddRow(registrationDate.Format("2006-01-02"), numDevices, numEntries, numQueries, lastUsedDate.Format("2006-01-02"), lastQueryStr, versions, ipAddresses)
+	}
+	tbl.Print()
+	return nil
+}
+
+func statsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var numDevices int64 = 0
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Count(&numDevices)); err != nil {
+		return err
+	}
+	type numEntriesProcessed struct {
+		Total int
+	}
+	nep := numEntriesProcessed{}
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&UsageData{}).Select("SUM(num_entries_handled) as total").Find(&nep)); err != nil {
+		return err
+	}
+	var numDbEntries int64 = 0
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.EncHistoryEntry{}).Count(&numDbEntries)); err != nil {
+		return err
+	}
+
+	lastWeek := time.Now().AddDate(0, 0, -7)
+	var weeklyActiveInstalls int64 = 0
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&UsageData{}).Where("last_used > ?", lastWeek).Count(&weeklyActiveInstalls)); err != nil {
+		return err
+	}
+	var weeklyQueryUsers int64 = 0
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&UsageData{}).Where("last_queried > ?", lastWeek).Count(&weeklyQueryUsers)); err != nil {
+		return err
+	}
+	var lastRegistration string = ""
+	row := GLOBAL_DB.WithContext(ctx).Raw("select to_char(max(registration_date), 'DD Month YYYY HH24:MI') from devices").Row()
+	err := row.Scan(&lastRegistration)
+	if err != nil {
+		return err
+	}
+	w.Write([]byte(fmt.Sprintf("Num devices: %d\n", numDevices)))
+	w.Write([]byte(fmt.Sprintf("Num history entries processed: %d\n", nep.Total)))
+	w.Write([]byte(fmt.Sprintf("Num DB entries: %d\n", numDbEntries)))
+	w.Write([]byte(fmt.Sprintf("Weekly active installs: %d\n", weeklyActiveInstalls)))
+	w.Write([]byte(fmt.Sprintf("Weekly active queries: %d\n", weeklyQueryUsers)))
+	w.Write([]byte(fmt.Sprintf("Last registration: %s\n", lastRegistration)))
+	return nil
+}
+
+func apiSubmitHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var entries []*shared.EncHistoryEntry
+	err := readJsonBody(r, maxRequestBodySize, &entries)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("apiSubmitHandler: received request containg %d EncHistoryEntry\n", len(entries))
+	if len(entries) == 0 {
+		return nil
+	}
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.UserId != userId {
+			return newApiError(http.StatusBadRequest, shared.ErrorCodeBadRequest, "batch contains an entry with UserId=%#v, when the query param contained the user_id=%#v", entry.UserId, userId)
+		}
+	}
+	updateUsageData(ctx, r, userId, entries[0].DeviceId, len(entries), false)
+	// Ordered by device ID so that concurrent submissions lock the devices in the same order
+	tx := GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND is_revoked = ?", userId, false).Order("device_id")
+	var devices []*shared.Device
+	if err := checkGormResult(tx.Find(&devices)); err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return newApiError(http.StatusNotFound, shared.ErrorCodeNotFound, "found no devices associated with user_id=%s, can't save history entry", userId)
+	}
+	fmt.Printf("apiSubmitHandler: Found %d devices\n", len(devices))
+	if err := checkStorageQuota(ctx, userId, entries, len(devices)); err != nil {
+		return err
+	}
+	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, device := range devices {
+			firstSeq, err := allocateSeqs(tx, userId, device.DeviceId, len(entries))
+			if err != nil {
+				return err
+			}
+			for i, entry := range entries {
+				entry.DeviceId = device.DeviceId
+				entry.Seq = firstSeq + int64(i)
+			}
+			// Chunk the inserts to prevent the `extended protocol limited to 65535 parameters` error
+			for _, entriesChunk := range shared.Chunks(entries, 1000) {
+				if err := checkGormResult(tx.Create(&entriesChunk)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute transaction to add entries to DB: %w", err)
+	}
+	if GLOBAL_STATSD != nil {
+		GLOBAL_STATSD.Count("hishtory.submit", int64(len(devices)), []string{}, 1.0)
+		GLOBAL_STATSD.Count("hishtory.submit.entries", int64(len(entries)), []string{}, 1.0)
+	}
+	return nil
+}
+
+const (
+	// The largest request body (after decompression) that is accepted, which bounds the memory that each request can
+	// hold. Clients submit entries in batches of at most 1000, which is a small fraction of this.
+	maxRequestBodySize = 16 * 1024 * 1024
+	// Dumps contain the whole history of the device that sends them in one request, so they're allowed to be larger
+	maxDumpBodySize = 128 * 1024 * 1024
+)
+
+// Reads the request body, which must be at most maxSize bytes, and parses it as JSON into v
+func readJsonBody(r *http.Request, maxSize int64, v interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return newApiError(http.StatusBadRequest, shared.ErrorCodeBadRequest, "failed to read the request body: %v", err)
+	}
+	if int64(len(data)) > maxSize {
+		return newApiError(http.StatusRequestEntityTooLarge, shared.ErrorCodeBadRequest, "the request body is larger than the maximum of %s", byteCountToString(int(maxSize)))
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return newApiError(http.StatusBadRequest, shared.ErrorCodeBadRequest, "failed to parse the request body: %v", err)
+	}
+	return nil
+}
+
+// Reserves n sequence numbers for entries destined for the given device and returns the first of them. This must
+// be called from within the transaction that inserts the entries. Updating the device row locks it until the
+// transaction commits, so entries for a device are committed in sequence order and a device that syncs from a
+// cursor can never skip over an entry that is committed later with a lower sequence number.
+func allocateSeqs(tx *gorm.DB, userId, deviceId string, n int) (int64, error) {
+	r := tx.Exec("UPDATE devices SET last_seq = last_seq + ? WHERE user_id = ? AND device_id = ? AND is_revoked = ?", n, userId, deviceId, false)
+	if r.Error != nil {
+		return 0, fmt.Errorf("failed to allocate sequence numbers: %v", r.Error)
+	}
+	var lastSeq int64
+	r = tx.Raw("SELECT COALESCE(MAX(last_seq), 0) FROM devices WHERE user_id = ? AND device_id = ? AND is_revoked = ?", userId, deviceId, false).Scan(&lastSeq)
+	if r.Error != nil {
+		return 0, fmt.Errorf("failed to allocate sequence numbers: %v", r.Error)
+	}
+	if lastSeq < int64(n) {
+		return 0, fmt.Errorf("failed to allocate sequence numbers: no unrevoked device with device_id=%s", deviceId)
+	}
+	return lastSeq - int64(n) + 1, nil
+}
+
+func apiBootstrapHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	deviceId, err := getRequiredQueryParam(r, "device_id")
+	if err != nil {
+		return err
+	}
+	updateUsageData(ctx, r, userId, deviceId, 0, false)
+	if GLOBAL_STATSD != nil {
+		GLOBAL_STATSD.Incr("hishtory.bootstrap", []string{}, 1.0)
+	}
+	if r.URL.Query().Get("format") == "ndjson" {
+		return streamBootstrap(ctx, w, userId)
+	}
+	// Older clients expect a single JSON array
+	tx := GLOBAL_DB.WithContext(ctx).Where("user_id = ?", userId)
+	var historyEntries []*shared.EncHistoryEntry
+	if err := checkGormResult(tx.Find(&historyEntries)); err != nil {
+		return err
+	}
+	fmt.Printf("apiBootstrapHandler: Found %d entries\n", len(historyEntries))
+	if GLOBAL_STATSD != nil {
+		GLOBAL_STATSD.Count("hishtory.bootstrap.entries", int64(len(historyEntries)), []string{}, 1.0)
+	}
+	resp, err := json.Marshal(historyEntries)
+	if err != nil {
+		return err
+	}
+	w.Write(resp)
+	return nil
+}
+
+// The number of entries that streamBootstrap reads from the DB at a time
+const bootstrapBatchSize = 1000
+
+// Streams all of the user's entries as newline delimited JSON, so that a large history is never held in memory
+func streamBootstrap(ctx context.Context, w http.ResponseWriter, userId string) error {
+	var numEntries int64
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.EncHistoryEntry{}).Where("user_id = ?", userId).Count(&numEntries)); err != nil {
+		return err
+	}
+	fmt.Printf("apiBootstrapHandler: Streaming %d entries\n", numEntries)
+	if GLOBAL_STATSD != nil {
+		GLOBAL_STATSD.Count("hishtory.bootstrap.entries", numEntries, []string{}, 1.0)
+	}
+	w.Header().Set("Content-Type", shared.NdjsonContentType)
+	w.Header().Set(shared.TotalEntriesHeader, strconv.FormatInt(numEntries, 10))
+	encoder := json.NewEncoder(w)
+	flusher, canFlush := w.(http.Flusher)
+	// The entries are read in batches with keyset pagination rather than through one cursor, so that a DB connection
+	// isn't held for as long as it takes to write to the client. With SQLite there is only one connection, so holding
+	// it would block every other request. Entries don't have an ID, so they're paginated by their device and their
+	// encrypted ID. If an entry was stored twice for the same device and the copies are split across two batches, the
+	// second copy is skipped, which is harmless since clients de-duplicate entries anyway.
+	lastDeviceId, lastEncryptedId := "", ""
+	numWritten := 0
+	for {
+		var batch []*shared.EncHistoryEntry
+		err := GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND (device_id > ? OR (device_id = ? AND encrypted_id > ?))", userId, lastDeviceId, lastDeviceId, lastEncryptedId).Order("device_id, encrypted_id").Limit(bootstrapBatchSize).Find(&batch).Error
+		if err != nil {
+			if numWritten == 0 {
+				return fmt.Errorf("failed to query entries to bootstrap: %v", err)
+			}
+			// Part of the response was already sent, so abort it rather than letting it look complete
+			fmt.Printf("apiBootstrapHandler: failed to read entries to bootstrap: %v\n", err)
+			panic(http.ErrAbortHandler)
+		}
+		for _, entry := range batch {
+			err = encoder.Encode(entry)
+			if err != nil {
+				// The client went away, so there's no point in continuing
+				fmt.Printf("apiBootstrapHandler: failed to write entry: %v\n", err)
+				return nil
+			}
+			numWritten += 1
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+		if len(batch) < bootstrapBatchSize {
+			return nil
+		}
+		lastDeviceId = batch[len(batch)-1].DeviceId
+		lastEncryptedId = batch[len(batch)-1].EncryptedId
+	}
+}
+
+func apiQueryHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	deviceId, err := getRequiredQueryParam(r, "device_id")
+	if err != nil {
+		return err
+	}
+	updateUsageData(ctx, r, userId, deviceId, 0, true)
+
+	// Delete any entries that match a pending deletion request
+	var deletionRequests []*shared.DeletionRequest
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Where("destination_device_id = ? AND user_id = ?", deviceId, userId).Find(&deletionRequests)); err != nil {
+		return err
+	}
+	for _, request := range deletionRequests {
+		_, err := applyDeletionRequestsToBackend(ctx, *request)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Then retrieve. Clients that support cursors send the sequence number of the last entry they persisted, which
+	// acknowledges every entry up to it. Older clients don't, and instead get every entry that has been read fewer
+	// than 5 times.
+	var tx *gorm.DB
+	afterSeqStr := r.URL.Query().Get("after_seq")
+	isCursorQuery := afterSeqStr != ""
+	if isCursorQuery {
+		afterSeq, err := strconv.ParseInt(afterSeqStr, 10, 64)
+		if err != nil || afterSeq < 0 {
+			return newApiError(http.StatusBadRequest, shared.ErrorCodeBadRequest, "invalid after_seq=%#v", afterSeqStr)
+		}
+		if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Exec("UPDATE devices SET acked_seq = ? WHERE user_id = ? AND device_id = ? AND acked_seq < ?", afterSeq, userId, deviceId, afterSeq)); err != nil {
+			return err
+		}
+		// Entries stored before sequence numbers were introduced have a seq of 0, and are still returned
+		// based on their read count
+		tx = GLOBAL_DB.WithContext(ctx).Where("device_id = ? AND (seq > ? OR (seq = 0 AND read_count < 5))", deviceId, afterSeq).Order("seq")
+	} else {
+		tx = GLOBAL_DB.WithContext(ctx).Where("device_id = ? AND read_count < 5", deviceId)
+	}
+	var historyEntries []*shared.EncHistoryEntry
+	if err := checkGormResult(tx.Find(&historyEntries)); err != nil {
+		return err
+	}
+	fmt.Printf("apiQueryHandler: Found %d entries for %s\n", len(historyEntries), r.URL)
+	resp, err := json.Marshal(historyEntries)
+	if err != nil {
+		return err
+	}
+	entryEncoding, err := getEntryEncoding(ctx, userId)
+	if err != nil {
+		return err
+	}
+	w.Header().Set(shared.EntryEncodingHeader, entryEncoding)
+	w.Write(resp)
+
+	// And finally, kick off a background goroutine that will increment the read count. Doing it in the background avoids
+	// blocking the entire response. This does have a potential race condition, but that is fine.
+	if isProductionEnvironment() {
+		go func() {
+			ctx, finishSpan := StartSpan(ctx, "apiQueryHandler.incrementReadCount")
+			err = incrementReadCounts(ctx, deviceId, isCursorQuery)
+			finishSpan(err)
+		}()
+	} else {
+		err = incrementReadCounts(ctx, deviceId, isCursorQuery)
+		if err != nil {
+			return fmt.Errorf("failed to increment read counts: %v", err)
+		}
+	}
+
+	if GLOBAL_STATSD != nil {
+		GLOBAL_STATSD.Incr("hishtory.query", []string{}, 1.0)
+		GLOBAL_STATSD.Count("hishtory.query.entries", int64(len(historyEntries)), []string{}, 1.0)
+	}
+	return nil
+}
+
+// Returns the encoding that new entries for the given user should be encrypted in. Entries are only compressed once
+// every device can decrypt them, since older versions can't.
+func getEntryEncoding(ctx context.Context, userId string) (string, error) {
+	var numUnsupportedDevices int64
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Where("user_id = ? AND is_revoked = ? AND supports_compressed_entries = ?", userId, false, false).Count(&numUnsupportedDevices)); err != nil {
+		return "", err
+	}
+	if numUnsupportedDevices > 0 {
+		return shared.EncodingIdentity, nil
+	}
+	return shared.EncodingZstd, nil
+}
+
+func supportsCompressedEntries(r *http.Request) bool {
+	return strings.Contains(r.Header.Get(shared.EntryEncodingsHeader), shared.EncodingZstd)
+}
+
+// Increments the read counts of the entries for the given device. For cursor queries, only the entries without a
+// sequence number are incremented since the rest are deleted once they're acknowledged rather than once they've
+// been read enough times.
+func incrementReadCounts(ctx context.Context, deviceId string, isCursorQuery bool) error {
+	if isCursorQuery {
+		return GLOBAL_DB.WithContext(ctx).Exec("UPDATE enc_history_entries SET read_count = read_count + 1 WHERE device_id = ? AND seq = 0", deviceId).Error
+	}
+	return GLOBAL_DB.WithContext(ctx).Exec("UPDATE enc_history_entries SET read_count = read_count + 1 WHERE device_id = ?", deviceId).Error
+}
+
+// Returns the IP that the request came from. If the request came from one of the trusted proxies, this is the
+// X-Real-Ip header that the proxy set. Otherwise the header is ignored, since anyone could set it to evade the limits
+// or to forge the IPs that are logged.
+func getRemoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if realIp := r.Header.Get("X-Real-Ip"); realIp != "" && isTrustedProxy(net.ParseIP(host)) {
+		return realIp
+	}
+	return host
+}
+
+func apiRegisterHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	// Registration isn't authenticated as an existing device, so it is only limited per IP
+	if err := checkIpRateLimit(w, r); err != nil {
+		return err
+	}
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	deviceId, err := getRequiredQueryParam(r, "device_id")
+	if err != nil {
+		return err
+	}
+	token := getBearerToken(r)
+	userToken := r.Header.Get(UserTokenHeader)
+	if token == "" || userToken == "" {
+		return newApiError(http.StatusUnauthorized, shared.ErrorCodeUnauthorized, "registering a device requires a device token and a user token")
+	}
+	var existingDevices []*shared.Device
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ?", userId).Find(&existingDevices)); err != nil {
+		return err
+	}
+	var thisDevice *shared.Device
+	hasUserToken := false
+	for _, device := range existingDevices {
+		if device.UserTokenHash != "" {
+			if !tokenMatchesHash(userToken, device.UserTokenHash) {
+				return newApiError(http.StatusUnauthorized, shared.ErrorCodeUnauthorized, "invalid user token")
+			}
+			hasUserToken = true
+		}
+		if device.DeviceId == deviceId {
+			if device.IsRevoked {
+				return newApiError(http.StatusForbidden, shared.ErrorCodeDeviceRevoked, "this device has been revoked")
+			}
+			thisDevice = device
+		}
+	}
+	if len(existingDevices) > 0 && !hasUserToken {
+		// All of the user's devices were registered before tokens existed, so there is no user token to check this one
+		// against. Trusting whichever user token is presented first would let anyone who knows the user ID take over
+		// the account, so instead only one of the existing devices can set it. Before tokens existed, requests were
+		// authenticated by the user ID and device ID, so that is what authenticates a device's first token.
+		if thisDevice == nil {
+			return newApiError(http.StatusUnauthorized, shared.ErrorCodeUnauthorized, "this user's devices were registered with an older version of hishtory, so update hishtory on one of them before registering a new device")
+		}
+		if thisDevice.TokenHash != "" && !tokenMatchesHash(token, thisDevice.TokenHash) {
+			return newApiError(http.StatusUnauthorized, shared.ErrorCodeUnauthorized, "invalid device token")
+		}
+	}
+	if thisDevice != nil {
+		fmt.Printf("apiRegisterHandler: updating the token for an existing device\n")
+		if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Where("user_id = ? AND device_id = ?", userId, deviceId).Update("token_hash", shared.HashToken(token))); err != nil {
+			return err
+		}
+	}
+	// Users and devices that were registered before tokens existed get them the next time they register
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Where("user_id = ? AND user_token_hash = ''", userId).Update("user_token_hash", shared.HashToken(userToken))); err != nil {
+		return err
+	}
+	if thisDevice != nil {
+		updateUsageData(ctx, r, userId, deviceId, 0, false)
+		return nil
+	}
+
+	if maxNumUsers := GLOBAL_CONFIG.Limits.MaxNumUsers; maxNumUsers > 0 {
+		row := GLOBAL_DB.WithContext(ctx).Raw("SELECT COUNT(DISTINCT devices.user_id) FROM devices").Row()
+		var numDistinctUsers int64 = 0
+		err := row.Scan(&numDistinctUsers)
+		if err != nil {
+			return err
+		}
+		if numDistinctUsers >= int64(maxNumUsers) {
+			return newApiError(http.StatusForbidden, shared.ErrorCodeUserLimitReached, "refusing to allow registration of new device since there are currently %d users and this server allows a max of %d users", numDistinctUsers, maxNumUsers)
+		}
+	}
+	existingDevicesCount := len(existingDevices)
+	fmt.Printf("apiRegisterHandler: existingDevicesCount=%d\n", existingDevicesCount)
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Create(&shared.Device{UserId: userId, DeviceId: deviceId, RegistrationIp: getRemoteAddr(r), RegistrationDate: time.Now(), TokenHash: shared.HashToken(token), UserTokenHash: shared.HashToken(userToken), SupportsCompressedEntries: supportsCompressedEntries(r)})); err != nil {
+		return err
+	}
+	if existingDevicesCount > 0 {
+		if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Create(&shared.DumpRequest{UserId: userId, RequestingDeviceId: deviceId, RequestTime: time.Now()})); err != nil {
+			return err
+		}
+	}
+	updateUsageData(ctx, r, userId, deviceId, 0, false)
+
+	if GLOBAL_STATSD != nil {
+		GLOBAL_STATSD.Incr("hishtory.register", []string{}, 1.0)
+	}
+	return nil
+}
+
+func apiGetPendingDumpRequestsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	deviceId, err := getRequiredQueryParam(r, "device_id")
+	if err != nil {
+		return err
+	}
+	var dumpRequests []*shared.DumpRequest
+	// Filter out ones requested by the hishtory instance that sent this request
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND requesting_device_id != ?", userId, deviceId).Find(&dumpRequests)); err != nil {
+		return err
+	}
+	respBody, err := json.Marshal(dumpRequests)
+	if err != nil {
+		return fmt.Errorf("failed to JSON marshall the dump requests: %v", err)
+	}
+	w.Write(respBody)
+	return nil
+}
+
+func apiSubmitDumpHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	srcDeviceId, err := getRequiredQueryParam(r, "source_device_id")
+	if err != nil {
+		return err
+	}
+	requestingDeviceId, err := getRequiredQueryParam(r, "requesting_device_id")
+	if err != nil {
+		return err
+	}
+	var entries []*shared.EncHistoryEntry
+	err = readJsonBody(r, maxDumpBodySize, &entries)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("apiSubmitDumpHandler: received request containg %d EncHistoryEntry\n", len(entries))
+	var numDumpRequests int64
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.DumpRequest{}).Where("user_id = ? AND requesting_device_id = ?", userId, requestingDeviceId).Count(&numDumpRequests)); err != nil {
+		return err
+	}
+	if numDumpRequests == 0 {
+		return newApiError(http.StatusNotFound, shared.ErrorCodeNotFound, "found no pending dump request from requesting_device_id=%s", requestingDeviceId)
+	}
+	if err := checkStorageQuota(ctx, userId, entries, 1); err != nil {
+		return err
+	}
+	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Deleting the dump request in the same transaction means that if several devices respond to it, only the
+		// first dump is stored
+		result := tx.Delete(&shared.DumpRequest{}, "user_id = ? AND requesting_device_id = ?", userId, requestingDeviceId)
+		if err := checkGormResult(result); err != nil {
+			return err
+		}
+		if result.RowsAffected == 0 {
+			return newApiError(http.StatusNotFound, shared.ErrorCodeNotFound, "found no pending dump request from requesting_device_id=%s", requestingDeviceId)
+		}
+		firstSeq, err := allocateSeqs(tx, userId, requestingDeviceId, len(entries))
+		if err != nil {
+			return err
+		}
+		for i, entry := range entries {
+			entry.DeviceId = requestingDeviceId
+			entry.Seq = firstSeq + int64(i)
+			if entry.UserId != userId {
+				return newApiError(http.StatusBadRequest, shared.ErrorCodeBadRequest, "batch contains an entry with UserId=%#v, when the query param contained the user_id=%#v", entry.UserId, userId)
+			}
+			if err := checkGormResult(tx.Create(entry)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute transaction to add dumped DB: %w", err)
+	}
+	updateUsageData(ctx, r, userId, srcDeviceId, len(entries), false)
+	return nil
+}
+
+func apiBannerHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	commitHash, err := getRequiredQueryParam(r, "commit_hash")
+	if err != nil {
+		return err
+	}
+	deviceId, err := getRequiredQueryParam(r, "device_id")
+	if err != nil {
+		return err
+	}
+	forcedBanner := r.URL.Query().Get("forced_banner")
+	fmt.Printf("apiBannerHandler: commit_hash=%#v, device_id=%#v, forced_banner=%#v\n", commitHash, deviceId, forcedBanner)
+	if getHishtoryVersion(r) == "v0.160" {
+		w.Write([]byte("Warning: hiSHtory v0.160 has a bug that slows down your shell! Please run `hishtory update` to upgrade hiSHtory."))
+		return nil
+	}
+	w.Write([]byte(html.EscapeString(forcedBanner)))
+	return nil
+}
+
+func getDeletionRequestsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	deviceId, err := getRequiredQueryParam(r, "device_id")
+	if err != nil {
+		return err
+	}
+
+	// Increment the ReadCount
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Exec("UPDATE deletion_requests SET read_count = read_count + 1 WHERE destination_device_id = ? AND user_id = ?", deviceId, userId)); err != nil {
+		return err
+	}
+
+	// Return all the deletion requests
+	var deletionRequests []*shared.DeletionRequest
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND destination_device_id = ?", userId, deviceId).Find(&deletionRequests)); err != nil {
+		return err
+	}
+	respBody, err := json.Marshal(deletionRequests)
+	if err != nil {
+		return fmt.Errorf("failed to JSON marshall the dump requests: %v", err)
+	}
+	w.Write(respBody)
+	return nil
+}
+
+func addDeletionRequestHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var request shared.DeletionRequest
+	err := readJsonBody(r, maxRequestBodySize, &request)
+	if err != nil {
+		return err
+	}
+	request.ReadCount = 0
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	if request.UserId != userId {
+		return newApiError(http.StatusBadRequest, shared.ErrorCodeBadRequest, "deletion request has UserId=%#v, when the query param contained the user_id=%#v", request.UserId, userId)
+	}
+	fmt.Printf("addDeletionRequestHandler: received request containg %d messages to be deleted\n", len(request.Messages.Ids))
+
+	// Store the deletion request so all the devices will get it
+	tx := GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND is_revoked = ?", request.UserId, false)
+	var devices []*shared.Device
+	if err := checkGormResult(tx.Find(&devices)); err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return newApiError(http.StatusNotFound, shared.ErrorCodeNotFound, "found no devices associated with user_id=%s, can't save deletion request", request.UserId)
+	}
+	fmt.Printf("addDeletionRequestHandler: Found %d devices\n", len(devices))
+	for _, device := range devices {
+		request.DestinationDeviceId = device.DeviceId
+		if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Create(&request)); err != nil {
+			return err
+		}
+	}
+
+	// Also delete anything currently in the DB matching it
+	numDeleted, err := applyDeletionRequestsToBackend(ctx, request)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("addDeletionRequestHandler: Deleted %d rows in the backend\n", numDeleted)
+	return nil
+}
+
+func apiListDevicesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	var devices []*shared.Device
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ?", userId).Order("registration_date").Find(&devices)); err != nil {
+		return err
+	}
+	var usageData []*UsageData
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ?", userId).Find(&usageData)); err != nil {
+		return err
+	}
+	lastUsed := make(map[string]time.Time)
+	for _, u := range usageData {
+		lastUsed[u.DeviceId] = u.LastUsed
+	}
+	deviceInfos := make([]shared.DeviceInfo, 0, len(devices))
+	seen := make(map[string]bool)
+	for _, device := range devices {
+		if seen[device.DeviceId] {
+			continue
+		}
+		seen[device.DeviceId] = true
+		deviceInfos = append(deviceInfos, shared.DeviceInfo{
+			DeviceId:         device.DeviceId,
+			Name:             device.Name,
+			RegistrationDate: device.RegistrationDate,
+			LastUsed:         lastUsed[device.DeviceId],
+			IsRevoked:        device.IsRevoked,
+		})
+	}
+	respBody, err := json.Marshal(deviceInfos)
+	if err != nil {
+		return fmt.Errorf("failed to JSON marshall the devices: %v", err)
+	}
+	w.Write(respBody)
+	return nil
+}
+
+func apiRenameDeviceHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := requireMethod(w, r, http.MethodPost); err != nil {
+		return err
+	}
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	targetDeviceId, err := getRequiredQueryParam(r, "target_device_id")
+	if err != nil {
+		return err
+	}
+	name := r.URL.Query().Get("name")
+	if len(name) > shared.MaxDeviceNameLength {
+		return newApiError(http.StatusBadRequest, shared.ErrorCodeBadRequest, "device names can be at most %d characters long", shared.MaxDeviceNameLength)
+	}
+	result := GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Where("user_id = ? AND device_id = ?", userId, targetDeviceId).Update("name", name)
+	if err := checkGormResult(result); err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 {
+		return newApiError(http.StatusNotFound, shared.ErrorCodeNotFound, "no device with device_id=%s", targetDeviceId)
+	}
+	return nil
+}
+
+// Revokes a device so that it can no longer make requests. Revoked devices are skipped when fanning out new
+// entries and deletion requests, and anything that was still waiting to be sent to the device is removed.
+func apiRevokeDeviceHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := requireMethod(w, r, http.MethodPost); err != nil {
+		return err
+	}
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	targetDeviceId, err := getRequiredQueryParam(r, "target_device_id")
+	if err != nil {
+		return err
+	}
+	var numRevoked int64
+	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&shared.Device{}).Where("user_id = ? AND device_id = ?", userId, targetDeviceId).Update("is_revoked", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		numRevoked = result.RowsAffected
+		if err := tx.Delete(&shared.EncHistoryEntry{}, "user_id = ? AND device_id = ?", userId, targetDeviceId).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&shared.DumpRequest{}, "user_id = ? AND requesting_device_id = ?", userId, targetDeviceId).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&shared.DeletionRequest{}, "user_id = ? AND destination_device_id = ?", userId, targetDeviceId).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute transaction to revoke device: %v", err)
+	}
+	if numRevoked == 0 {
+		return newApiError(http.StatusNotFound, shared.ErrorCodeNotFound, "no device with device_id=%s", targetDeviceId)
+	}
+	fmt.Printf("apiRevokeDeviceHandler: revoked device_id=%s\n", targetDeviceId)
+	return nil
+}
+
+// Deletes everything stored for a user and revokes all of their devices. Clients call this after rotating their
+// secret key so that nothing encrypted with the old key is left on the server. The device rows are kept so that
+// devices still using the old key are rejected rather than silently registering again.
+func apiPurgeUserHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := requireMethod(w, r, http.MethodPost); err != nil {
+		return err
+	}
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	err = GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&shared.EncHistoryEntry{}, "user_id = ?", userId).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&shared.DumpRequest{}, "user_id = ?", userId).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&shared.DeletionRequest{}, "user_id = ?", userId).Error; err != nil {
+			return err
+		}
+		return tx.Model(&shared.Device{}).Where("user_id = ?", userId).Update("is_revoked", true).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute transaction to purge user: %v", err)
+	}
+	fmt.Printf("apiPurgeUserHandler: purged user_id=%s\n", userId)
+	return nil
+}
+
+func healthCheckHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if isProductionEnvironment() {
+		// Check that we have a reasonable looking set of devices/entries in the DB
+		rows, err := GLOBAL_DB.Raw("SELECT true FROM enc_history_entries LIMIT 1 OFFSET 1000").Rows()
+		if err != nil {
+			return fmt.Errorf("failed to count entries in DB: %v", err)
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			return fmt.Errorf("suspiciously few enc history entries")
+		}
+		var count int64
+		if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Count(&count)); err != nil {
+			return err
+		}
+		if count < 100 {
+			return fmt.Errorf("suspiciously few devices")
+		}
+		// Check that we can write to the DB. This entry will get written and then eventually cleaned by the cron.
+		err = checkGormResult(GLOBAL_DB.WithContext(ctx).Create(&shared.EncHistoryEntry{
+			EncryptedData: []byte("data"),
+			Nonce:         []byte("nonce"),
+			DeviceId:      "healthcheck_device_id",
+			UserId:        "healthcheck_user_id",
+			Date:          time.Now(),
+			EncryptedId:   "healthcheck_enc_id",
+			ReadCount:     10000,
+		}))
+		if err != nil {
+			return err
+		}
+	} else {
+		db, err := GLOBAL_DB.DB()
+		if err != nil {
+			return fmt.Errorf("failed to get DB: %v", err)
+		}
+		err = db.Ping()
+		if err != nil {
+			return fmt.Errorf("failed to ping DB: %v", err)
+		}
+	}
+	ok := "OK"
+	w.Write([]byte(ok))
+	return nil
+}
+
+func applyDeletionRequestsToBackend(ctx context.Context, request shared.DeletionRequest) (int, error) {
+	tx := GLOBAL_DB.WithContext(ctx).Where("false")
+	for _, message := range request.Messages.Ids {
+		tx = tx.Or(GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND device_id = ? AND date = ?", request.UserId, message.DeviceId, message.Date))
+	}
+	result := tx.Delete(&shared.EncHistoryEntry{})
+	if err := checkGormResult(result); err != nil {
+		return 0, err
+	}
+	return int(result.RowsAffected), nil
+}
+
+func wipeDbEntriesHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Host == "api.hishtory.dev" || isProductionEnvironment() {
+		return newApiError(http.StatusForbidden, shared.ErrorCodeForbidden, "refusing to wipe the DB for prod")
+	}
+	if !isTestEnvironment() {
+		return newApiError(http.StatusForbidden, shared.ErrorCodeForbidden, "refusing to wipe the DB non-test environment")
+	}
+	return checkGormResult(GLOBAL_DB.WithContext(ctx).Exec("DELETE FROM enc_history_entries"))
+}
+
+func getNumConnectionsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	sqlDb, err := GLOBAL_DB.DB()
+	if err != nil {
+		return err
+	}
+	w.Write([]byte(fmt.Sprintf("%#v", sqlDb.Stats().OpenConnections)))
+	return nil
+}
+
+func isTestEnvironment() bool {
+	return os.Getenv("HISHTORY_TEST") != ""
+}
+
+func isProductionEnvironment() bool {
+	return GLOBAL_CONFIG.Environment == "prod"
+}
+
+// OpenTestDB opens an in-memory SQLite DB for use in tests
+func OpenTestDB() (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open("file::memory:?_journal_mode=WAL&cache=shared"), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the DB: %v", err)
+	}
+	underlyingDb, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to access underlying DB: %v", err)
+	}
+	underlyingDb.SetMaxOpenConns(1)
+	db.Exec("PRAGMA journal_mode = WAL")
+	AddDatabaseTables(db)
+	return db, nil
+}
+
+// OpenSqliteDB opens the SQLite DB stored at the given path, creating it if it doesn't exist yet. This uses a pure
+// Go SQLite driver so that it can be used from the client binary, which is built without CGO.
+func OpenSqliteDB(path string) (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: NewDbLogger()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the DB: %v", err)
+	}
+	underlyingDb, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to access underlying DB: %v", err)
+	}
+	// SQLite only supports a single writer, so serialize access rather than failing with SQLITE_BUSY
+	underlyingDb.SetMaxOpenConns(1)
+	db.Exec("PRAGMA journal_mode = WAL")
+	AddDatabaseTables(db)
+	return db, nil
+}
+
+// NewDbLogger returns the same logger as the gorm default, except with a higher SlowThreshold
+func NewDbLogger() logger.Interface {
+	return logger.New(log.New(os.Stdout, "\r\n", log.LstdFlags), logger.Config{
+		SlowThreshold:             1000 * time.Millisecond,
+		LogLevel:                  logger.Warn,
+		IgnoreRecordNotFoundError: false,
+		Colorful:                  true,
+	})
+}
+
+// InitDB sets the DB that is used by all of the handlers
+func InitDB(db *gorm.DB) error {
+	err := registerDbMetrics(db)
+	if err != nil {
+		return err
+	}
+	sqlDb, err := db.DB()
+	if err != nil {
+		return err
+	}
+	err = sqlDb.Ping()
+	if err != nil {
+		return err
+	}
+	if isProductionEnvironment() {
+		sqlDb.SetMaxIdleConns(10)
+	}
+	if isTestEnvironment() {
+		sqlDb.SetMaxIdleConns(1)
+	}
+	GLOBAL_DB = db
+	return nil
+}
+
+func AddDatabaseTables(db *gorm.DB) {
+	db.AutoMigrate(&shared.EncHistoryEntry{})
+	db.AutoMigrate(&shared.Device{})
+	db.AutoMigrate(&UsageData{})
+	db.AutoMigrate(&shared.DumpRequest{})
+	db.AutoMigrate(&shared.DeletionRequest{})
+	db.AutoMigrate(&shared.Feedback{})
+}
+
+func cron(ctx context.Context) error {
+	if TrackLatestRelease {
+		err := updateReleaseVersion()
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := cleanDatabase(ctx)
+	if err != nil {
+		panic(err)
+	}
+	if GLOBAL_STATSD != nil {
+		err = reportPendingRequests(ctx)
+		if err != nil {
+			panic(err)
+		}
+		err = GLOBAL_STATSD.Flush()
+		if err != nil {
+			panic(err)
+		}
+	}
+	return nil
+}
+
+// Reports the number of dump requests and deletion requests that devices haven't retrieved yet
+func reportPendingRequests(ctx context.Context) error {
+	var numDumpRequests int64
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.DumpRequest{}).Count(&numDumpRequests)); err != nil {
+		return err
+	}
+	GLOBAL_STATSD.Gauge("hishtory.pending_dump_requests", float64(numDumpRequests), []string{}, 1.0)
+	var numDeletionRequests int64
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.DeletionRequest{}).Where("read_count = 0").Count(&numDeletionRequests)); err != nil {
+		return err
+	}
+	GLOBAL_STATSD.Gauge("hishtory.pending_deletion_requests", float64(numDeletionRequests), []string{}, 1.0)
+	return nil
+}
+
+// RunBackgroundJobs periodically runs the cron until the context is cancelled. A cron that is already running when
+// the context is cancelled is allowed to finish, so that it doesn't fail halfway through.
+func RunBackgroundJobs(ctx context.Context) {
+	delay := 5 * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		err := cron(context.Background())
+		if err != nil {
+			fmt.Printf("Cron failure: %v", err)
+		}
+		delay = GLOBAL_CONFIG.Retention.CleanupInterval.Duration
+	}
+}
+
+func triggerCronHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	return cron(ctx)
+}
+
+type releaseInfo struct {
+	Name string `json:"name"`
+}
+
+func updateReleaseVersion() error {
+	resp, err := http.Get("https://api.github.com/repos/ddworken/hishtory/releases/latest")
+	if err != nil {
+		return fmt.Errorf("failed to get latest release version: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read github API response body: %v", err)
+	}
+	if resp.StatusCode == 403 && strings.Contains(string(respBody), "API rate limit exceeded for ") {
+		return nil
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to call github API, status_code=%d, body=%#v", resp.StatusCode, string(respBody))
+	}
+	var info releaseInfo
+	err = json.Unmarshal(respBody, &info)
+	if err != nil {
+		return fmt.Errorf("failed to parse github API response: %v", err)
+	}
+	latestVersionTag := info.Name
+	ReleaseVersion = decrementVersionIfInvalid(latestVersionTag)
+	return nil
+}
+
+func decrementVersionIfInvalid(initialVersion string) string {
+	// Decrements the version up to 5 times if the version doesn't have valid binaries yet.
+	version := initialVersion
+	for i := 0; i < 5; i++ {
+		updateInfo := buildUpdateInfo(version)
+		err := assertValidUpdate(updateInfo)
+		if err == nil {
+			fmt.Printf("Found a valid version: %v\n", version)
+			return version
+		}
+		fmt.Printf("Found %s to be an invalid version: %v\n", version, err)
+		version, err = decrementVersion(version)
+		if err != nil {
+			fmt.Printf("Failed to decrement version after finding the latest version was invalid: %v\n", err)
+			return initialVersion
+		}
+	}
+	fmt.Printf("Decremented the version 5 times and failed to find a valid version version number, initial version number: %v, last checked version number: %v\n", initialVersion, version)
+	return initialVersion
+}
+
+func assertValidUpdate(updateInfo shared.UpdateInfo) error {
+	urls := []string{updateInfo.LinuxAmd64Url, updateInfo.LinuxAmd64AttestationUrl, updateInfo.LinuxArm64Url, updateInfo.LinuxArm64AttestationUrl,
+		updateInfo.LinuxArm7Url, updateInfo.LinuxArm7AttestationUrl,
+		updateInfo.DarwinAmd64Url, updateInfo.DarwinAmd64UnsignedUrl, updateInfo.DarwinAmd64AttestationUrl,
+		updateInfo.DarwinArm64Url, updateInfo.DarwinArm64UnsignedUrl, updateInfo.DarwinArm64AttestationUrl}
+	for _, url := range urls {
+		resp, err := http.Get(url)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve URL %#v: %v", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == 404 {
+			return fmt.Errorf("URL %#v returned 404", url)
+		}
+	}
+	return nil
+}
+
+func decrementVersion(version string) (string, error) {
+	if version == "UNKNOWN" {
+		return "", fmt.Errorf("cannot decrement UNKNOWN")
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid version: %s", version)
+	}
+	versionNumber, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid version: %s", version)
+	}
+	return parts[0] + "." + strconv.Itoa(versionNumber-1), nil
+}
+
+func buildUpdateInfo(version string) shared.UpdateInfo {
+	return shared.UpdateInfo{
+		LinuxAmd64Url:             fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-linux-amd64", version),
+		LinuxAmd64AttestationUrl:  fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-linux-amd64.intoto.jsonl", version),
+		LinuxArm64Url:             fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-linux-arm64", version),
+		LinuxArm64AttestationUrl:  fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-linux-arm64.intoto.jsonl", version),
+		LinuxArm7Url:              fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-linux-arm", version),
+		LinuxArm7AttestationUrl:   fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-linux-arm.intoto.jsonl", version),
+		DarwinAmd64Url:            fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-darwin-amd64", version),
+		DarwinAmd64UnsignedUrl:    fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-darwin-amd64-unsigned", version),
+		DarwinAmd64AttestationUrl: fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-darwin-amd64.intoto.jsonl", version),
+		DarwinArm64Url:            fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-darwin-arm64", version),
+		DarwinArm64UnsignedUrl:    fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-darwin-arm64-unsigned", version),
+		DarwinArm64AttestationUrl: fmt.Sprintf("https://github.com/ddworken/hishtory/releases/download/%s/hishtory-darwin-arm64.intoto.jsonl", version),
+		Version:                   version,
+	}
+}
+
+func apiDownloadHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	updateInfo := buildUpdateInfo(ReleaseVersion)
+	resp, err := json.Marshal(updateInfo)
+	if err != nil {
+		return err
+	}
+	w.Write(resp)
+	return nil
+}
+
+func slsaStatusHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	// returns "OK" unless there is a current SLSA bug
+	v := getHishtoryVersion(r)
+	if !strings.Contains(v, "v0.") {
+		w.Write([]byte("OK"))
+		return nil
+	}
+	vNum, err := strconv.Atoi(strings.Split(v, ".")[1])
+	if err != nil {
+		w.Write([]byte("OK"))
+		return nil
+	}
+	if vNum < 159 {
+		w.Write([]byte("Sigstore deployed a broken change. See https://github.com/slsa-framework/slsa-github-generator/issues/1163"))
+		return nil
+	}
+	w.Write([]byte("OK"))
+	return nil
+}
+
+func feedbackHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var feedback shared.Feedback
+	err := readJsonBody(r, maxRequestBodySize, &feedback)
+	if err != nil {
+		return err
+	}
+	userId, err := getRequiredQueryParam(r, "user_id")
+	if err != nil {
+		return err
+	}
+	if feedback.UserId != userId {
+		return newApiError(http.StatusBadRequest, shared.ErrorCodeBadRequest, "feedback has UserId=%#v, when the query param contained the user_id=%#v", feedback.UserId, userId)
+	}
+	fmt.Printf("feedbackHandler: received request containg feedback %#v\n", feedback)
+	if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Create(feedback)); err != nil {
+		return err
+	}
+
+	if GLOBAL_STATSD != nil {
+		GLOBAL_STATSD.Incr("hishtory.uninstall", []string{}, 1.0)
+	}
+	return nil
+}
+
+type loggedResponseData struct {
+	size int
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	responseData *loggedResponseData
+}
+
+func (r *loggingResponseWriter) Write(b []byte) (int, error) {
+	size, err := r.ResponseWriter.Write(b)
+	r.responseData.size += size
+	return size, err
+}
+
+func (r *loggingResponseWriter) WriteHeader(statusCode int) {
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *loggingResponseWriter) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func getFunctionName(temp interface{}) string {
+	strs := strings.Split((runtime.FuncForPC(reflect.ValueOf(temp).Pointer()).Name()), ".")
+	return strs[len(strs)-1]
+}
+
+func withLogging(h func(context.Context, http.ResponseWriter, *http.Request) error) http.Handler {
+	return withNamedLogging(getFunctionName(h), h)
+}
+
+// withDeviceAuth is the same as withLogging, except that it rejects requests that don't include the token for the
+// device making the request. The device is identified by the user_id query param along with the device_id (or for
+// uploads, the source_device_id) query param, so the handler can trust those params.
+func withDeviceAuth(h func(context.Context, http.ResponseWriter, *http.Request) error) http.Handler {
+	return withNamedLogging(getFunctionName(h), func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		if err := checkIpRateLimit(w, r); err != nil {
+			return err
+		}
+		userId := r.URL.Query().Get("user_id")
+		deviceId := r.URL.Query().Get("device_id")
+		if deviceId == "" {
+			deviceId = r.URL.Query().Get("source_device_id")
+		}
+		token := getBearerToken(r)
+		if userId == "" || deviceId == "" || token == "" {
+			return newApiError(http.StatusUnauthorized, shared.ErrorCodeUnauthorized, "request is missing a user_id, device_id or device token")
+		}
+		var devices []*shared.Device
+		if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Where("user_id = ? AND device_id = ?", userId, deviceId).Find(&devices)); err != nil {
+			return err
+		}
+		needsToken := false
+		for _, device := range devices {
+			if device.TokenHash == "" {
+				needsToken = true
+			}
+			if tokenMatchesHash(token, device.TokenHash) {
+				if device.IsRevoked {
+					return newApiError(http.StatusForbidden, shared.ErrorCodeDeviceRevoked, "this device has been revoked")
+				}
+				// Track whether the device can decrypt compressed entries, which changes when it is upgraded or downgraded
+				if supports := supportsCompressedEntries(r); supports != device.SupportsCompressedEntries {
+					if err := checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Where("user_id = ? AND device_id = ?", userId, deviceId).Update("supports_compressed_entries", supports)); err != nil {
+						return err
+					}
+				}
+				if err := checkUserRateLimit(w, userId); err != nil {
+					return err
+				}
+				return h(ctx, w, r)
+			}
+		}
+		if needsToken {
+			return newApiError(http.StatusUnauthorized, shared.ErrorCodeDeviceTokenNotRegistered, "this device was registered before device tokens existed, and needs to register its token")
+		}
+		return newApiError(http.StatusUnauthorized, shared.ErrorCodeUnauthorized, "invalid device token")
+	})
+}
+
+func getBearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+func tokenMatchesHash(token, tokenHash string) bool {
+	return tokenHash != "" && subtle.ConstantTimeCompare([]byte(shared.HashToken(token)), []byte(tokenHash)) == 1
+}
+
+func withNamedLogging(name string, h func(context.Context, http.ResponseWriter, *http.Request) error) http.Handler {
+	logFn := func(rw http.ResponseWriter, r *http.Request) {
+		var responseData loggedResponseData
+		lrw := loggingResponseWriter{
+			ResponseWriter: rw,
+			responseData:   &responseData,
+		}
+		start := time.Now()
+		ctx, finishSpan := StartSpan(context.Background(), name)
+		defer finishSpan(nil)
+
+		withCompression(withErrorResponses(h))(ctx, &lrw, r)
+
+		duration := time.Since(start)
+		fmt.Printf("%s %s %#v %s %s %s\n", getRemoteAddr(r), r.Method, r.RequestURI, getHishtoryVersion(r), duration.String(), byteCountToString(responseData.size))
+		if GLOBAL_STATSD != nil {
+			GLOBAL_STATSD.Distribution("hishtory.request_duration", float64(duration.Microseconds())/1_000, []string{"HANDLER=" + name}, 1.0)
+			GLOBAL_STATSD.Incr("hishtory.request", []string{}, 1.0)
+		}
+	}
+	return http.HandlerFunc(logFn)
+}
+
+// withErrorResponses sends the error returned by the handler to the client as a JSON shared.ApiError. Errors that
+// aren't already a shared.ApiError, and panics, are reported as internal errors without any details, which are
+// only logged.
+func withErrorResponses(h func(context.Context, http.ResponseWriter, *http.Request) error) func(context.Context, http.ResponseWriter, *http.Request) {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				writeApiError(w, r, fmt.Errorf("panic: %v", rec))
+			}
+		}()
+		err := h(ctx, w, r)
+		if err != nil {
+			writeApiError(w, r, err)
+		}
+	}
+}
+
+func writeApiError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *shared.ApiError
+	if !errors.As(err, &apiErr) {
+		fmt.Printf("%s %#v failed: %v\n", r.Method, r.RequestURI, err)
+		apiErr = newApiError(http.StatusInternalServerError, shared.ErrorCodeInternal, "internal server error")
+	}
+	resp, err := json.Marshal(apiErr)
+	if err != nil {
+		resp = []byte(`{"code":"` + shared.ErrorCodeInternal + `"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.StatusCode)
+	w.Write(resp)
+}
+
+// withCompression decompresses request bodies according to their Content-Encoding, and compresses the response with
+// the encoding negotiated from the Accept-Encoding header. Responses also advertise the encodings that are accepted
+// for request bodies, so that clients know it is safe to compress them. Older clients don't send either header, so
+// they get uncompressed responses.
+func withCompression(h func(context.Context, http.ResponseWriter, *http.Request)) func(context.Context, http.ResponseWriter, *http.Request) {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Encoding", shared.SupportedEncodings)
+		if contentEncoding := r.Header.Get("Content-Encoding"); contentEncoding != "" {
+			// Handlers limit the size of the bodies they read, so this only needs to enforce the largest of those limits
+			body, err := shared.NewDecompressingReader(r.Body, contentEncoding, maxDumpBodySize)
+			if err != nil {
+				writeApiError(w, r, newApiError(http.StatusUnsupportedMediaType, shared.ErrorCodeUnsupportedEncoding, "%v", err))
+				return
+			}
+			defer body.Close()
+			r.Body = body
+			r.Header.Del("Content-Encoding")
+		}
+		encoding := shared.NegotiateEncoding(r.Header.Get("Accept-Encoding"))
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoding == shared.EncodingIdentity {
+			h(ctx, w, r)
+			return
+		}
+		cw := &compressingResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer func() {
+			err := cw.Close()
+			if err != nil {
+				fmt.Printf("failed to finish compressing the response: %v\n", err)
+			}
+		}()
+		h(ctx, cw, r)
+	}
+}
+
+// compressingResponseWriter compresses everything written to it. The status code is held back until the first write
+// so that empty responses can be sent without a Content-Encoding.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	encoding   string
+	statusCode int
+	writer     io.WriteCloser
+}
+
+func (c *compressingResponseWriter) WriteHeader(statusCode int) {
+	if c.statusCode == 0 {
+		c.statusCode = statusCode
+	}
+}
+
+func (c *compressingResponseWriter) Write(b []byte) (int, error) {
+	if c.writer == nil {
+		if c.statusCode == 0 {
+			c.statusCode = http.StatusOK
+		}
+		writer, err := shared.NewCompressingWriter(c.ResponseWriter, c.encoding)
+		if err != nil {
+			return 0, err
+		}
+		c.Header().Del("Content-Length")
+		c.Header().Set("Content-Encoding", c.encoding)
+		c.ResponseWriter.WriteHeader(c.statusCode)
+		c.writer = writer
+	}
+	return c.writer.Write(b)
+}
+
+func (c *compressingResponseWriter) Flush() {
+	if f, ok := c.writer.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressingResponseWriter) Close() error {
+	if c.writer == nil {
+		if c.statusCode != 0 {
+			c.ResponseWriter.WriteHeader(c.statusCode)
+		}
+		return nil
+	}
+	return c.writer.Close()
+}
+
+func byteCountToString(b int) string {
+	const unit = 1000
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMG"[exp])
+}
+
+func cleanDatabase(ctx context.Context) error {
+	r := GLOBAL_DB.WithContext(ctx).Exec("DELETE FROM enc_history_entries WHERE read_count > ?", GLOBAL_CONFIG.Retention.MaxEntryReadCount)
+	if r.Error != nil {
+		return r.Error
+	}
+	r = GLOBAL_DB.WithContext(ctx).Exec("DELETE FROM enc_history_entries WHERE seq > 0 AND seq <= (SELECT MAX(devices.acked_seq) FROM devices WHERE devices.device_id = enc_history_entries.device_id)")
+	if r.Error != nil {
+		return r.Error
+	}
+	r = GLOBAL_DB.WithContext(ctx).Exec("DELETE FROM deletion_requests WHERE read_count > ?", GLOBAL_CONFIG.Retention.MaxDeletionRequestReadCount)
+	if r.Error != nil {
+		return r.Error
+	}
+	return nil
+}
+
+// DeepCleanDatabase finds stale entries from inactive users. This relies on Postgres specific SQL.
+func DeepCleanDatabase(ctx context.Context) {
+	inactiveHours := int(GLOBAL_CONFIG.Retention.InactiveUserAge.Hours())
+	err := GLOBAL_DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		r := tx.Exec(`
+		CREATE TEMP TABLE temp_users_with_one_device AS (
+			SELECT user_id
+			FROM devices
+			GROUP BY user_id
+			HAVING COUNT(DISTINCT device_id) > 1
+		)	
+		`)
+		if r.Error != nil {
+			return r.Error
+		}
+		r = tx.Exec(fmt.Sprintf(`
+		CREATE TEMP TABLE temp_inactive_users AS (
+			SELECT user_id
+			FROM usage_data
+			WHERE last_used <= (now() - INTERVAL '%d hours')
+		)	
+		`, inactiveHours))
+		if r.Error != nil {
+			return r.Error
+		}
+		r = tx.Exec(fmt.Sprintf(`
+		SELECT COUNT(*) FROM enc_history_entries WHERE
+			date <= (now() - INTERVAL '%d hours')
+			AND user_id IN (SELECT * FROM temp_users_with_one_device)
+			AND user_id IN (SELECT * FROM temp_inactive_users)
+		`, inactiveHours))
+		if r.Error != nil {
+			return r.Error
+		}
+		fmt.Printf("Ran deep clean and deleted %d rows\n", r.RowsAffected)
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Errorf("failed to deep clean DB: %v", err))
+	}
+}
+
+// RegisterHandlers adds all of the API handlers to the given mux
+func RegisterHandlers(mux interface {
+	Handle(pattern string, handler http.Handler)
+}) {
+	mux.Handle("/api/v1/submit", withDeviceAuth(apiSubmitHandler))
+	mux.Handle("/api/v1/get-dump-requests", withDeviceAuth(apiGetPendingDumpRequestsHandler))
+	mux.Handle("/api/v1/submit-dump", withDeviceAuth(apiSubmitDumpHandler))
+	mux.Handle("/api/v1/query", withDeviceAuth(apiQueryHandler))
+	mux.Handle("/api/v1/bootstrap", withDeviceAuth(apiBootstrapHandler))
+	// Registration checks the tokens itself, since the device doesn't have a token until it is registered
+	mux.Handle("/api/v1/register", withLogging(apiRegisterHandler))
+	mux.Handle("/api/v1/banner", withDeviceAuth(apiBannerHandler))
+	mux.Handle("/api/v1/download", withLogging(apiDownloadHandler))
+	mux.Handle("/api/v1/trigger-cron", withLogging(triggerCronHandler))
+	mux.Handle("/api/v1/get-deletion-requests", withDeviceAuth(getDeletionRequestsHandler))
+	mux.Handle("/api/v1/add-deletion-request", withDeviceAuth(addDeletionRequestHandler))
+	mux.Handle("/api/v1/slsa-status", withLogging(slsaStatusHandler))
+	mux.Handle("/api/v1/feedback", withDeviceAuth(feedbackHandler))
+	mux.Handle("/api/v1/devices", withDeviceAuth(apiListDevicesHandler))
+	mux.Handle("/api/v1/rename-device", withDeviceAuth(apiRenameDeviceHandler))
+	mux.Handle("/api/v1/revoke-device", withDeviceAuth(apiRevokeDeviceHandler))
+	mux.Handle("/api/v1/purge-user", withDeviceAuth(apiPurgeUserHandler))
+	mux.Handle("/healthcheck", withLogging(healthCheckHandler))
+	mux.Handle("/internal/api/v1/usage-stats", withLogging(usageStatsHandler))
+	mux.Handle("/internal/api/v1/stats", withLogging(statsHandler))
+	if isTestEnvironment() {
+		mux.Handle("/api/v1/wipe-db-entries", withLogging(wipeDbEntriesHandler))
+		mux.Handle("/api/v1/get-num-connections", withLogging(getNumConnectionsHandler))
+	}
+}
+
+func checkGormResult(result *gorm.DB) error {
+	if result.Error != nil {
+		_, filename, line, _ := runtime.Caller(1)
+		return fmt.Errorf("DB error at %s:%d: %v", filename, line, result.Error)
+	}
+	return nil
+}
+
+// TODO(optimization): Maybe optimize the endpoints a bit to reduce the number of round trips required?
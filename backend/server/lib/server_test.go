@@ -0,0 +1,1670 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/shared"
+	"github.com/ddworken/hishtory/shared/testutils"
+	"github.com/go-test/deep"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func TestESubmitThenQuery(t *testing.T) {
+	// Set up
+	initTestDB(t)
+
+	// Register a few devices
+	userId := data.UserId("key")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	otherDev := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "key", devId1)
+	registerDevice(t, "key", devId2)
+	registerDevice(t, "otherkey", otherDev)
+
+	// Submit a few entries for different devices
+	entry := testutils.MakeFakeHistoryEntry("ls ~/")
+	encEntry, err := data.EncryptHistoryEntry("key", entry)
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	submitReq := httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(reqBody))
+	apiSubmitHandler(context.Background(), nil, submitReq)
+
+	// Query for device id 1
+	w := httptest.NewRecorder()
+	searchReq := httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil)
+	apiQueryHandler(context.Background(), w, searchReq)
+	res := w.Result()
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	var retrievedEntries []*shared.EncHistoryEntry
+	testutils.Check(t, json.Unmarshal(respBody, &retrievedEntries))
+	if len(retrievedEntries) != 1 {
+		t.Fatalf("Expected to retrieve 1 entry, found %d", len(retrievedEntries))
+	}
+	dbEntry := retrievedEntries[0]
+	if dbEntry.DeviceId != devId1 {
+		t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+	}
+	if dbEntry.UserId != data.UserId("key") {
+		t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+	}
+	if dbEntry.ReadCount != 0 {
+		t.Fatalf("db.ReadCount should have been 1, was %v", dbEntry.ReadCount)
+	}
+	decEntry, err := data.DecryptHistoryEntry("key", *dbEntry)
+	testutils.Check(t, err)
+	if !data.EntryEquals(decEntry, entry) {
+		t.Fatalf("DB data is different than input! \ndb   =%#v\ninput=%#v", *dbEntry, entry)
+	}
+
+	// Same for device id 2
+	w = httptest.NewRecorder()
+	searchReq = httptest.NewRequest(http.MethodGet, "/?device_id="+devId2+"&user_id="+userId, nil)
+	apiQueryHandler(context.Background(), w, searchReq)
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	testutils.Check(t, json.Unmarshal(respBody, &retrievedEntries))
+	if len(retrievedEntries) != 1 {
+		t.Fatalf("Expected to retrieve 1 entry, found %d", len(retrievedEntries))
+	}
+	dbEntry = retrievedEntries[0]
+	if dbEntry.DeviceId != devId2 {
+		t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+	}
+	if dbEntry.UserId != data.UserId("key") {
+		t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+	}
+	if dbEntry.ReadCount != 0 {
+		t.Fatalf("db.ReadCount should have been 1, was %v", dbEntry.ReadCount)
+	}
+	decEntry, err = data.DecryptHistoryEntry("key", *dbEntry)
+	testutils.Check(t, err)
+	if !data.EntryEquals(decEntry, entry) {
+		t.Fatalf("DB data is different than input! \ndb   =%#v\ninput=%#v", *dbEntry, entry)
+	}
+
+	// Bootstrap handler should return 2 entries, one for each device
+	w = httptest.NewRecorder()
+	searchReq = httptest.NewRequest(http.MethodGet, "/?user_id="+data.UserId("key")+"&device_id="+devId1, nil)
+	apiBootstrapHandler(context.Background(), w, searchReq)
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	testutils.Check(t, json.Unmarshal(respBody, &retrievedEntries))
+	if len(retrievedEntries) != 2 {
+		t.Fatalf("Expected to retrieve 2 entries, found %d", len(retrievedEntries))
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestDumpRequestAndResponse(t *testing.T) {
+	// Set up
+	initTestDB(t)
+
+	// Register a first device for two different users
+	userId := data.UserId("dkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	otherUser := data.UserId("dOtherkey")
+	otherDev1 := uuid.Must(uuid.NewRandom()).String()
+	otherDev2 := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "dkey", devId1)
+	registerDevice(t, "dkey", devId2)
+	registerDevice(t, "dOtherkey", otherDev1)
+	registerDevice(t, "dOtherkey", otherDev2)
+
+	// Query for dump requests, there should be one for userId
+	w := httptest.NewRecorder()
+	apiGetPendingDumpRequestsHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?user_id="+userId+"&device_id="+devId1, nil))
+	res := w.Result()
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	var dumpRequests []*shared.DumpRequest
+	testutils.Check(t, json.Unmarshal(respBody, &dumpRequests))
+	if len(dumpRequests) != 1 {
+		t.Fatalf("expected one pending dump request, got %#v", dumpRequests)
+	}
+	dumpRequest := dumpRequests[0]
+	if dumpRequest.RequestingDeviceId != devId2 {
+		t.Fatalf("unexpected device ID")
+	}
+	if dumpRequest.UserId != userId {
+		t.Fatalf("unexpected user ID")
+	}
+
+	// And one for otherUser
+	w = httptest.NewRecorder()
+	apiGetPendingDumpRequestsHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?user_id="+otherUser+"&device_id="+otherDev1, nil))
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	dumpRequests = make([]*shared.DumpRequest, 0)
+	testutils.Check(t, json.Unmarshal(respBody, &dumpRequests))
+	if len(dumpRequests) != 1 {
+		t.Fatalf("expected one pending dump request, got %#v", dumpRequests)
+	}
+	dumpRequest = dumpRequests[0]
+	if dumpRequest.RequestingDeviceId != otherDev2 {
+		t.Fatalf("unexpected device ID")
+	}
+	if dumpRequest.UserId != otherUser {
+		t.Fatalf("unexpected user ID")
+	}
+
+	// And none if we query for a user ID that doesn't exit
+	w = httptest.NewRecorder()
+	apiGetPendingDumpRequestsHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?user_id=foo&device_id=bar", nil))
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	if string(respBody) != "[]" {
+		t.Fatalf("got unexpected respBody: %#v", string(respBody))
+	}
+
+	// And none for a missing user ID
+	w = httptest.NewRecorder()
+	apiGetPendingDumpRequestsHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?user_id=%20&device_id=%20", nil))
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	if string(respBody) != "[]" {
+		t.Fatalf("got unexpected respBody: %#v", string(respBody))
+	}
+
+	// Now submit a dump for userId
+	entry1Dec := testutils.MakeFakeHistoryEntry("ls ~/")
+	entry1, err := data.EncryptHistoryEntry("dkey", entry1Dec)
+	testutils.Check(t, err)
+	entry2Dec := testutils.MakeFakeHistoryEntry("aaaaaaáaaa")
+	entry2, err := data.EncryptHistoryEntry("dkey", entry1Dec)
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{entry1, entry2})
+	testutils.Check(t, err)
+	submitReq := httptest.NewRequest(http.MethodPost, "/?user_id="+userId+"&requesting_device_id="+devId2+"&source_device_id="+devId1, bytes.NewReader(reqBody))
+	testutils.Check(t, apiSubmitDumpHandler(context.Background(), nil, submitReq))
+
+	// Another dump for the same request (e.g. from a third device) is rejected, since it is no longer pending
+	submitReq = httptest.NewRequest(http.MethodPost, "/?user_id="+userId+"&requesting_device_id="+devId2+"&source_device_id="+devId1, bytes.NewReader(reqBody))
+	assertApiErrorCode(t, apiSubmitDumpHandler(context.Background(), nil, submitReq), shared.ErrorCodeNotFound)
+
+	// Check that the dump request is no longer there for userId for either device ID
+	w = httptest.NewRecorder()
+	apiGetPendingDumpRequestsHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?user_id="+userId+"&device_id="+devId1, nil))
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	if string(respBody) != "[]" {
+		t.Fatalf("got unexpected respBody: %#v", string(respBody))
+	}
+	w = httptest.NewRecorder()
+	// The other user
+	apiGetPendingDumpRequestsHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?user_id="+userId+"&device_id="+devId2, nil))
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	if string(respBody) != "[]" {
+		t.Fatalf("got unexpected respBody: %#v", string(respBody))
+	}
+
+	// But it is there for the other user
+	w = httptest.NewRecorder()
+	apiGetPendingDumpRequestsHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?user_id="+otherUser+"&device_id="+otherDev1, nil))
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	dumpRequests = make([]*shared.DumpRequest, 0)
+	testutils.Check(t, json.Unmarshal(respBody, &dumpRequests))
+	if len(dumpRequests) != 1 {
+		t.Fatalf("expected one pending dump request, got %#v", dumpRequests)
+	}
+	dumpRequest = dumpRequests[0]
+	if dumpRequest.RequestingDeviceId != otherDev2 {
+		t.Fatalf("unexpected device ID")
+	}
+	if dumpRequest.UserId != otherUser {
+		t.Fatalf("unexpected user ID")
+	}
+
+	// And finally, query to ensure that the dumped entries are in the DB
+	w = httptest.NewRecorder()
+	searchReq := httptest.NewRequest(http.MethodGet, "/?device_id="+devId2+"&user_id="+userId, nil)
+	apiQueryHandler(context.Background(), w, searchReq)
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	var retrievedEntries []*shared.EncHistoryEntry
+	testutils.Check(t, json.Unmarshal(respBody, &retrievedEntries))
+	if len(retrievedEntries) != 2 {
+		t.Fatalf("Expected to retrieve 2 entries, found %d", len(retrievedEntries))
+	}
+	for _, dbEntry := range retrievedEntries {
+		if dbEntry.DeviceId != devId2 {
+			t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+		}
+		if dbEntry.UserId != userId {
+			t.Fatalf("Response contains an incorrect user ID: %#v", *dbEntry)
+		}
+		if dbEntry.ReadCount != 0 {
+			t.Fatalf("db.ReadCount should have been 1, was %v", dbEntry.ReadCount)
+		}
+		decEntry, err := data.DecryptHistoryEntry("dkey", *dbEntry)
+		testutils.Check(t, err)
+		if !data.EntryEquals(decEntry, entry1Dec) && !data.EntryEquals(decEntry, entry2Dec) {
+			t.Fatalf("DB data is different than input! \ndb   =%#v\nentry1=%#v\nentry2=%#v", *dbEntry, entry1Dec, entry2Dec)
+		}
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestUpdateReleaseVersion(t *testing.T) {
+	if !testutils.IsOnline() {
+		t.Skip("skipping because we're currently offline")
+	}
+
+	// Set up
+	initTestDB(t)
+
+	// Check that ReleaseVersion hasn't been set yet
+	if ReleaseVersion != "UNKNOWN" {
+		t.Fatalf("initial ReleaseVersion isn't as expected: %#v", ReleaseVersion)
+	}
+
+	// Update it
+	err := updateReleaseVersion()
+	if err != nil {
+		t.Fatalf("updateReleaseVersion failed: %v", err)
+	}
+
+	// If ReleaseVersion is still unknown, skip because we're getting rate limited
+	if ReleaseVersion == "UNKNOWN" {
+		t.Skip()
+	}
+	// Otherwise, check that the new value looks reasonable
+	if !strings.HasPrefix(ReleaseVersion, "v0.") {
+		t.Fatalf("ReleaseVersion wasn't updated to contain a version: %#v", ReleaseVersion)
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestDeletionRequests(t *testing.T) {
+	// Set up
+	initTestDB(t)
+
+	// Register two devices for two different users
+	userId := data.UserId("dkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	otherUser := data.UserId("dOtherkey")
+	otherDev1 := uuid.Must(uuid.NewRandom()).String()
+	otherDev2 := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "dkey", devId1)
+	registerDevice(t, "dkey", devId2)
+	registerDevice(t, "dOtherkey", otherDev1)
+	registerDevice(t, "dOtherkey", otherDev2)
+
+	// Add an entry for user1
+	entry1 := testutils.MakeFakeHistoryEntry("ls ~/")
+	entry1.DeviceId = devId1
+	encEntry, err := data.EncryptHistoryEntry("dkey", entry1)
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	submitReq := httptest.NewRequest(http.MethodPost, "/?user_id="+data.UserId("dkey"), bytes.NewReader(reqBody))
+	apiSubmitHandler(context.Background(), nil, submitReq)
+
+	// And another entry for user1
+	entry2 := testutils.MakeFakeHistoryEntry("ls /foo/bar")
+	entry2.DeviceId = devId2
+	encEntry, err = data.EncryptHistoryEntry("dkey", entry2)
+	testutils.Check(t, err)
+	reqBody, err = json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	submitReq = httptest.NewRequest(http.MethodPost, "/?user_id="+data.UserId("dkey"), bytes.NewReader(reqBody))
+	apiSubmitHandler(context.Background(), nil, submitReq)
+
+	// And an entry for user2 that has the same timestamp as the previous entry
+	entry3 := testutils.MakeFakeHistoryEntry("ls /foo/bar")
+	entry3.StartTime = entry1.StartTime
+	entry3.EndTime = entry1.EndTime
+	encEntry, err = data.EncryptHistoryEntry("dOtherkey", entry3)
+	testutils.Check(t, err)
+	reqBody, err = json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	submitReq = httptest.NewRequest(http.MethodPost, "/?user_id="+data.UserId("dOtherkey"), bytes.NewReader(reqBody))
+	apiSubmitHandler(context.Background(), nil, submitReq)
+
+	// Query for device id 1
+	w := httptest.NewRecorder()
+	searchReq := httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil)
+	apiQueryHandler(context.Background(), w, searchReq)
+	res := w.Result()
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	var retrievedEntries []*shared.EncHistoryEntry
+	testutils.Check(t, json.Unmarshal(respBody, &retrievedEntries))
+	if len(retrievedEntries) != 2 {
+		t.Fatalf("Expected to retrieve 1 entry, found %d", len(retrievedEntries))
+	}
+	for _, dbEntry := range retrievedEntries {
+		if dbEntry.DeviceId != devId1 {
+			t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+		}
+		if dbEntry.UserId != data.UserId("dkey") {
+			t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+		}
+		if dbEntry.ReadCount != 0 {
+			t.Fatalf("db.ReadCount should have been 1, was %v", dbEntry.ReadCount)
+		}
+		decEntry, err := data.DecryptHistoryEntry("dkey", *dbEntry)
+		testutils.Check(t, err)
+		if !data.EntryEquals(decEntry, entry1) && !data.EntryEquals(decEntry, entry2) {
+			t.Fatalf("DB data is different than input! \ndb   =%#v\nentry1=%#v\nentry2=%#v", *dbEntry, entry1, entry2)
+		}
+	}
+
+	// Submit a redact request for entry1
+	delReqTime := time.Now()
+	delReq := shared.DeletionRequest{
+		UserId:   data.UserId("dkey"),
+		SendTime: delReqTime,
+		Messages: shared.MessageIdentifiers{Ids: []shared.MessageIdentifier{
+			{DeviceId: devId1, Date: entry1.EndTime},
+		}},
+	}
+	reqBody, err = json.Marshal(delReq)
+	testutils.Check(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/?user_id="+data.UserId("dkey"), bytes.NewReader(reqBody))
+	addDeletionRequestHandler(context.Background(), nil, req)
+
+	// Query again for device id 1 and get a single result
+	time.Sleep(10 * time.Millisecond)
+	w = httptest.NewRecorder()
+	searchReq = httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil)
+	apiQueryHandler(context.Background(), w, searchReq)
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	testutils.Check(t, json.Unmarshal(respBody, &retrievedEntries))
+	if len(retrievedEntries) != 1 {
+		t.Fatalf("Expected to retrieve 1 entry, found %d", len(retrievedEntries))
+	}
+	dbEntry := retrievedEntries[0]
+	if dbEntry.DeviceId != devId1 {
+		t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+	}
+	if dbEntry.UserId != data.UserId("dkey") {
+		t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+	}
+	if dbEntry.ReadCount != 1 {
+		t.Fatalf("db.ReadCount should have been 1, was %v", dbEntry.ReadCount)
+	}
+	decEntry, err := data.DecryptHistoryEntry("dkey", *dbEntry)
+	testutils.Check(t, err)
+	if !data.EntryEquals(decEntry, entry2) {
+		t.Fatalf("DB data is different than input! \ndb   =%#v\nentry=%#v", *dbEntry, entry2)
+	}
+
+	// Query for user 2
+	w = httptest.NewRecorder()
+	searchReq = httptest.NewRequest(http.MethodGet, "/?device_id="+otherDev1+"&user_id="+otherUser, nil)
+	apiQueryHandler(context.Background(), w, searchReq)
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	testutils.Check(t, json.Unmarshal(respBody, &retrievedEntries))
+	if len(retrievedEntries) != 1 {
+		t.Fatalf("Expected to retrieve 1 entry, found %d", len(retrievedEntries))
+	}
+	dbEntry = retrievedEntries[0]
+	if dbEntry.DeviceId != otherDev1 {
+		t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+	}
+	if dbEntry.UserId != data.UserId("dOtherkey") {
+		t.Fatalf("Response contains an incorrect device ID: %#v", *dbEntry)
+	}
+	if dbEntry.ReadCount != 0 {
+		t.Fatalf("db.ReadCount should have been 1, was %v", dbEntry.ReadCount)
+	}
+	decEntry, err = data.DecryptHistoryEntry("dOtherkey", *dbEntry)
+	testutils.Check(t, err)
+	if !data.EntryEquals(decEntry, entry3) {
+		t.Fatalf("DB data is different than input! \ndb   =%#v\nentry=%#v", *dbEntry, entry3)
+	}
+
+	// Query for deletion requests
+	w = httptest.NewRecorder()
+	searchReq = httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil)
+	getDeletionRequestsHandler(context.Background(), w, searchReq)
+	res = w.Result()
+	defer res.Body.Close()
+	respBody, err = io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	var deletionRequests []*shared.DeletionRequest
+	testutils.Check(t, json.Unmarshal(respBody, &deletionRequests))
+	if len(deletionRequests) != 1 {
+		t.Fatalf("received %d deletion requests, expected only one", len(deletionRequests))
+	}
+	deletionRequest := deletionRequests[0]
+	expected := shared.DeletionRequest{
+		UserId:              data.UserId("dkey"),
+		DestinationDeviceId: devId1,
+		SendTime:            delReqTime,
+		ReadCount:           1,
+		Messages: shared.MessageIdentifiers{Ids: []shared.MessageIdentifier{
+			{DeviceId: devId1, Date: entry1.EndTime},
+		}},
+	}
+	if diff := deep.Equal(*deletionRequest, expected); diff != nil {
+		t.Error(diff)
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestHealthcheck(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthCheckHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200 resp code for healthCheckHandler")
+	}
+	res := w.Result()
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(res.Body)
+	testutils.Check(t, err)
+	if string(respBody) != "OK" {
+		t.Fatalf("expected healthcheckHandler to return OK")
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestLimitRegistrations(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Exec("DELETE FROM enc_history_entries")))
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Exec("DELETE FROM devices")))
+	defer func() { GLOBAL_CONFIG = DefaultConfig() }()
+	GLOBAL_CONFIG.Limits.MaxNumUsers = 2
+
+	// Register three devices across two users
+	registerDevice(t, "user1", uuid.Must(uuid.NewRandom()).String())
+	registerDevice(t, "user1", uuid.Must(uuid.NewRandom()).String())
+	registerDevice(t, "user2", uuid.Must(uuid.NewRandom()).String())
+
+	// And this next one should fail since it is a new user
+	err := tryRegisterDevice("user3", uuid.Must(uuid.NewRandom()).String())
+	assertApiErrorCode(t, err, shared.ErrorCodeUserLimitReached)
+}
+
+func TestCleanDatabaseNoErrors(t *testing.T) {
+	// Init
+	initTestDB(t)
+
+	// Create a user and an entry
+	userId := data.UserId("dkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "dkey", devId1)
+	entry1 := testutils.MakeFakeHistoryEntry("ls ~/")
+	entry1.DeviceId = devId1
+	encEntry, err := data.EncryptHistoryEntry("dkey", entry1)
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	submitReq := httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(reqBody))
+	apiSubmitHandler(context.Background(), nil, submitReq)
+
+	// Call cleanDatabase and just check that there are no panics
+	testutils.Check(t, cleanDatabase(context.TODO()))
+}
+
+func TestCursorSync(t *testing.T) {
+	// Set up
+	initTestDB(t)
+
+	// Register two devices
+	userId := data.UserId("cursorkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "cursorkey", devId1)
+	registerDevice(t, "cursorkey", devId2)
+
+	submit := func(commands ...string) {
+		var encEntries []shared.EncHistoryEntry
+		for _, command := range commands {
+			encEntry, err := data.EncryptHistoryEntry("cursorkey", testutils.MakeFakeHistoryEntry(command))
+			testutils.Check(t, err)
+			encEntries = append(encEntries, encEntry)
+		}
+		reqBody, err := json.Marshal(encEntries)
+		testutils.Check(t, err)
+		apiSubmitHandler(context.Background(), nil, httptest.NewRequest(http.MethodPost, "/?user_id="+data.UserId("cursorkey"), bytes.NewReader(reqBody)))
+	}
+	query := func(deviceId, params string) []*shared.EncHistoryEntry {
+		w := httptest.NewRecorder()
+		apiQueryHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?device_id="+deviceId+"&user_id="+userId+params, nil))
+		res := w.Result()
+		defer res.Body.Close()
+		respBody, err := io.ReadAll(res.Body)
+		testutils.Check(t, err)
+		var retrievedEntries []*shared.EncHistoryEntry
+		testutils.Check(t, json.Unmarshal(respBody, &retrievedEntries))
+		return retrievedEntries
+	}
+	assertSeqs := func(entries []*shared.EncHistoryEntry, expectedSeqs ...int64) {
+		t.Helper()
+		var seqs []int64
+		for _, entry := range entries {
+			seqs = append(seqs, entry.Seq)
+		}
+		if diff := deep.Equal(seqs, expectedSeqs); diff != nil {
+			t.Fatalf("unexpected sequence numbers: %v", diff)
+		}
+	}
+
+	// Each device gets its own sequence of entries
+	submit("ls", "echo foo")
+	assertSeqs(query(devId1, "&after_seq=0"), 1, 2)
+	assertSeqs(query(devId2, "&after_seq=0"), 1, 2)
+
+	// Querying from a cursor only returns newer entries, no matter how many times the device queries
+	submit("echo bar")
+	for i := 0; i < 10; i++ {
+		assertSeqs(query(devId1, "&after_seq=2"), 3)
+	}
+	assertSeqs(query(devId1, "&after_seq=3"))
+
+	// Acknowledged entries are cleaned up, while unacknowledged entries are kept even though they've been read many times
+	testutils.Check(t, cleanDatabase(context.TODO()))
+	var numEntries int64
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.EncHistoryEntry{}).Where("device_id = ?", devId1).Count(&numEntries)))
+	if numEntries != 0 {
+		t.Fatalf("expected the acknowledged entries for device 1 to be deleted, found %d", numEntries)
+	}
+	assertSeqs(query(devId2, "&after_seq=1"), 2, 3)
+
+	// A lower cursor doesn't undo an acknowledgement
+	assertSeqs(query(devId1, "&after_seq=0"))
+	var ackedSeq int64
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.Device{}).Select("acked_seq").Where("device_id = ?", devId1).Scan(&ackedSeq)))
+	if ackedSeq != 3 {
+		t.Fatalf("expected acked_seq=3, got %d", ackedSeq)
+	}
+
+	// Entries stored before sequence numbers existed are returned based on their read count
+	legacyEntry, err := data.EncryptHistoryEntry("cursorkey", testutils.MakeFakeHistoryEntry("legacy"))
+	testutils.Check(t, err)
+	legacyEntry.DeviceId = devId1
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Create(&legacyEntry)))
+	for i := 0; i < 5; i++ {
+		assertSeqs(query(devId1, "&after_seq=3"), 0)
+	}
+	assertSeqs(query(devId1, "&after_seq=3"))
+
+	// And clients that don't send a cursor still get the read count based behavior
+	submit("echo baz")
+	for i := 0; i < 5; i++ {
+		assertSeqs(query(devId2, ""), 1, 2, 3, 4)
+	}
+	assertSeqs(query(devId2, ""))
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestDeviceAuth(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	userId := data.UserId("authkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "authkey", devId1)
+	registerDevice(t, "otherauthkey", devId2)
+
+	queryHandler := withDeviceAuth(apiQueryHandler)
+	query := func(userId, deviceId, token string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?device_id="+deviceId+"&user_id="+userId+"&after_seq=0", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		queryHandler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Requests with the device's token are allowed
+	if code := query(userId, devId1, data.DeviceToken("authkey", devId1)); code != 200 {
+		t.Fatalf("expected a valid token to be accepted, got status_code=%d", code)
+	}
+	// But not requests with a missing token, the wrong secret, the token for another device, or for another user
+	for _, tc := range []struct{ userId, deviceId, token string }{
+		{userId, devId1, ""},
+		{userId, devId1, data.DeviceToken("wrongkey", devId1)},
+		{userId, devId1, data.DeviceToken("otherauthkey", devId2)},
+		{data.UserId("otherauthkey"), devId1, data.DeviceToken("authkey", devId1)},
+		{userId, devId2, data.DeviceToken("authkey", devId2)},
+		{userId, "", data.DeviceToken("authkey", "")},
+	} {
+		if code := query(tc.userId, tc.deviceId, tc.token); code != http.StatusUnauthorized {
+			t.Fatalf("expected %#v to be rejected, got status_code=%d", tc, code)
+		}
+	}
+
+	// Registering another device for an existing user requires the user token
+	devId3 := uuid.Must(uuid.NewRandom()).String()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?device_id="+devId3+"&user_id="+userId, nil)
+	req.Header.Set("Authorization", "Bearer "+data.DeviceToken("wrongkey", devId3))
+	req.Header.Set(UserTokenHeader, data.UserToken("wrongkey"))
+	err := apiRegisterHandler(context.Background(), w, req)
+	assertApiErrorCode(t, err, shared.ErrorCodeUnauthorized)
+	var numDevices int64
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.Device{}).Where("user_id = ?", userId).Count(&numDevices)))
+	if numDevices != 1 {
+		t.Fatalf("expected 1 device, got %d", numDevices)
+	}
+
+	// Devices that were registered before tokens existed get a token when they register again
+	legacyUserId := data.UserId("legacykey")
+	legacyDevId := uuid.Must(uuid.NewRandom()).String()
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Create(&shared.Device{UserId: legacyUserId, DeviceId: legacyDevId, RegistrationDate: time.Now()})))
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?device_id="+legacyDevId+"&user_id="+legacyUserId+"&after_seq=0", nil)
+	req.Header.Set("Authorization", "Bearer "+data.DeviceToken("legacykey", legacyDevId))
+	queryHandler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), shared.ErrorCodeDeviceTokenNotRegistered) {
+		t.Fatalf("expected the legacy device to be asked to register its token, got status_code=%d body=%#v", w.Code, w.Body.String())
+	}
+
+	// Until then, no one can register a new device for the legacy user, since there is no user token to check
+	attackerDevId := uuid.Must(uuid.NewRandom()).String()
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?device_id="+attackerDevId+"&user_id="+legacyUserId, nil)
+	req.Header.Set("Authorization", "Bearer "+data.DeviceToken("attackerkey", attackerDevId))
+	req.Header.Set(UserTokenHeader, data.UserToken("attackerkey"))
+	err = apiRegisterHandler(context.Background(), w, req)
+	assertApiErrorCode(t, err, shared.ErrorCodeUnauthorized)
+	err = tryRegisterDevice("legacykey", uuid.Must(uuid.NewRandom()).String())
+	assertApiErrorCode(t, err, shared.ErrorCodeUnauthorized)
+	var legacyDevices []*shared.Device
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Where("user_id = ?", legacyUserId).Find(&legacyDevices)))
+	if len(legacyDevices) != 1 || legacyDevices[0].TokenHash != "" || legacyDevices[0].UserTokenHash != "" {
+		t.Fatalf("expected the rejected registrations to not change the legacy user's devices: %#v", legacyDevices)
+	}
+
+	// The existing device can register its token, which also sets the user token
+	registerDevice(t, "legacykey", legacyDevId)
+	if code := query(legacyUserId, legacyDevId, data.DeviceToken("legacykey", legacyDevId)); code != 200 {
+		t.Fatalf("expected the legacy device to be accepted after registering, got status_code=%d", code)
+	}
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.Device{}).Where("user_id = ?", legacyUserId).Count(&numDevices)))
+	if numDevices != 1 {
+		t.Fatalf("expected re-registering to not create a new device, got %d devices", numDevices)
+	}
+	var numDumpRequests int64
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.DumpRequest{}).Where("user_id = ?", legacyUserId).Count(&numDumpRequests)))
+	if numDumpRequests != 0 {
+		t.Fatalf("expected re-registering to not create a dump request, got %d", numDumpRequests)
+	}
+
+	// After which the attacker's user token is rejected, while the user's other devices can register
+	err = apiRegisterHandler(context.Background(), httptest.NewRecorder(), req)
+	assertApiErrorCode(t, err, shared.ErrorCodeUnauthorized)
+	registerDevice(t, "legacykey", uuid.Must(uuid.NewRandom()).String())
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.Device{}).Where("user_id = ?", legacyUserId).Count(&numDevices)))
+	if numDevices != 2 {
+		t.Fatalf("expected the legacy user to have 2 devices, got %d", numDevices)
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestDeviceManagement(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	userId := data.UserId("devicekey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "devicekey", devId1)
+	registerDevice(t, "devicekey", devId2)
+
+	listDevices := func() []shared.DeviceInfo {
+		w := httptest.NewRecorder()
+		apiListDevicesHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+		var devices []shared.DeviceInfo
+		testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &devices))
+		return devices
+	}
+	devices := listDevices()
+	if len(devices) != 2 || devices[0].DeviceId != devId1 || devices[1].DeviceId != devId2 {
+		t.Fatalf("unexpected devices: %#v", devices)
+	}
+	if devices[0].IsRevoked || devices[1].IsRevoked {
+		t.Fatalf("expected no devices to be revoked: %#v", devices)
+	}
+
+	// Rename a device
+	testutils.Check(t, apiRenameDeviceHandler(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/?device_id="+devId1+"&user_id="+userId+"&target_device_id="+devId2+"&name=laptop", nil)))
+	devices = listDevices()
+	if devices[0].Name != "" || devices[1].Name != "laptop" {
+		t.Fatalf("unexpected device names: %#v", devices)
+	}
+	// Other users' devices can't be renamed
+	err := apiRenameDeviceHandler(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/?device_id="+devId1+"&user_id="+data.UserId("otherkey")+"&target_device_id="+devId2+"&name=foo", nil))
+	assertApiErrorCode(t, err, shared.ErrorCodeNotFound)
+	// Renaming and revoking devices modify state, so they can't be done with a GET
+	for _, handler := range []func(context.Context, http.ResponseWriter, *http.Request) error{apiRenameDeviceHandler, apiRevokeDeviceHandler} {
+		err = handler(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId+"&target_device_id="+devId2+"&name=foo", nil))
+		var apiErr *shared.ApiError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("expected a GET to be rejected with status_code=405, got err=%v", err)
+		}
+	}
+	if devices = listDevices(); devices[1].Name != "laptop" || devices[1].IsRevoked {
+		t.Fatalf("expected the rejected requests to not change the device: %#v", devices)
+	}
+
+	// Submit an entry and create a dump request that are both pending for devId2
+	entry := testutils.MakeFakeHistoryEntry("ls")
+	encEntry, err := data.EncryptHistoryEntry("devicekey", entry)
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	apiSubmitHandler(context.Background(), nil, httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(reqBody)))
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Create(&shared.DumpRequest{UserId: userId, RequestingDeviceId: devId2, RequestTime: time.Now()})))
+
+	// Revoke devId2
+	testutils.Check(t, apiRevokeDeviceHandler(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/?device_id="+devId1+"&user_id="+userId+"&target_device_id="+devId2, nil)))
+	devices = listDevices()
+	if devices[0].IsRevoked || !devices[1].IsRevoked {
+		t.Fatalf("expected only devId2 to be revoked: %#v", devices)
+	}
+
+	// The pending entries and dump requests for the revoked device are gone
+	var numEntries int64
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.EncHistoryEntry{}).Where("device_id = ?", devId2).Count(&numEntries)))
+	if numEntries != 0 {
+		t.Fatalf("expected the revoked device's entries to be deleted, found %d", numEntries)
+	}
+	w := httptest.NewRecorder()
+	apiGetPendingDumpRequestsHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+	var dumpRequests []*shared.DumpRequest
+	testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &dumpRequests))
+	if len(dumpRequests) != 0 {
+		t.Fatalf("expected no dump requests, got %#v", dumpRequests)
+	}
+
+	// New entries are no longer sent to the revoked device
+	apiSubmitHandler(context.Background(), nil, httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(reqBody)))
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.EncHistoryEntry{}).Where("device_id = ?", devId2).Count(&numEntries)))
+	if numEntries != 0 {
+		t.Fatalf("expected the revoked device to not receive new entries, found %d", numEntries)
+	}
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.EncHistoryEntry{}).Where("device_id = ?", devId1).Count(&numEntries)))
+	if numEntries != 2 {
+		t.Fatalf("expected devId1 to receive both entries, found %d", numEntries)
+	}
+
+	// And the revoked device can't make requests or register again
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?device_id="+devId2+"&user_id="+userId+"&after_seq=0", nil)
+	req.Header.Set("Authorization", "Bearer "+data.DeviceToken("devicekey", devId2))
+	withDeviceAuth(apiQueryHandler).ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected the revoked device to be rejected, got status_code=%d", w.Code)
+	}
+	var apiErr shared.ApiError
+	testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &apiErr))
+	if apiErr.Code != shared.ErrorCodeDeviceRevoked {
+		t.Fatalf("expected the revoked device to be rejected with code=%s, got %#v", shared.ErrorCodeDeviceRevoked, apiErr)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/?device_id="+devId2+"&user_id="+userId, nil)
+	req.Header.Set("Authorization", "Bearer "+data.DeviceToken("devicekey", devId2))
+	req.Header.Set(UserTokenHeader, data.UserToken("devicekey"))
+	err = apiRegisterHandler(context.Background(), httptest.NewRecorder(), req)
+	assertApiErrorCode(t, err, shared.ErrorCodeDeviceRevoked)
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestPurgeUser(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	userId := data.UserId("purgekey")
+	otherUserId := data.UserId("otherpurgekey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	otherDevId := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "purgekey", devId1)
+	registerDevice(t, "purgekey", devId2)
+	registerDevice(t, "otherpurgekey", otherDevId)
+	submit := func(userSecret string) {
+		encEntry, err := data.EncryptHistoryEntry(userSecret, testutils.MakeFakeHistoryEntry("ls"))
+		testutils.Check(t, err)
+		reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+		testutils.Check(t, err)
+		apiSubmitHandler(context.Background(), nil, httptest.NewRequest(http.MethodPost, "/?user_id="+data.UserId(userSecret), bytes.NewReader(reqBody)))
+	}
+	submit("purgekey")
+	submit("otherpurgekey")
+
+	// Purging is irreversible, so it can't be done with a GET
+	err := apiPurgeUserHandler(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+	var apiErr *shared.ApiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected purging with a GET to be rejected, got %v", err)
+	}
+	var count int64
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.EncHistoryEntry{}).Where("user_id = ?", userId).Count(&count)))
+	if count != 2 {
+		t.Fatalf("expected the user's entries to be kept after a GET, found %d", count)
+	}
+
+	// Purge the user
+	w := httptest.NewRecorder()
+	apiPurgeUserHandler(context.Background(), w, httptest.NewRequest(http.MethodPost, "/?device_id="+devId1+"&user_id="+userId, nil))
+	if w.Code != 200 {
+		t.Fatalf("failed to purge user, status_code=%d", w.Code)
+	}
+
+	// All of their entries and requests are gone, and their devices are revoked
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.EncHistoryEntry{}).Where("user_id = ?", userId).Count(&count)))
+	if count != 0 {
+		t.Fatalf("expected the purged user's entries to be deleted, found %d", count)
+	}
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.DumpRequest{}).Where("user_id = ?", userId).Count(&count)))
+	if count != 0 {
+		t.Fatalf("expected the purged user's dump requests to be deleted, found %d", count)
+	}
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.Device{}).Where("user_id = ? AND is_revoked = ?", userId, false).Count(&count)))
+	if count != 0 {
+		t.Fatalf("expected all of the purged user's devices to be revoked, found %d unrevoked devices", count)
+	}
+
+	// Other users are unaffected
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.EncHistoryEntry{}).Where("user_id = ?", otherUserId).Count(&count)))
+	if count != 1 {
+		t.Fatalf("expected the other user's entry to be kept, found %d", count)
+	}
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.Device{}).Where("user_id = ? AND is_revoked = ?", otherUserId, false).Count(&count)))
+	if count != 1 {
+		t.Fatalf("expected the other user's device to not be revoked, found %d unrevoked devices", count)
+	}
+
+	// The device can register under a new user ID after rotating its key
+	registerDevice(t, "rotatedpurgekey", devId1)
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.Device{}).Where("user_id = ? AND device_id = ? AND is_revoked = ?", data.UserId("rotatedpurgekey"), devId1, false).Count(&count)))
+	if count != 1 {
+		t.Fatalf("expected the device to be registered under the new user ID, found %d devices", count)
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestCompression(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	userId := data.UserId("compressionkey")
+	devId := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "compressionkey", devId)
+	encEntry, err := data.EncryptHistoryEntry("compressionkey", testutils.MakeFakeHistoryEntry("ls"))
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+
+	// Compressed request bodies are decompressed
+	for _, encoding := range []string{shared.EncodingZstd, shared.EncodingGzip} {
+		compressed, err := shared.Compress(reqBody, encoding)
+		testutils.Check(t, err)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(compressed))
+		req.Header.Set("Content-Encoding", encoding)
+		withLogging(apiSubmitHandler).ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("failed to submit a %s compressed body, status_code=%d", encoding, w.Code)
+		}
+		if w.Header().Get("Accept-Encoding") != shared.SupportedEncodings {
+			t.Fatalf("expected the response to advertise the supported encodings, got %#v", w.Header().Get("Accept-Encoding"))
+		}
+	}
+	var numEntries int64
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.EncHistoryEntry{}).Where("user_id = ?", userId).Count(&numEntries)))
+	if numEntries != 2 {
+		t.Fatalf("expected 2 entries to be submitted, found %d", numEntries)
+	}
+
+	// A small compressed body can't decompress to more than the maximum request size
+	compressed, err := shared.Compress(append(append([]byte("["), bytes.Repeat([]byte(" "), maxRequestBodySize)...), ']'), shared.EncodingZstd)
+	testutils.Check(t, err)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", shared.EncodingZstd)
+	withLogging(apiSubmitHandler).ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a %d byte compressed body that is too large once decompressed to be rejected, got status_code=%d", len(compressed), w.Code)
+	}
+
+	// Unsupported encodings are rejected
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(reqBody))
+	req.Header.Set("Content-Encoding", "br")
+	withLogging(apiSubmitHandler).ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected an unsupported encoding to be rejected, got status_code=%d", w.Code)
+	}
+
+	// Responses are compressed with the negotiated encoding
+	for _, tc := range []struct{ acceptEncoding, expectedEncoding string }{
+		{"", ""},
+		{"gzip", shared.EncodingGzip},
+		{"zstd, gzip", shared.EncodingZstd},
+		{"zstd;q=0, gzip", shared.EncodingGzip},
+		{"br", ""},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		withLogging(apiBootstrapHandler).ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("failed to bootstrap, status_code=%d", w.Code)
+		}
+		if encoding := w.Header().Get("Content-Encoding"); encoding != tc.expectedEncoding {
+			t.Fatalf("expected Accept-Encoding=%#v to get Content-Encoding=%#v, got %#v", tc.acceptEncoding, tc.expectedEncoding, encoding)
+		}
+		respBody, err := shared.Decompress(w.Body.Bytes(), tc.expectedEncoding)
+		testutils.Check(t, err)
+		var retrievedEntries []*shared.EncHistoryEntry
+		testutils.Check(t, json.Unmarshal(respBody, &retrievedEntries))
+		if len(retrievedEntries) != 2 {
+			t.Fatalf("expected to retrieve 2 entries, got %d", len(retrievedEntries))
+		}
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestEntryEncodingNegotiation(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	userId := data.UserId("entryencodingkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "entryencodingkey", devId1)
+	registerDevice(t, "entryencodingkey", devId2)
+	query := func(deviceId string, supportsCompression bool) string {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?device_id="+deviceId+"&user_id="+userId+"&after_seq=0", nil)
+		req.Header.Set("Authorization", "Bearer "+data.DeviceToken("entryencodingkey", deviceId))
+		if supportsCompression {
+			req.Header.Set(shared.EntryEncodingsHeader, shared.EncodingZstd)
+		}
+		withDeviceAuth(apiQueryHandler).ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("failed to query, status_code=%d", w.Code)
+		}
+		return w.Header().Get(shared.EntryEncodingHeader)
+	}
+
+	// Entries are only compressed once every device supports it
+	if encoding := query(devId1, true); encoding != shared.EncodingIdentity {
+		t.Fatalf("expected entries to not be compressed while devId2 doesn't support it, got %#v", encoding)
+	}
+	if encoding := query(devId2, true); encoding != shared.EncodingZstd {
+		t.Fatalf("expected entries to be compressed once all devices support it, got %#v", encoding)
+	}
+
+	// A device that is downgraded turns compression off again
+	query(devId2, false)
+	if encoding := query(devId1, true); encoding != shared.EncodingIdentity {
+		t.Fatalf("expected entries to not be compressed after devId2 was downgraded, got %#v", encoding)
+	}
+
+	// Revoked devices don't count
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Model(&shared.Device{}).Where("device_id = ?", devId2).Update("is_revoked", true)))
+	if encoding := query(devId1, true); encoding != shared.EncodingZstd {
+		t.Fatalf("expected the revoked device to be ignored, got %#v", encoding)
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestStreamingBootstrap(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	userId := data.UserId("streamkey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "streamkey", devId1)
+	registerDevice(t, "streamkey", devId2)
+	var encEntries []shared.EncHistoryEntry
+	for i := 0; i < 1500; i++ {
+		encEntry, err := data.EncryptHistoryEntry("streamkey", testutils.MakeFakeHistoryEntry(fmt.Sprintf("echo %d", i)))
+		testutils.Check(t, err)
+		encEntries = append(encEntries, encEntry)
+	}
+	reqBody, err := json.Marshal(encEntries)
+	testutils.Check(t, err)
+	apiSubmitHandler(context.Background(), nil, httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(reqBody)))
+
+	// The entries are streamed one per line, for both devices
+	w := httptest.NewRecorder()
+	apiBootstrapHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId+"&format=ndjson", nil))
+	if contentType := w.Header().Get("Content-Type"); contentType != shared.NdjsonContentType {
+		t.Fatalf("unexpected Content-Type: %#v", contentType)
+	}
+	if total := w.Header().Get(shared.TotalEntriesHeader); total != "3000" {
+		t.Fatalf("unexpected total entries: %#v", total)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3000 {
+		t.Fatalf("expected 3000 lines, got %d", len(lines))
+	}
+	commands := make(map[string]bool)
+	for _, line := range lines {
+		var entry shared.EncHistoryEntry
+		testutils.Check(t, json.Unmarshal([]byte(line), &entry))
+		decEntry, err := data.DecryptHistoryEntry("streamkey", entry)
+		testutils.Check(t, err)
+		commands[decEntry.Command] = true
+	}
+	if len(commands) != 1500 {
+		t.Fatalf("expected 1500 distinct commands, got %d", len(commands))
+	}
+
+	// The DB connection is released between batches, so other requests aren't blocked by a slow client
+	w = httptest.NewRecorder()
+	numFlushes := 0
+	flushWriter := &flushHookWriter{ResponseRecorder: w, onFlush: func() {
+		numFlushes += 1
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var count int64
+		testutils.Check(t, checkGormResult(GLOBAL_DB.WithContext(ctx).Model(&shared.Device{}).Where("user_id = ?", userId).Count(&count)))
+	}}
+	apiBootstrapHandler(context.Background(), flushWriter, httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId+"&format=ndjson", nil))
+	if numLines := strings.Count(w.Body.String(), "\n"); numLines != 3000 || numFlushes != 4 {
+		t.Fatalf("expected 3000 lines in 4 batches, got %d lines and %d flushes", numLines, numFlushes)
+	}
+
+	// Older clients still get a JSON array
+	w = httptest.NewRecorder()
+	apiBootstrapHandler(context.Background(), w, httptest.NewRequest(http.MethodGet, "/?device_id="+devId1+"&user_id="+userId, nil))
+	var retrievedEntries []*shared.EncHistoryEntry
+	testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &retrievedEntries))
+	if len(retrievedEntries) != 3000 {
+		t.Fatalf("expected 3000 entries, got %d", len(retrievedEntries))
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestErrorResponses(t *testing.T) {
+	// Set up
+	initTestDB(t)
+
+	getApiError := func(w *httptest.ResponseRecorder) shared.ApiError {
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Fatalf("unexpected Content-Type for an error: %#v", contentType)
+		}
+		var apiErr shared.ApiError
+		testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &apiErr))
+		return apiErr
+	}
+
+	// Bad input is reported as a 400 along with what was wrong with it
+	w := httptest.NewRecorder()
+	withLogging(apiDownloadHandler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected the download handler to succeed, got status_code=%d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	withLogging(apiBannerHandler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?device_id=foo", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a missing query param to be rejected, got status_code=%d", w.Code)
+	}
+	if apiErr := getApiError(w); apiErr.Code != shared.ErrorCodeBadRequest || !strings.Contains(apiErr.Message, "commit_hash") {
+		t.Fatalf("unexpected error: %#v", apiErr)
+	}
+
+	// Requests without a device token are rejected as unauthorized
+	w = httptest.NewRecorder()
+	withDeviceAuth(apiQueryHandler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?device_id=foo&user_id=bar", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a request without a token to be rejected, got status_code=%d", w.Code)
+	}
+	if apiErr := getApiError(w); apiErr.Code != shared.ErrorCodeUnauthorized {
+		t.Fatalf("unexpected error: %#v", apiErr)
+	}
+
+	// Internal errors and panics are reported as a 500 without leaking any details
+	for _, h := range []func(context.Context, http.ResponseWriter, *http.Request) error{
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			return fmt.Errorf("secret details")
+		},
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			panic("secret details")
+		},
+	} {
+		w = httptest.NewRecorder()
+		withLogging(h).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected an internal error, got status_code=%d", w.Code)
+		}
+		if apiErr := getApiError(w); apiErr.Code != shared.ErrorCodeInternal || strings.Contains(apiErr.Message, "secret") {
+			t.Fatalf("unexpected error: %#v", apiErr)
+		}
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestRateLimits(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	defer func() {
+		GLOBAL_CONFIG = DefaultConfig()
+		requestRateLimiter = newRateLimiter()
+	}()
+	userId := data.UserId("ratekey")
+	devId := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "ratekey", devId)
+	otherUserId := data.UserId("otherratekey")
+	otherDevId := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "otherratekey", otherDevId)
+	query := func(userSecret, userId, deviceId, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?device_id="+deviceId+"&user_id="+userId, nil)
+		req.Header.Set("Authorization", "Bearer "+data.DeviceToken(userSecret, deviceId))
+		req.Header.Set("X-Real-Ip", ip)
+		w := httptest.NewRecorder()
+		withDeviceAuth(apiQueryHandler).ServeHTTP(w, req)
+		return w
+	}
+	assertRateLimited := func(w *httptest.ResponseRecorder) {
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Fatalf("expected the request to be rate limited, got status_code=%d", w.Code)
+		}
+		var apiErr shared.ApiError
+		testutils.Check(t, json.Unmarshal(w.Body.Bytes(), &apiErr))
+		if apiErr.Code != shared.ErrorCodeRateLimited {
+			t.Fatalf("unexpected error: %#v", apiErr)
+		}
+	}
+
+	// Each user can make a burst of requests before being limited, without affecting other users
+	GLOBAL_CONFIG.Limits.UserRequestsPerSecond = 0.001
+	GLOBAL_CONFIG.Limits.UserBurst = 2
+	for i := 0; i < 2; i++ {
+		if w := query("ratekey", userId, devId, "1.1.1.1"); w.Code != 200 {
+			t.Fatalf("expected request #%d to succeed, got status_code=%d", i, w.Code)
+		}
+	}
+	assertRateLimited(query("ratekey", userId, devId, "1.1.1.1"))
+	if w := query("otherratekey", otherUserId, otherDevId, "1.1.1.1"); w.Code != 200 {
+		t.Fatalf("expected a different user to not be limited, got status_code=%d", w.Code)
+	}
+
+	// And the same goes for each IP, including for registrations. httptest requests come from 192.0.2.1, which is
+	// trusted to set the X-Real-Ip header.
+	GLOBAL_CONFIG.Limits = LimitsConfig{IpRequestsPerSecond: 0.001, IpBurst: 1, TrustedProxies: []string{"192.0.2.0/24"}}
+	requestRateLimiter = newRateLimiter()
+	if w := query("ratekey", userId, devId, "2.2.2.2"); w.Code != 200 {
+		t.Fatalf("expected the first request to succeed, got status_code=%d", w.Code)
+	}
+	assertRateLimited(query("otherratekey", otherUserId, otherDevId, "2.2.2.2"))
+	if w := query("otherratekey", otherUserId, otherDevId, "3.3.3.3"); w.Code != 200 {
+		t.Fatalf("expected a different IP to not be limited, got status_code=%d", w.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/?device_id=foo&user_id=bar", nil)
+	req.Header.Set("X-Real-Ip", "3.3.3.3")
+	err := apiRegisterHandler(context.Background(), httptest.NewRecorder(), req)
+	assertApiErrorCode(t, err, shared.ErrorCodeRateLimited)
+
+	// Without a trusted proxy, the X-Real-Ip header is ignored so that it can't be used to evade the limit
+	GLOBAL_CONFIG.Limits = LimitsConfig{IpRequestsPerSecond: 0.001, IpBurst: 1}
+	requestRateLimiter = newRateLimiter()
+	if w := query("ratekey", userId, devId, "4.4.4.4"); w.Code != 200 {
+		t.Fatalf("expected the first request to succeed, got status_code=%d", w.Code)
+	}
+	assertRateLimited(query("ratekey", userId, devId, "5.5.5.5"))
+	for _, tc := range []struct {
+		trustedProxies []string
+		remoteAddr     string
+		expectedIp     string
+	}{
+		{nil, "192.0.2.1:1234", "192.0.2.1"},
+		{[]string{"192.0.2.1"}, "192.0.2.1:1234", "6.6.6.6"},
+		{[]string{"192.0.2.2"}, "192.0.2.1:1234", "192.0.2.1"},
+		{[]string{"10.0.0.0/8", "::1"}, "[::1]:1234", "6.6.6.6"},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:1234", "6.6.6.6"},
+	} {
+		GLOBAL_CONFIG.Limits.TrustedProxies = tc.trustedProxies
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("X-Real-Ip", "6.6.6.6")
+		if ip := getRemoteAddr(req); ip != tc.expectedIp {
+			t.Fatalf("expected %#v to be used for %#v, got %#v", tc.expectedIp, tc, ip)
+		}
+	}
+	GLOBAL_CONFIG.Limits.TrustedProxies = []string{"not-an-ip"}
+	if err := GLOBAL_CONFIG.Validate(); err == nil || !strings.Contains(err.Error(), "limits.trusted_proxies") {
+		t.Fatalf("expected an invalid trusted proxy to be rejected, got %v", err)
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestStorageQuota(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	defer func() { GLOBAL_CONFIG = DefaultConfig() }()
+	userId := data.UserId("quotakey")
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "quotakey", devId1)
+	registerDevice(t, "quotakey", devId2)
+	submit := func(command string) error {
+		entry, err := data.EncryptHistoryEntry("quotakey", testutils.MakeFakeHistoryEntry(command))
+		testutils.Check(t, err)
+		reqBody, err := json.Marshal([]shared.EncHistoryEntry{entry})
+		testutils.Check(t, err)
+		return apiSubmitHandler(context.Background(), nil, httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(reqBody)))
+	}
+
+	// Entries are stored once per device, so the quota of 3 entries fits one submission but not two
+	storageUsages = newStorageUsageCache()
+	GLOBAL_CONFIG.Limits.MaxEntriesPerUser = 3
+	testutils.Check(t, submit("echo 1"))
+	err := submit("echo 2")
+	assertApiErrorCode(t, err, shared.ErrorCodeQuotaExceeded)
+	if !strings.Contains(err.Error(), "at most 3 entries per user") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The usage is cached rather than recomputed on every submission
+	if usage, ok := storageUsages.get(userId); !ok || usage.NumEntries != 2 {
+		t.Fatalf("expected the usage to be cached, got %#v", usage)
+	}
+
+	// Once the entries are synced and deleted, there is space for more. A submission that exceeds the quota only
+	// recomputes the usage once it is old enough, so that it doesn't scan the entries on every request.
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Where("user_id = ?", userId).Delete(&shared.EncHistoryEntry{})))
+	assertApiErrorCode(t, submit("echo 3"), shared.ErrorCodeQuotaExceeded)
+	storageUsages.usages[userId].computedAt = time.Now().Add(-storageUsageRecheckInterval)
+	testutils.Check(t, submit("echo 3"))
+
+	// Dumps count towards the quota too
+	testutils.Check(t, checkGormResult(GLOBAL_DB.Create(&shared.DumpRequest{UserId: userId, RequestingDeviceId: devId2, RequestTime: time.Now()})))
+	entry, err := data.EncryptHistoryEntry("quotakey", testutils.MakeFakeHistoryEntry("echo dump"))
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{entry, entry})
+	testutils.Check(t, err)
+	err = apiSubmitDumpHandler(context.Background(), nil, httptest.NewRequest(http.MethodPost, "/?user_id="+userId+"&requesting_device_id="+devId2+"&source_device_id="+devId1, bytes.NewReader(reqBody)))
+	assertApiErrorCode(t, err, shared.ErrorCodeQuotaExceeded)
+
+	// The number of bytes is limited in the same way
+	storageUsages = newStorageUsageCache()
+	GLOBAL_CONFIG.Limits = LimitsConfig{MaxBytesPerUser: 100}
+	err = submit("echo 4")
+	assertApiErrorCode(t, err, shared.ErrorCodeQuotaExceeded)
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		testutils.Check(t, os.WriteFile(path, []byte(contents), 0o600))
+		return path
+	}
+
+	// The same config can be written as either YAML or TOML
+	yamlConfig := writeConfig("server.yaml", `
+listen_address: "127.0.0.1:9000"
+database:
+  driver: sqlite
+  dsn: /tmp/server.sqlite
+limits:
+  max_num_users: 3
+retention:
+  cleanup_interval: 1h
+observability:
+  metrics: prometheus
+`)
+	tomlConfig := writeConfig("server.toml", `
+listen_address = "127.0.0.1:9000"
+
+[database]
+driver = "sqlite"
+dsn = "/tmp/server.sqlite"
+
+[limits]
+max_num_users = 3
+
+[retention]
+cleanup_interval = "1h"
+
+[observability]
+metrics = "prometheus"
+`)
+	for _, path := range []string{yamlConfig, tomlConfig} {
+		cfg := DefaultConfig()
+		testutils.Check(t, LoadConfigFile(path, &cfg))
+		testutils.Check(t, cfg.Validate())
+		if cfg.ListenAddress != "127.0.0.1:9000" || cfg.Database.Driver != "sqlite" || cfg.Database.DSN != "/tmp/server.sqlite" || cfg.Limits.MaxNumUsers != 3 || cfg.Retention.CleanupInterval.Duration != time.Hour || cfg.Observability.Metrics != "prometheus" {
+			t.Fatalf("unexpected config loaded from %s: %#v", path, cfg)
+		}
+		// Options that aren't in the file keep their defaults
+		if cfg.Retention.MaxEntryReadCount != 10 || cfg.Retention.MaxDeletionRequestReadCount != 100 {
+			t.Fatalf("expected the default read counts, got %#v", cfg.Retention)
+		}
+	}
+
+	// The example config documents the defaults
+	cfg := DefaultConfig()
+	testutils.Check(t, LoadConfigFile("../config.example.yaml", &cfg))
+	expected := DefaultConfig()
+	expected.Environment = "dev"
+	expected.Database.DSN = cfg.Database.DSN
+	if diff := deep.Equal(cfg, expected); diff != nil {
+		t.Fatalf("the example config doesn't match the defaults: %v", diff)
+	}
+
+	// Typos are rejected rather than silently ignored
+	cfg = DefaultConfig()
+	err := LoadConfigFile(writeConfig("typo.yaml", "listen_adress: \":9000\"\n"), &cfg)
+	if err == nil || !strings.Contains(err.Error(), "listen_adress") {
+		t.Fatalf("expected an error for the unknown option, got %v", err)
+	}
+	err = LoadConfigFile(writeConfig("typo.toml", "[limits]\nmax_users = 1\n"), &cfg)
+	if err == nil || !strings.Contains(err.Error(), "max_users") {
+		t.Fatalf("expected an error for the unknown option, got %v", err)
+	}
+	err = LoadConfigFile(writeConfig("server.json", "{}"), &cfg)
+	if err == nil || !strings.Contains(err.Error(), "unsupported config file") {
+		t.Fatalf("expected an error for the unsupported file type, got %v", err)
+	}
+
+	// And validation reports every problem with the config at once
+	cfg = DefaultConfig()
+	cfg.ListenAddress = "8080"
+	cfg.TLS.CertFile = "/tmp/cert.pem"
+	cfg.Database = DatabaseConfig{Driver: "sqlite"}
+	cfg.Retention.DeepClean = true
+	cfg.Observability.Metrics = "statsd"
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatalf("expected the config to be invalid")
+	}
+	for _, expected := range []string{"listen_address", "tls.cert_file and tls.key_file", "database.dsn", "retention.deep_clean", "observability.metrics"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected the error to mention %#v, got: %v", expected, err)
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Timeouts.Shutdown = Duration{5 * time.Second}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	testutils.Check(t, err)
+	requestStarted := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requestStarted)
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serveListener(ctx, listener, cfg, handler)
+	}()
+
+	// Start a slow request, and then shut down the server while it is in-flight
+	responseBody := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responseBody <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		responseBody <- string(body)
+	}()
+	<-requestStarted
+	cancel()
+
+	// The in-flight request still succeeds, and then the server exits cleanly
+	if body := <-responseBody; body != "done" {
+		t.Fatalf("expected the in-flight request to finish, got %#v", body)
+	}
+	testutils.Check(t, <-serveErr)
+	if _, err := http.Get("http://" + listener.Addr().String()); err == nil {
+		t.Fatalf("expected the server to stop accepting requests")
+	}
+
+	// And the background jobs stop as soon as their context is cancelled
+	backgroundJobsDone := make(chan struct{})
+	go func() {
+		RunBackgroundJobs(ctx)
+		close(backgroundJobsDone)
+	}()
+	select {
+	case <-backgroundJobsDone:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the background jobs to stop")
+	}
+}
+
+func TestTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first.example.com")
+	reloader, err := newCertReloader(certFile, keyFile)
+	testutils.Check(t, err)
+	getCommonName := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		testutils.Check(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		testutils.Check(t, err)
+		return parsed.Subject.CommonName
+	}
+	if cn := getCommonName(); cn != "first.example.com" {
+		t.Fatalf("unexpected certificate: %#v", cn)
+	}
+
+	// A renewed certificate is picked up without a restart
+	writeTestCert(t, certFile, keyFile, "second.example.com")
+	future := time.Now().Add(time.Minute)
+	testutils.Check(t, os.Chtimes(certFile, future, future))
+	if cn := getCommonName(); cn != "second.example.com" {
+		t.Fatalf("expected the renewed certificate, got %#v", cn)
+	}
+
+	// And a broken certificate doesn't replace the last working one
+	testutils.Check(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	future = future.Add(time.Minute)
+	testutils.Check(t, os.Chtimes(certFile, future, future))
+	if cn := getCommonName(); cn != "second.example.com" {
+		t.Fatalf("expected the previous certificate to still be used, got %#v", cn)
+	}
+}
+
+// Writes a self-signed certificate for the given host name
+func writeTestCert(t *testing.T, certFile, keyFile, hostname string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutils.Check(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	testutils.Check(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	testutils.Check(t, err)
+	testutils.Check(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0o600))
+	testutils.Check(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+}
+
+func TestPrometheusStats(t *testing.T) {
+	// Set up
+	initTestDB(t)
+	stats := NewPrometheusStats()
+	GLOBAL_STATSD = stats
+	defer func() { GLOBAL_STATSD = nil }()
+	userId := data.UserId("promkey")
+	devId := uuid.Must(uuid.NewRandom()).String()
+	registerDevice(t, "promkey", devId)
+	entry := testutils.MakeFakeHistoryEntry("ls ~/")
+	encEntry, err := data.EncryptHistoryEntry("promkey", entry)
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+
+	// Make a few requests and report the gauges
+	w := httptest.NewRecorder()
+	withLogging(apiSubmitHandler).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?user_id="+userId, bytes.NewReader(reqBody)))
+	if w.Code != 200 {
+		t.Fatalf("failed to submit, status_code=%d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	withLogging(apiQueryHandler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?device_id="+devId+"&user_id="+userId, nil))
+	if w.Code != 200 {
+		t.Fatalf("failed to query, status_code=%d", w.Code)
+	}
+	testutils.Check(t, reportPendingRequests(context.Background()))
+
+	// And check that they're all exposed for Prometheus
+	w = httptest.NewRecorder()
+	stats.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := w.Body.String()
+	for _, expected := range []string{
+		`hishtory_request_duration_bucket{handler="apiSubmitHandler"`,
+		`hishtory_request_duration_bucket{handler="apiQueryHandler"`,
+		`hishtory_submit_entries_total 1`,
+		`hishtory_query_entries_total 1`,
+		`hishtory_db_duration_count{operation="create"}`,
+		`hishtory_db_duration_count{operation="query"}`,
+		"# TYPE hishtory_pending_dump_requests gauge",
+		"# TYPE hishtory_pending_deletion_requests gauge",
+		`go_goroutines`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Fatalf("expected metrics to contain %#v, got:\n%s", expected, metrics)
+		}
+	}
+
+	// Assert that we aren't leaking connections
+	assertNoLeakedConnections(t, GLOBAL_DB)
+}
+
+// Registers the given device, authenticated with the tokens derived from the user secret
+func registerDevice(t *testing.T, userSecret, deviceId string) {
+	testutils.Check(t, tryRegisterDevice(userSecret, deviceId))
+}
+
+func tryRegisterDevice(userSecret, deviceId string) error {
+	req := httptest.NewRequest(http.MethodGet, "/?device_id="+deviceId+"&user_id="+data.UserId(userSecret), nil)
+	req.Header.Set("Authorization", "Bearer "+data.DeviceToken(userSecret, deviceId))
+	req.Header.Set(UserTokenHeader, data.UserToken(userSecret))
+	return apiRegisterHandler(context.Background(), httptest.NewRecorder(), req)
+}
+
+func assertApiErrorCode(t *testing.T, err error, code string) {
+	t.Helper()
+	var apiErr *shared.ApiError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an ApiError with code=%s, got err=%v", code, err)
+	}
+	if apiErr.Code != code {
+		t.Fatalf("expected an ApiError with code=%s, got %#v", code, apiErr)
+	}
+}
+
+func assertNoLeakedConnections(t *testing.T, db *gorm.DB) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numConns := sqlDB.Stats().OpenConnections
+	if numConns > 1 {
+		t.Fatalf("expected DB to have not leak connections, actually have %d", numConns)
+	}
+}
+
+// flushHookWriter calls onFlush every time the response is flushed
+type flushHookWriter struct {
+	*httptest.ResponseRecorder
+	onFlush func()
+}
+
+func (w *flushHookWriter) Flush() {
+	w.ResponseRecorder.Flush()
+	w.onFlush()
+}
+
+func initTestDB(t *testing.T) {
+	db, err := OpenTestDB()
+	testutils.Check(t, err)
+	testutils.Check(t, InitDB(db))
+}
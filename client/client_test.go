@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
@@ -912,10 +911,13 @@ func manuallySubmitHistoryEntry(t *testing.T, userSecret string, entry data.Hist
 	}
 	jsonValue, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
 	testutils.Check(t, err)
-	resp, err := http.Post("http://localhost:8080/api/v1/submit", "application/json", bytes.NewBuffer(jsonValue))
+	// Authenticate as the device that is installed locally
+	config, err := hctx.GetConfig()
 	testutils.Check(t, err)
-	if resp.StatusCode != 200 {
-		t.Fatalf("failed to submit result to backend, status_code=%d", resp.StatusCode)
+	config.UserSecret = userSecret
+	_, err = lib.ApiPost(config, "/api/v1/submit?source_device_id="+config.DeviceId+"&user_id="+data.UserId(userSecret), "application/json", jsonValue)
+	if err != nil {
+		t.Fatalf("failed to submit result to backend: %v", err)
 	}
 }
 
@@ -1118,7 +1120,7 @@ func testRequestAndReceiveDbDump(t *testing.T, tester shellTester) {
 	// Confirm there are no pending dump requests
 	config := hctx.GetConf(hctx.MakeContext())
 	deviceId1 := config.DeviceId
-	resp, err := lib.ApiGet("/api/v1/get-dump-requests?user_id=" + data.UserId(secretKey) + "&device_id=" + deviceId1)
+	resp, err := lib.ApiGet(config, "/api/v1/get-dump-requests?user_id="+data.UserId(secretKey)+"&device_id="+deviceId1)
 	if err != nil {
 		t.Fatalf("failed to get pending dump requests: %v", err)
 	}
@@ -1149,7 +1151,7 @@ echo other`)
 	restoreFirstInstallation := testutils.BackupAndRestoreWithId(t, "-install1")
 
 	// Wipe the DB to simulate entries getting deleted because they've already been read and expired
-	_, err = lib.ApiGet("/api/v1/wipe-db-entries")
+	_, err = lib.ApiGet(hctx.ClientConfig{}, "/api/v1/wipe-db-entries")
 	if err != nil {
 		t.Fatalf("failed to wipe the DB: %v", err)
 	}
@@ -1158,7 +1160,7 @@ echo other`)
 	installHishtory(t, tester, secretKey)
 
 	// Confirm there is now a pending dump requests that the first device should respond to
-	resp, err = lib.ApiGet("/api/v1/get-dump-requests?user_id=" + data.UserId(secretKey) + "&device_id=" + deviceId1)
+	resp, err = lib.ApiGet(config, "/api/v1/get-dump-requests?user_id="+data.UserId(secretKey)+"&device_id="+deviceId1)
 	if err != nil {
 		t.Fatalf("failed to get pending dump requests: %v", err)
 	}
@@ -1191,7 +1193,7 @@ echo other`)
 	}
 
 	// Confirm there are no pending dump requests for the first device
-	resp, err = lib.ApiGet("/api/v1/get-dump-requests?user_id=" + data.UserId(secretKey) + "&device_id=" + deviceId1)
+	resp, err = lib.ApiGet(config, "/api/v1/get-dump-requests?user_id="+data.UserId(secretKey)+"&device_id="+deviceId1)
 	if err != nil {
 		t.Fatalf("failed to get pending dump requests: %v", err)
 	}
@@ -2705,7 +2707,7 @@ func FuzzTestMultipleUsers(f *testing.F) {
 }
 
 func assertNoLeakedConnections(t *testing.T) {
-	resp, err := lib.ApiGet("/api/v1/get-num-connections")
+	resp, err := lib.ApiGet(hctx.ClientConfig{}, "/api/v1/get-num-connections")
 	testutils.Check(t, err)
 	numConnections, err := strconv.Atoi(string(resp))
 	testutils.Check(t, err)
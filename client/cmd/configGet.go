@@ -40,6 +40,16 @@ var getFilterDuplicateCommandsCmd = &cobra.Command{
 	},
 }
 
+var getFuzzySearchCmd = &cobra.Command{
+	Use:   "fuzzy-search",
+	Short: "Whether the TUI uses fuzzy matching when searching your history",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		fmt.Println(config.FuzzySearchEnabled)
+	},
+}
+
 var getDisplayedColumnsCmd = &cobra.Command{
 	Use:   "displayed-columns",
 	Short: "The list of columns that hishtory displays",
@@ -84,6 +94,7 @@ func init() {
 	rootCmd.AddCommand(configGetCmd)
 	configGetCmd.AddCommand(getEnableControlRCmd)
 	configGetCmd.AddCommand(getFilterDuplicateCommandsCmd)
+	configGetCmd.AddCommand(getFuzzySearchCmd)
 	configGetCmd.AddCommand(getDisplayedColumnsCmd)
 	configGetCmd.AddCommand(getTimestampFormatCmd)
 	configGetCmd.AddCommand(getCustomColumnsCmd)
@@ -53,6 +53,23 @@ var setFilterDuplicateCommandsCmd = &cobra.Command{
 	},
 }
 
+var setFuzzySearchCmd = &cobra.Command{
+	Use:       "fuzzy-search",
+	Short:     "Whether the TUI uses fuzzy matching when searching your history",
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: []string{"true", "false"},
+	Run: func(cmd *cobra.Command, args []string) {
+		val := args[0]
+		if val != "true" && val != "false" {
+			log.Fatalf("Unexpected config value %s, must be one of: true, false", val)
+		}
+		ctx := hctx.MakeContext()
+		config := hctx.GetConf(ctx)
+		config.FuzzySearchEnabled = (val == "true")
+		lib.CheckFatalError(hctx.SetConfig(config))
+	},
+}
+
 var setDisplayedColumnsCmd = &cobra.Command{
 	Use:   "displayed-columns",
 	Short: "The list of columns that hishtory displays",
@@ -81,6 +98,7 @@ func init() {
 	rootCmd.AddCommand(configSetCmd)
 	configSetCmd.AddCommand(setEnableControlRCmd)
 	configSetCmd.AddCommand(setFilterDuplicateCommandsCmd)
+	configSetCmd.AddCommand(setFuzzySearchCmd)
 	configSetCmd.AddCommand(setDisplayedColumnsCmd)
 	configSetCmd.AddCommand(setTimestampFormatCmd)
 }
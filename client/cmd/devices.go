@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var forceRevoke *bool
+
+var devicesCmd = &cobra.Command{
+	Use:     "devices",
+	Short:   "List and manage the devices that your history is synced with",
+	GroupID: GROUP_ID_MANAGEMENT,
+	Run: func(cmd *cobra.Command, args []string) {
+		lib.CheckFatalError(cmd.Help())
+	},
+}
+
+var devicesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the devices that your history is synced with",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		devices, err := lib.ListDevices(ctx)
+		lib.CheckFatalError(err)
+		lib.DisplayDevices(ctx, devices)
+	},
+}
+
+var devicesRenameCmd = &cobra.Command{
+	Use:   "rename DEVICE NAME",
+	Short: "Give a device a name to make it easier to identify",
+	Long:  "Give a device a name to make it easier to identify. DEVICE can be a device ID, a unique prefix of one, or the device's current name.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		devices, err := lib.ListDevices(ctx)
+		lib.CheckFatalError(err)
+		device, err := lib.FindDevice(devices, args[0])
+		lib.CheckFatalError(err)
+		lib.CheckFatalError(lib.RenameDevice(ctx, device.DeviceId, args[1]))
+	},
+}
+
+var devicesRevokeCmd = &cobra.Command{
+	Use:   "revoke DEVICE",
+	Short: "Stop syncing your history with a device that you no longer use",
+	Long: "Stop syncing your history with a device that you no longer use. Requests from this device ID will be rejected, but the device " +
+		"still has your secret key, so it could register again as a new device. To cut off a lost or compromised device, run " +
+		"`hishtory rotate-key` instead. DEVICE can be a device ID, a unique prefix of one, or the device's name.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		devices, err := lib.ListDevices(ctx)
+		lib.CheckFatalError(err)
+		device, err := lib.FindDevice(devices, args[0])
+		lib.CheckFatalError(err)
+		if device.IsRevoked {
+			fmt.Printf("Device %s has already been revoked\n", device.DeviceId)
+			return
+		}
+		if !*forceRevoke {
+			fmt.Printf("This will permanently revoke device %s, are you sure? [y/N]", device.DeviceId)
+			reader := bufio.NewReader(os.Stdin)
+			resp, err := reader.ReadString('\n')
+			lib.CheckFatalError(err)
+			if strings.TrimSpace(resp) != "y" {
+				fmt.Printf("Aborting revoke per user response of %#v\n", strings.TrimSpace(resp))
+				return
+			}
+		}
+		lib.CheckFatalError(lib.RevokeDevice(ctx, device.DeviceId))
+		fmt.Printf("Revoked device %s\n", device.DeviceId)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(devicesCmd)
+	devicesCmd.AddCommand(devicesListCmd)
+	devicesCmd.AddCommand(devicesRenameCmd)
+	devicesCmd.AddCommand(devicesRevokeCmd)
+	forceRevoke = devicesRevokeCmd.Flags().BoolP("force", "f", false, "Revoke the device without asking for confirmation")
+}
@@ -1,28 +1,86 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
+	"github.com/ddworken/hishtory/client/data"
 	"github.com/ddworken/hishtory/client/hctx"
 	"github.com/ddworken/hishtory/client/lib"
 	"github.com/spf13/cobra"
 )
 
+var importFormat *string
+
 var importCmd = &cobra.Command{
-	Use:    "import",
+	Use:    "import [FILE]",
 	Hidden: true,
 	Short:  "Re-import history entries from your existing shell history",
-	Long:   "Note that you must pipe commands to be imported in via stdin. For example `history | hishtory import`.",
+	Long:   "Note that you must pipe commands to be imported in via stdin. For example `history | hishtory import`.\n\nTo import history entries from another hiSHtory install, export them with `hishtory export --format json` and then run `hishtory import --format json FILE` (or pipe them in via stdin).\n\nTo import history from another shell history tool, run `hishtory import --format TOOL [FILE]` where TOOL is one of: " + strings.Join(importerNames(), ", ") + ". If FILE isn't specified, the tool's default history location is used.",
+	Args:   cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := hctx.MakeContext()
-		numImported, err := lib.ImportHistory(ctx, true, true)
-		lib.CheckFatalError(err)
-		if numImported > 0 {
-			fmt.Printf("Imported %v history entries from your existing shell history\n", numImported)
+		switch *importFormat {
+		case "":
+			if len(args) > 0 {
+				lib.CheckFatalError(fmt.Errorf("importing from a file is only supported with --format json"))
+			}
+			numImported, err := lib.ImportHistory(ctx, true, true)
+			lib.CheckFatalError(err)
+			if numImported > 0 {
+				fmt.Printf("Imported %v history entries from your existing shell history\n", numImported)
+			}
+		case "json", "ndjson":
+			var in io.Reader = os.Stdin
+			if len(args) > 0 {
+				f, err := os.Open(args[0])
+				lib.CheckFatalError(err)
+				defer f.Close()
+				in = f
+			}
+			importedEntries, err := lib.ImportJsonHistory(ctx, in)
+			lib.CheckFatalError(err)
+			uploadImportedEntries(ctx, importedEntries)
+		default:
+			importer, ok := lib.GetHistoryImporter(*importFormat)
+			if !ok {
+				lib.CheckFatalError(fmt.Errorf("unknown import format %q (expected one of: json, %s)", *importFormat, strings.Join(importerNames(), ", ")))
+			}
+			path := ""
+			if len(args) > 0 {
+				path = args[0]
+			}
+			importedEntries, err := lib.ImportFromTool(ctx, importer, path)
+			lib.CheckFatalError(err)
+			uploadImportedEntries(ctx, importedEntries)
 		}
 	},
 }
 
+func uploadImportedEntries(ctx *context.Context, importedEntries []*data.HistoryEntry) {
+	err := lib.UploadImportedEntries(ctx, importedEntries)
+	if msg := lib.GetLimitErrorMessage(err); msg != "" {
+		fmt.Printf("Warning: the imported entries weren't synced to your other devices, run `hishtory reupload` to retry later: %s\n", msg)
+	} else if lib.IsOfflineError(err) {
+		fmt.Println("Warning: hishtory is offline so the imported entries weren't synced to your other devices, run `hishtory reupload` once you're back online")
+	} else {
+		lib.CheckFatalError(err)
+	}
+	fmt.Printf("Imported %v new history entries\n", len(importedEntries))
+}
+
+func importerNames() []string {
+	names := make([]string, 0)
+	for _, importer := range lib.HISTORY_IMPORTERS {
+		names = append(names, importer.Name)
+	}
+	return names
+}
+
 func init() {
 	rootCmd.AddCommand(importCmd)
+	importFormat = importCmd.Flags().String("format", "", "The format to import from, either unset to import shell history, json to import entries from `hishtory export --format json`, or the name of another shell history tool")
 }
@@ -20,10 +20,13 @@ import (
 	"github.com/ddworken/hishtory/client/lib"
 	"github.com/ddworken/hishtory/shared"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 var offlineInit *bool
 var offlineInstall *bool
+var passphraseInit *bool
+var kdfHeaderInit *string
 
 var installCmd = &cobra.Command{
 	Use:    "install",
@@ -58,8 +61,18 @@ var installCmd = &cobra.Command{
 var initCmd = &cobra.Command{
 	Use:     "init",
 	Short:   "Re-initialize hiSHtory with a specified secret key",
+	Long:    "Re-initialize hiSHtory with a specified secret key. With --passphrase, the secret key is instead derived from a passphrase that is read from the terminal.",
 	GroupID: GROUP_ID_CONFIG,
 	Args:    cobra.MaximumNArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if *passphraseInit && len(args) > 0 {
+			return fmt.Errorf("a secret key can't be specified along with --passphrase")
+		}
+		if *kdfHeaderInit != "" && !*passphraseInit {
+			return fmt.Errorf("--kdf-header can only be used along with --passphrase")
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		db, err := hctx.OpenLocalSqliteDb()
 		lib.CheckFatalError(err)
@@ -75,11 +88,20 @@ var initCmd = &cobra.Command{
 				return
 			}
 		}
-		secretKey := ""
-		if len(args) > 0 {
-			secretKey = args[0]
+		if *passphraseInit {
+			passphrase, err := readPassphrase(*kdfHeaderInit == "")
+			lib.CheckFatalError(err)
+			lib.CheckFatalError(lib.SetupWithPassphrase(passphrase, *kdfHeaderInit, *offlineInit))
+			config, err := hctx.GetConfig()
+			lib.CheckFatalError(err)
+			fmt.Printf("To set up another device with this passphrase, run `hishtory init --passphrase --kdf-header '%s'`\n", config.KdfHeader)
+		} else {
+			secretKey := ""
+			if len(args) > 0 {
+				secretKey = args[0]
+			}
+			lib.CheckFatalError(lib.Setup(secretKey, *offlineInit))
 		}
-		lib.CheckFatalError(lib.Setup(secretKey, *offlineInit))
 		if os.Getenv("HISHTORY_SKIP_INIT_IMPORT") == "" {
 			fmt.Println("Importing existing shell history...")
 			ctx := hctx.MakeContext()
@@ -92,6 +114,36 @@ var initCmd = &cobra.Command{
 	},
 }
 
+// Reads a passphrase from the terminal without echoing it, or from stdin if it isn't a terminal
+func readPassphrase(confirm bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to read passphrase: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Print("Passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %v", err)
+	}
+	if confirm {
+		fmt.Print("Confirm passphrase: ")
+		confirmation, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase: %v", err)
+		}
+		if string(confirmation) != string(passphrase) {
+			return "", fmt.Errorf("passphrases don't match")
+		}
+	}
+	return string(passphrase), nil
+}
+
 var uninstallCmd = &cobra.Command{
 	Use:   "uninstall",
 	Short: "Completely uninstall hiSHtory and remove your shell history",
@@ -115,7 +167,8 @@ var uninstallCmd = &cobra.Command{
 		}
 		reqBody, err := json.Marshal(feedback)
 		lib.CheckFatalError(err)
-		_, _ = lib.ApiPost("/api/v1/feedback", "application/json", reqBody)
+		config := hctx.GetConf(ctx)
+		_, _ = lib.ApiPost(config, "/api/v1/feedback?user_id="+data.UserId(config.UserSecret)+"&device_id="+config.DeviceId, "application/json", reqBody)
 		lib.CheckFatalError(uninstall(ctx))
 	},
 }
@@ -529,4 +582,6 @@ func init() {
 
 	offlineInit = initCmd.Flags().Bool("offline", false, "Install hiSHtory in offline mode wiht all syncing capabilities disabled")
 	offlineInstall = installCmd.Flags().Bool("offline", false, "Install hiSHtory in offline mode wiht all syncing capabilities disabled")
+	passphraseInit = initCmd.Flags().Bool("passphrase", false, "Derive the secret key from a passphrase rather than specifying it directly")
+	kdfHeaderInit = initCmd.Flags().String("kdf-header", "", "The KDF header printed when the passphrase was first used, to derive the same secret key as your other devices")
 }
@@ -3,6 +3,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/ddworken/hishtory/client/hctx"
@@ -17,7 +18,15 @@ var EXAMPLE_QUERIES string = `Example queries:
 'hishtory SUBCOMMAND curl user:david'	# Find shell commands containing 'curl' run by 'david'
 'hishtory SUBCOMMAND curl host:x1'		# Find shell commands containing 'curl' run on 'x1'
 'hishtory SUBCOMMAND exit_code:1'		# Find shell commands that exited with status code 1
+'hishtory SUBCOMMAND exit_code:!=0'		# Find shell commands that failed
+'hishtory SUBCOMMAND "runtime:>30s"'		# Find shell commands that took longer than 30 seconds to run
 'hishtory SUBCOMMAND before:2022-02-01'	# Find shell commands run before 2022-02-01
+'hishtory SUBCOMMAND after:2h'		# Find shell commands run in the last 2 hours
+'hishtory SUBCOMMAND during:2024-03'		# Find shell commands run in March 2024
+'hishtory SUBCOMMAND regex:^git\s'		# Find shell commands matching the regex '^git\s' (also supports cwd~: and host~:)
+'hishtory SUBCOMMAND kubectl OR helm'	# Find shell commands containing 'kubectl' or 'helm'
+'hishtory SUBCOMMAND (kubectl OR helm) cwd:~/infra'	# Find shell commands containing 'kubectl' or 'helm' run in '~/infra'
+'hishtory SUBCOMMAND docker sort:frequency'	# Find shell commands containing 'docker', with the most frequently run first
 `
 
 var GROUP_ID_QUERYING string = "group_id:querying"
@@ -47,34 +56,80 @@ var tqueryCmd = &cobra.Command{
 	},
 }
 
+var EXPORT_FLAGS string = `Flags:
+  --format FORMAT	The format to export in, one of: ` + strings.Join(lib.EXPORT_FORMATS, ", ") + `. Defaults to raw, which displays just the commands.
+  --null		Separate raw commands with NUL bytes rather than newlines, for use with 'xargs -0'
+
+`
+
 var exportCmd = &cobra.Command{
 	Use:                "export",
-	Short:              "Export your shell history and display just the raw commands",
+	Short:              "Export your shell history, either as the raw commands or in a structured format",
 	GroupID:            GROUP_ID_QUERYING,
-	Long:               strings.ReplaceAll(EXAMPLE_QUERIES, "SUBCOMMAND", "export"),
+	Long:               EXPORT_FLAGS + strings.ReplaceAll(EXAMPLE_QUERIES, "SUBCOMMAND", "export"),
 	DisableFlagParsing: true,
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := hctx.MakeContext()
 		lib.CheckFatalError(lib.ProcessDeletionRequests(ctx))
-		export(ctx, strings.Join(args, " "))
+		format, nullSeparated, args, err := parseExportFlags(args)
+		lib.CheckFatalError(err)
+		export(ctx, strings.Join(args, " "), format, nullSeparated)
 	},
 }
 
-func export(ctx *context.Context, query string) {
+// Extracts the flags for export from args, returning the remaining args. Cobra's flag parsing is disabled for
+// export since negated search terms (e.g. `-pipefail`) look like flags.
+func parseExportFlags(args []string) (string, bool, []string, error) {
+	format := "raw"
+	nullSeparated := false
+	remainingArgs := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--null":
+			nullSeparated = true
+		case strings.HasPrefix(args[i], "--format="):
+			format = strings.TrimPrefix(args[i], "--format=")
+		case args[i] == "--format":
+			if i+1 >= len(args) {
+				return "", false, nil, fmt.Errorf("--format requires a value (one of: %s)", strings.Join(lib.EXPORT_FORMATS, ", "))
+			}
+			format = args[i+1]
+			i++
+		default:
+			remainingArgs = append(remainingArgs, args[i])
+		}
+	}
+	for _, f := range lib.EXPORT_FORMATS {
+		if f == format {
+			return format, nullSeparated, remainingArgs, nil
+		}
+	}
+	return "", false, nil, fmt.Errorf("unknown export format %q (expected one of: %s)", format, strings.Join(lib.EXPORT_FORMATS, ", "))
+}
+
+func export(ctx *context.Context, query, format string, nullSeparated bool) {
 	db := hctx.GetDb(ctx)
 	err := lib.RetrieveAdditionalEntriesFromRemote(ctx)
 	if err != nil {
 		if lib.IsOfflineError(err) {
-			fmt.Println("Warning: hishtory is offline so this may be missing recent results from your other machines!")
+			warning := "Warning: hishtory is offline so this may be missing recent results from your other machines!"
+			if format == "raw" && !nullSeparated {
+				fmt.Println(warning)
+			} else {
+				// Don't corrupt machine-readable output
+				fmt.Fprintln(os.Stderr, warning)
+			}
 		} else {
 			lib.CheckFatalError(err)
 		}
 	}
 	data, err := lib.Search(ctx, db, query, 0)
 	lib.CheckFatalError(err)
-	for i := len(data) - 1; i >= 0; i-- {
-		fmt.Println(data[i].Command)
+	// Export in chronological order
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
 	}
+	lib.CheckFatalError(lib.ExportEntries(os.Stdout, data, format, nullSeparated))
 }
 
 func query(ctx *context.Context, query string) {
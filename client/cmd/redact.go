@@ -88,7 +88,7 @@ func deleteOnRemoteInstances(ctx *context.Context, historyEntries []*data.Histor
 	for _, entry := range historyEntries {
 		deletionRequest.Messages.Ids = append(deletionRequest.Messages.Ids, shared.MessageIdentifier{Date: entry.EndTime, DeviceId: entry.DeviceId})
 	}
-	return lib.SendDeletionRequest(deletionRequest)
+	return lib.SendDeletionRequest(ctx, deletionRequest)
 }
 
 func init() {
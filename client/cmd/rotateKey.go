@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+)
+
+var forceRotateKey *bool
+
+var rotateKeyCmd = &cobra.Command{
+	Use:     "rotate-key",
+	Short:   "Replace your secret key, e.g. because it was leaked",
+	Long:    "Replace your secret key with a new one and re-encrypt your history with it. Everything encrypted with the old key is deleted from the server, so your other devices will need to be set up again with the new key.",
+	GroupID: GROUP_ID_CONFIG,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := hctx.MakeContext()
+		if !*forceRotateKey {
+			fmt.Printf("This will replace your secret key and stop syncing with your other devices until they are set up with the new key, are you sure? [y/N]")
+			reader := bufio.NewReader(os.Stdin)
+			resp, err := reader.ReadString('\n')
+			lib.CheckFatalError(err)
+			if strings.TrimSpace(resp) != "y" {
+				fmt.Printf("Aborting key rotation per user response of %#v\n", strings.TrimSpace(resp))
+				return
+			}
+		}
+		newSecret, otherDevices, err := lib.RotateKey(ctx)
+		lib.CheckFatalError(err)
+		fmt.Println("Setting secret hishtory key to " + newSecret)
+		if len(otherDevices) > 0 {
+			fmt.Printf("To keep syncing your history, run `hishtory init %s` on your other devices:\n", newSecret)
+			for _, device := range otherDevices {
+				if device.Name != "" {
+					fmt.Printf("  %s (%s)\n", device.Name, device.DeviceId)
+				} else {
+					fmt.Printf("  %s\n", device.DeviceId)
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rotateKeyCmd)
+	forceRotateKey = rotateKeyCmd.Flags().BoolP("force", "f", false, "Rotate the key without asking for confirmation")
+}
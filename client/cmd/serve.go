@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	serverlib "github.com/ddworken/hishtory/backend/server/lib"
+	"github.com/ddworken/hishtory/client/lib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run a self-hosted sync server",
+	Long:  "Run a sync server backed by a SQLite DB, so that devices can sync their history without relying on api.hishtory.dev. Point your devices at it by setting HISHTORY_SERVER to the server's URL before running `hishtory init`.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := loadServeConfig(cmd.Flags())
+		lib.CheckFatalError(err)
+		handler, err := setUpServer(cfg)
+		lib.CheckFatalError(err)
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		backgroundJobsDone := make(chan struct{})
+		go func() {
+			serverlib.RunBackgroundJobs(ctx)
+			close(backgroundJobsDone)
+		}()
+		fmt.Printf("Listening on %s with the DB stored in %s\n", cfg.ListenAddress, cfg.Database.DSN)
+		lib.CheckFatalError(serverlib.Serve(ctx, cfg, handler))
+		<-backgroundJobsDone
+	},
+}
+
+// Builds the server config from the defaults, the config file and then the flags, in increasing order of precedence
+func loadServeConfig(flags *pflag.FlagSet) (serverlib.Config, error) {
+	configPath, err := flags.GetString("config")
+	if err != nil {
+		return serverlib.Config{}, err
+	}
+	dbPath, err := flags.GetString("db")
+	if err != nil {
+		return serverlib.Config{}, err
+	}
+	listen, err := flags.GetString("listen")
+	if err != nil {
+		return serverlib.Config{}, err
+	}
+	metrics, err := flags.GetBool("metrics")
+	if err != nil {
+		return serverlib.Config{}, err
+	}
+
+	cfg := serverlib.DefaultConfig()
+	cfg.Database = serverlib.DatabaseConfig{Driver: "sqlite", DSN: dbPath}
+	cfg.ListenAddress = listen
+	if configPath != "" {
+		err = serverlib.LoadConfigFile(configPath, &cfg)
+		if err != nil {
+			return serverlib.Config{}, err
+		}
+	}
+	if flags.Changed("db") {
+		cfg.Database = serverlib.DatabaseConfig{Driver: "sqlite", DSN: dbPath}
+	}
+	if flags.Changed("listen") {
+		cfg.ListenAddress = listen
+	}
+	if metrics {
+		cfg.Observability.Metrics = "prometheus"
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return serverlib.Config{}, err
+	}
+	if cfg.Database.Driver != "sqlite" {
+		return serverlib.Config{}, fmt.Errorf("hishtory serve only supports sqlite DBs, use the standalone server for %s", cfg.Database.Driver)
+	}
+	if cfg.Observability.Metrics == "datadog" || cfg.Observability.Tracing {
+		return serverlib.Config{}, fmt.Errorf("hishtory serve doesn't support reporting to Datadog, use the standalone server instead")
+	}
+	return cfg, nil
+}
+
+// Opens the DB and returns the handler for the server. Background jobs aren't started, so that is left to the caller.
+func setUpServer(cfg serverlib.Config) (http.Handler, error) {
+	serverlib.GLOBAL_CONFIG = cfg
+	db, err := serverlib.OpenSqliteDB(cfg.Database.DSN)
+	if err != nil {
+		return nil, err
+	}
+	err = serverlib.InitDB(db)
+	if err != nil {
+		return nil, err
+	}
+	// Devices that sync with this server are updated to the version that it is running
+	serverlib.ReleaseVersion = "v0." + lib.Version
+	serverlib.TrackLatestRelease = false
+
+	mux := http.NewServeMux()
+	serverlib.RegisterHandlers(mux)
+	if cfg.Observability.Metrics == "prometheus" {
+		stats := serverlib.NewPrometheusStats()
+		serverlib.GLOBAL_STATSD = stats
+		mux.Handle("/metrics", stats.Handler())
+	}
+	return mux, nil
+}
+
+func registerServeFlags(flags *pflag.FlagSet) {
+	flags.String("config", "", "Path to a YAML or TOML server config file, see the README for the available options")
+	flags.String("db", "./server.sqlite", "The path to the SQLite DB that history entries are stored in")
+	flags.String("listen", ":8080", "The address to listen on")
+	flags.Bool("metrics", false, "Expose Prometheus metrics at /metrics")
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	registerServeFlags(serveCmd.Flags())
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	serverlib "github.com/ddworken/hishtory/backend/server/lib"
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/shared"
+	"github.com/ddworken/hishtory/shared/testutils"
+	"github.com/google/uuid"
+	"github.com/spf13/pflag"
+)
+
+func parseServeFlags(t *testing.T, args ...string) *pflag.FlagSet {
+	flags := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	registerServeFlags(flags)
+	testutils.Check(t, flags.Parse(args))
+	return flags
+}
+
+func writeServeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	testutils.Check(t, os.WriteFile(path, []byte(contents), 0o644))
+	return path
+}
+
+func TestServeConfig(t *testing.T) {
+	// The defaults are a SQLite DB in the current directory
+	cfg, err := loadServeConfig(parseServeFlags(t))
+	testutils.Check(t, err)
+	if cfg.Database.Driver != "sqlite" || cfg.Database.DSN != "./server.sqlite" || cfg.ListenAddress != ":8080" || cfg.Observability.Metrics != "none" {
+		t.Fatalf("unexpected default config: %#v", cfg)
+	}
+
+	// The config file takes precedence over the defaults of --db and --listen
+	configPath := writeServeConfig(t, "listen_address: 127.0.0.1:9000\ndatabase:\n  driver: sqlite\n  dsn: /tmp/from-config.sqlite\nlimits:\n  max_num_users: 5\n")
+	cfg, err = loadServeConfig(parseServeFlags(t, "--config", configPath))
+	testutils.Check(t, err)
+	if cfg.Database.DSN != "/tmp/from-config.sqlite" || cfg.ListenAddress != "127.0.0.1:9000" || cfg.Limits.MaxNumUsers != 5 {
+		t.Fatalf("expected the config file to be used: %#v", cfg)
+	}
+
+	// But --db and --listen take precedence over the config file when they're passed
+	cfg, err = loadServeConfig(parseServeFlags(t, "--config", configPath, "--db", "/tmp/from-flag.sqlite", "--listen", ":9001", "--metrics"))
+	testutils.Check(t, err)
+	if cfg.Database.DSN != "/tmp/from-flag.sqlite" || cfg.ListenAddress != ":9001" || cfg.Limits.MaxNumUsers != 5 || cfg.Observability.Metrics != "prometheus" {
+		t.Fatalf("expected the flags to override the config file: %#v", cfg)
+	}
+
+	// Only SQLite is supported, and Datadog isn't
+	for _, tc := range []struct {
+		config      string
+		expectedErr string
+	}{
+		{"database:\n  driver: postgres\n  dsn: postgresql://localhost/hishtory\n", "only supports sqlite DBs"},
+		{"observability:\n  metrics: datadog\n", "doesn't support reporting to Datadog"},
+		{"observability:\n  tracing: true\n", "doesn't support reporting to Datadog"},
+		{"retention:\n  max_entry_read_count: 0\n", "retention.max_entry_read_count must be positive"},
+	} {
+		_, err = loadServeConfig(parseServeFlags(t, "--config", writeServeConfig(t, tc.config)))
+		if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+			t.Fatalf("expected an error containing %#v for config %#v, got %v", tc.expectedErr, tc.config, err)
+		}
+	}
+}
+
+func TestServeRoundTrip(t *testing.T) {
+	defer func(cfg serverlib.Config) { serverlib.GLOBAL_CONFIG = cfg }(serverlib.GLOBAL_CONFIG)
+	dbPath := filepath.Join(t.TempDir(), "server.sqlite")
+	cfg, err := loadServeConfig(parseServeFlags(t, "--db", dbPath))
+	testutils.Check(t, err)
+	handler, err := setUpServer(cfg)
+	testutils.Check(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	userSecret := "servekey"
+	userId := data.UserId(userSecret)
+	devId1 := uuid.Must(uuid.NewRandom()).String()
+	devId2 := uuid.Must(uuid.NewRandom()).String()
+	request := func(method, path, deviceId string, body []byte) []byte {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		testutils.Check(t, err)
+		req.Header.Set("Authorization", "Bearer "+data.DeviceToken(userSecret, deviceId))
+		req.Header.Set(serverlib.UserTokenHeader, data.UserToken(userSecret))
+		resp, err := http.DefaultClient.Do(req)
+		testutils.Check(t, err)
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		testutils.Check(t, err)
+		if resp.StatusCode != 200 {
+			t.Fatalf("%s %s failed with status_code=%d: %s", method, path, resp.StatusCode, respBody)
+		}
+		return respBody
+	}
+
+	// Register two devices, submit an entry from one of them, and then bootstrap
+	request(http.MethodGet, "/api/v1/register?user_id="+userId+"&device_id="+devId1, devId1, nil)
+	request(http.MethodGet, "/api/v1/register?user_id="+userId+"&device_id="+devId2, devId2, nil)
+	encEntry, err := data.EncryptHistoryEntry(userSecret, testutils.MakeFakeHistoryEntry("echo self-hosted"))
+	testutils.Check(t, err)
+	reqBody, err := json.Marshal([]shared.EncHistoryEntry{encEntry})
+	testutils.Check(t, err)
+	request(http.MethodPost, "/api/v1/submit?user_id="+userId+"&source_device_id="+devId1, devId1, reqBody)
+	var entries []*shared.EncHistoryEntry
+	testutils.Check(t, json.Unmarshal(request(http.MethodGet, "/api/v1/bootstrap?user_id="+userId+"&device_id="+devId2, devId2, nil), &entries))
+	if len(entries) != 2 {
+		t.Fatalf("expected the entry to be stored for both devices, got %d entries", len(entries))
+	}
+	for _, entry := range entries {
+		decEntry, err := data.DecryptHistoryEntry(userSecret, *entry)
+		testutils.Check(t, err)
+		if decEntry.Command != "echo self-hosted" {
+			t.Fatalf("unexpected entry: %#v", decEntry)
+		}
+	}
+
+	// The entries are persisted in the SQLite DB
+	if info, err := os.Stat(dbPath); err != nil || info.Size() == 0 {
+		t.Fatalf("expected the DB to be written to %s: %v", dbPath, err)
+	}
+}
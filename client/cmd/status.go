@@ -19,10 +19,16 @@ var statusCmd = &cobra.Command{
 		config := hctx.GetConf(ctx)
 		fmt.Printf("hiSHtory: v0.%s\nEnabled: %v\n", lib.Version, config.IsEnabled)
 		fmt.Printf("Secret Key: %s\n", config.UserSecret)
+		if config.KdfHeader != "" {
+			fmt.Printf("Passphrase KDF Header: %s\n", config.KdfHeader)
+		}
 		if *verbose {
 			fmt.Printf("User ID: %s\n", data.UserId(config.UserSecret))
 			fmt.Printf("Device ID: %s\n", config.DeviceId)
 			printDumpStatus(config)
+			numPendingUploads, err := lib.CountPendingUploads(hctx.GetDb(ctx))
+			lib.CheckFatalError(err)
+			fmt.Printf("Pending Uploads: %d\n", numPendingUploads)
 		}
 		fmt.Printf("Commit Hash: %s\n", lib.GitCommit)
 	},
@@ -12,15 +12,19 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/ddworken/hishtory/shared"
 	"github.com/google/uuid"
+	"golang.org/x/crypto/argon2"
 )
 
 const (
 	KdfUserID        = "user_id"
 	KdfEncryptionKey = "encryption_key"
+	KdfUserToken     = "user_token"
+	KdfDeviceToken   = "device_token"
 	CONFIG_PATH      = ".hishtory.config"
 	DB_PATH          = ".hishtory.db"
 )
@@ -42,6 +46,18 @@ type HistoryEntry struct {
 	CustomColumns           CustomColumns `json:"custom_columns"`
 }
 
+// PendingUpload is a row in the outbox of history entries that have been saved locally but not yet acknowledged by
+// the backend. It identifies the entry the same way that deletion requests do, so entries that are redacted before
+// they're uploaded are never uploaded.
+type PendingUpload struct {
+	DeviceId string    `gorm:"uniqueIndex:pendinguploadindex"`
+	EndTime  time.Time `gorm:"uniqueIndex:pendinguploadindex"`
+	// The number of failed attempts to upload the entry
+	NumFailures int
+	// The entry isn't retried until this time, so that we back off while offline
+	NextAttempt time.Time `gorm:"index"`
+}
+
 type CustomColumns []CustomColumn
 
 type CustomColumn struct {
@@ -76,6 +92,84 @@ func UserId(key string) string {
 	return base64.URLEncoding.EncodeToString(sha256hmac(key, KdfUserID))
 }
 
+// UserToken proves to the backend that a device knows the user secret when registering it
+func UserToken(userSecret string) string {
+	return base64.URLEncoding.EncodeToString(sha256hmac(userSecret, KdfUserToken))
+}
+
+// DeviceToken authenticates requests from the given device to the backend. It is derived from the user secret so
+// that it never needs to be stored.
+func DeviceToken(userSecret, deviceId string) string {
+	return base64.URLEncoding.EncodeToString(sha256hmac(userSecret, KdfDeviceToken+":"+deviceId))
+}
+
+// KdfParams are the Argon2id parameters used to derive a user secret from a passphrase. They're stored alongside the
+// derived secret as a header in the PHC string format (e.g. `$argon2id$v=19$m=65536,t=3,p=4$<salt>`) so that the
+// same secret can be derived again on another device.
+type KdfParams struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	Salt    []byte
+}
+
+const (
+	defaultKdfMemory  = 64 * 1024
+	defaultKdfTime    = 3
+	defaultKdfThreads = 4
+	kdfSaltLength     = 16
+	kdfKeyLength      = 32
+	// Bounds on the parameters accepted from a header, so that a typo can't make derivation take forever
+	maxKdfMemory         = 4 * 1024 * 1024
+	maxKdfTime           = 100
+	MinPassphraseLength  = 12
+	passphraseHeaderType = "argon2id"
+)
+
+// NewKdfParams returns the default Argon2id parameters with a freshly generated salt
+func NewKdfParams() (KdfParams, error) {
+	salt := make([]byte, kdfSaltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return KdfParams{}, fmt.Errorf("failed to generate a salt: %v", err)
+	}
+	return KdfParams{Memory: defaultKdfMemory, Time: defaultKdfTime, Threads: defaultKdfThreads, Salt: salt}, nil
+}
+
+func (p KdfParams) Header() string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s", passphraseHeaderType, argon2.Version, p.Memory, p.Time, p.Threads, base64.RawStdEncoding.EncodeToString(p.Salt))
+}
+
+func ParseKdfHeader(header string) (KdfParams, error) {
+	parts := strings.Split(header, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != passphraseHeaderType {
+		return KdfParams{}, fmt.Errorf("invalid KDF header %#v, expected a header of the form $argon2id$v=19$m=65536,t=3,p=4$<salt>", header)
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return KdfParams{}, fmt.Errorf("invalid KDF header %#v, unsupported argon2 version %#v", header, parts[2])
+	}
+	var p KdfParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return KdfParams{}, fmt.Errorf("invalid KDF header %#v, failed to parse parameters: %v", header, err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return KdfParams{}, fmt.Errorf("invalid KDF header %#v, failed to decode salt: %v", header, err)
+	}
+	p.Salt = salt
+	if p.Threads == 0 || p.Time == 0 || p.Time > maxKdfTime || p.Memory < 8*uint32(p.Threads) || p.Memory > maxKdfMemory || len(p.Salt) < 8 {
+		return KdfParams{}, fmt.Errorf("invalid KDF header %#v, parameters are out of range", header)
+	}
+	return p, nil
+}
+
+// DeriveUserSecret derives a user secret from a passphrase. The result is used in place of a randomly generated
+// secret, so all the other keys are derived from it exactly as they are for random secrets.
+func DeriveUserSecret(passphrase string, params KdfParams) string {
+	key := argon2.IDKey([]byte(passphrase), params.Salt, params.Time, params.Memory, params.Threads, kdfKeyLength)
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
 func EncryptionKey(userSecret string) []byte {
 	return sha256hmac(userSecret, KdfEncryptionKey)
 }
@@ -93,11 +187,20 @@ func makeAead(userSecret string) (cipher.AEAD, error) {
 	return aead, nil
 }
 
-func Encrypt(userSecret string, data, additionalData []byte) ([]byte, []byte, error) {
+// Encrypt encrypts data with a key derived from the user secret. If compress is set, the data is compressed with zstd
+// before it is encrypted. Decrypt detects this from the zstd magic number, so it is only safe to compress data that
+// will be decrypted by versions that support it and that can't otherwise start with the magic number.
+func Encrypt(userSecret string, data, additionalData []byte, compress bool) ([]byte, []byte, error) {
 	aead, err := makeAead(userSecret)
 	if err != nil {
 		return []byte{}, []byte{}, fmt.Errorf("failed to make AEAD: %v", err)
 	}
+	if compress {
+		data, err = shared.Compress(data, shared.EncodingZstd)
+		if err != nil {
+			return []byte{}, []byte{}, err
+		}
+	}
 	nonce := make([]byte, 12)
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return []byte{}, []byte{}, fmt.Errorf("failed to read a nonce: %v", err)
@@ -119,15 +222,29 @@ func Decrypt(userSecret string, data, additionalData, nonce []byte) ([]byte, err
 	if err != nil {
 		return []byte{}, fmt.Errorf("failed to decrypt: %v", err)
 	}
+	if shared.IsZstdCompressed(plaintext) {
+		return shared.Decompress(plaintext, shared.EncodingZstd)
+	}
 	return plaintext, nil
 }
 
 func EncryptHistoryEntry(userSecret string, entry HistoryEntry) (shared.EncHistoryEntry, error) {
+	return encryptHistoryEntry(userSecret, entry, false)
+}
+
+// EncryptCompressedHistoryEntry is the same as EncryptHistoryEntry, except that the entry is compressed before it is
+// encrypted. Older versions can't decrypt compressed entries, so this should only be used once all of the user's
+// devices support them.
+func EncryptCompressedHistoryEntry(userSecret string, entry HistoryEntry) (shared.EncHistoryEntry, error) {
+	return encryptHistoryEntry(userSecret, entry, true)
+}
+
+func encryptHistoryEntry(userSecret string, entry HistoryEntry, compress bool) (shared.EncHistoryEntry, error) {
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return shared.EncHistoryEntry{}, err
 	}
-	ciphertext, nonce, err := Encrypt(userSecret, data, []byte(UserId(userSecret)))
+	ciphertext, nonce, err := Encrypt(userSecret, data, []byte(UserId(userSecret)), compress)
 	if err != nil {
 		return shared.EncHistoryEntry{}, err
 	}
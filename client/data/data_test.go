@@ -1,7 +1,11 @@
 package data
 
 import (
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ddworken/hishtory/shared"
 )
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -11,12 +15,41 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Fatalf("Expected EncryptionKey to be deterministic!")
 	}
 
-	ciphertext, nonce, err := Encrypt("key", []byte("hello world!"), []byte("extra"))
+	for _, compress := range []bool{false, true} {
+		ciphertext, nonce, err := Encrypt("key", []byte("hello world!"), []byte("extra"), compress)
+		checkError(t, err)
+		plaintext, err := Decrypt("key", ciphertext, []byte("extra"), nonce)
+		checkError(t, err)
+		if string(plaintext) != "hello world!" {
+			t.Fatalf("Expected decrypt(encrypt(x)) to work with compress=%v, but it didn't!", compress)
+		}
+	}
+}
+
+func TestEncryptCompressedHistoryEntry(t *testing.T) {
+	entry := HistoryEntry{
+		LocalUsername:           "david",
+		Hostname:                "localhost",
+		Command:                 strings.Repeat("echo hello world && ", 50),
+		CurrentWorkingDirectory: "/tmp/",
+		HomeDirectory:           "/home/david/",
+		StartTime:               time.Unix(1650000000, 0),
+		EndTime:                 time.Unix(1650000005, 0),
+		DeviceId:                "device",
+	}
+	uncompressed, err := EncryptHistoryEntry("key", entry)
 	checkError(t, err)
-	plaintext, err := Decrypt("key", ciphertext, []byte("extra"), nonce)
+	compressed, err := EncryptCompressedHistoryEntry("key", entry)
 	checkError(t, err)
-	if string(plaintext) != "hello world!" {
-		t.Fatalf("Expected decrypt(encrypt(x)) to work, but it didn't!")
+	if len(compressed.EncryptedData) >= len(uncompressed.EncryptedData) {
+		t.Fatalf("expected the compressed entry to be smaller, got %d bytes compared to %d bytes", len(compressed.EncryptedData), len(uncompressed.EncryptedData))
+	}
+	for _, encEntry := range []shared.EncHistoryEntry{uncompressed, compressed} {
+		decEntry, err := DecryptHistoryEntry("key", encEntry)
+		checkError(t, err)
+		if !EntryEquals(entry, decEntry) {
+			t.Fatalf("expected the decrypted entry to match, got %#v", decEntry)
+		}
 	}
 }
 
@@ -59,3 +92,56 @@ func TestCustomColumnSerialization(t *testing.T) {
 	}
 
 }
+
+func TestDeriveUserSecret(t *testing.T) {
+	params, err := NewKdfParams()
+	checkError(t, err)
+	// Use cheap parameters to keep the test fast
+	params.Memory = 1024
+	params.Time = 1
+
+	// The header round trips
+	parsed, err := ParseKdfHeader(params.Header())
+	checkError(t, err)
+	if parsed.Header() != params.Header() {
+		t.Fatalf("expected the header to round trip, got %#v, expected %#v", parsed.Header(), params.Header())
+	}
+
+	// Derivation is deterministic given the header, and depends on the passphrase and salt
+	s1 := DeriveUserSecret("correct horse battery staple", params)
+	s2 := DeriveUserSecret("correct horse battery staple", parsed)
+	if s1 != s2 {
+		t.Fatalf("expected DeriveUserSecret to be deterministic, got %#v and %#v", s1, s2)
+	}
+	if s1 == DeriveUserSecret("correct horse battery stapler", params) {
+		t.Fatalf("expected different passphrases to derive different secrets")
+	}
+	otherParams, err := NewKdfParams()
+	checkError(t, err)
+	otherParams.Memory = 1024
+	otherParams.Time = 1
+	if s1 == DeriveUserSecret("correct horse battery staple", otherParams) {
+		t.Fatalf("expected different salts to derive different secrets")
+	}
+	if UserId(s1) == UserId("correct horse battery staple") {
+		t.Fatalf("expected the derived secret to not be the passphrase")
+	}
+
+	// Invalid headers are rejected
+	for _, header := range []string{
+		"",
+		"correct horse battery staple",
+		"$argon2i$v=19$m=1024,t=1,p=4$c2FsdHNhbHRzYWx0",
+		"$argon2id$v=16$m=1024,t=1,p=4$c2FsdHNhbHRzYWx0",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHRzYWx0",
+		"$argon2id$v=19$m=1024,t=0,p=4$c2FsdHNhbHRzYWx0",
+		"$argon2id$v=19$m=999999999,t=1,p=4$c2FsdHNhbHRzYWx0",
+		"$argon2id$v=19$m=1024,t=1,p=4$c2FsdA",
+		"$argon2id$v=19$m=1024,t=1,p=4$!!!",
+	} {
+		_, err := ParseKdfHeader(header)
+		if err == nil {
+			t.Fatalf("expected header %#v to be rejected", header)
+		}
+	}
+}
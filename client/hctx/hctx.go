@@ -2,15 +2,19 @@ package hctx
 
 import (
 	"context"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ddworken/hishtory/client/data"
+	sqlitedriver "github.com/glebarez/go-sqlite"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -24,8 +28,19 @@ import (
 var (
 	hishtoryLogger *logrus.Logger
 	getLoggerOnce  sync.Once
+
+	registerRegexpOnce sync.Once
+	registerRegexpErr  error
+
+	// The most recently used patterns come first
+	regexpCache     []*regexp.Regexp
+	regexpCacheLock sync.Mutex
 )
 
+// The TUI re-runs the query on every keystroke, so only a handful of patterns are cached rather than every
+// intermediate one that was typed
+const regexpCacheSize = 8
+
 func GetLogger() *logrus.Logger {
 	getLoggerOnce.Do(func() {
 		homedir, err := os.UserHomeDir()
@@ -68,6 +83,65 @@ func MakeHishtoryDir() error {
 	return nil
 }
 
+// Implements the SQLite REGEXP function so that `X REGEXP Y` can be used in queries. SQLite
+// calls this as regexp(Y, X), so the first argument is the pattern.
+func sqliteRegexp(ctx *sqlitedriver.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("regexp() expects 2 arguments, got %d", len(args))
+	}
+	pattern, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("regexp() expects a string pattern, got %#v", args[0])
+	}
+	var value string
+	switch v := args[1].(type) {
+	case nil:
+		return false, nil
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		value = fmt.Sprintf("%v", v)
+	}
+	re, err := compileCachedRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(value), nil
+}
+
+// The REGEXP function is called once per row, so compiled patterns are cached rather than recompiling each time
+func compileCachedRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCacheLock.Lock()
+	defer regexpCacheLock.Unlock()
+	for i, re := range regexpCache {
+		if re.String() == pattern {
+			copy(regexpCache[1:i+1], regexpCache[:i])
+			regexpCache[0] = re
+			return re, nil
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regex %#v: %v", pattern, err)
+	}
+	if len(regexpCache) < regexpCacheSize {
+		regexpCache = append(regexpCache, nil)
+	}
+	copy(regexpCache[1:], regexpCache)
+	regexpCache[0] = re
+	return re, nil
+}
+
+func registerSqliteFunctions() error {
+	// Functions are registered globally on the driver, so this can only be done once per process
+	registerRegexpOnce.Do(func() {
+		registerRegexpErr = sqlitedriver.RegisterDeterministicScalarFunction("regexp", 2, sqliteRegexp)
+	})
+	return registerRegexpErr
+}
+
 func OpenLocalSqliteDb() (*gorm.DB, error) {
 	homedir, err := os.UserHomeDir()
 	if err != nil {
@@ -77,6 +151,10 @@ func OpenLocalSqliteDb() (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = registerSqliteFunctions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to register sqlite functions: %v", err)
+	}
 	newLogger := logger.New(
 		GetLogger().WithField("fromSQL", true),
 		logger.Config{
@@ -101,11 +179,143 @@ func OpenLocalSqliteDb() (*gorm.DB, error) {
 		return nil, err
 	}
 	db.AutoMigrate(&data.HistoryEntry{})
+	db.AutoMigrate(&data.PendingUpload{})
 	db.Exec("PRAGMA journal_mode = WAL")
 	db.Exec("CREATE INDEX IF NOT EXISTS end_time_index ON history_entries(end_time)")
+	err = createFullTextSearchIndex(db)
+	if err != nil {
+		// Not fatal since searches fall back to LIKE queries when the index doesn't exist. We'll retry the next time the DB is opened.
+		GetLogger().Warnf("failed to set up the full-text search index: %v", err)
+	}
 	return db, nil
 }
 
+// The FTS5 table that shadows history_entries so that free text searches don't require a full table scan
+const FtsTableName = "history_entries_fts"
+
+func HasFullTextSearchIndex(db *gorm.DB) (bool, error) {
+	var count int64
+	err := db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", FtsTableName).Scan(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Creates the full-text search index for history_entries along with the triggers that keep it in sync. For
+// existing DBs, this also backfills the index. This is all done in one transaction so that a failure part
+// way through leaves the DB without an index (which is then retried) rather than with a partial index.
+func createFullTextSearchIndex(db *gorm.DB) error {
+	hasIndex, err := HasFullTextSearchIndex(db)
+	if err != nil {
+		return err
+	}
+	stableRowids, err := hasStableRowids(db)
+	if err != nil {
+		return err
+	}
+	if hasIndex && stableRowids {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		hasIndex, err := HasFullTextSearchIndex(tx)
+		if err != nil {
+			return err
+		}
+		stableRowids, err := hasStableRowids(tx)
+		if err != nil {
+			return err
+		}
+		if hasIndex && stableRowids {
+			// Another hishtory process created it concurrently
+			return nil
+		}
+		if !stableRowids {
+			// Any existing index is keyed on rowids that may have been renumbered, so it is rebuilt from scratch
+			err = tx.Exec("DROP TABLE IF EXISTS " + FtsTableName).Error
+			if err != nil {
+				return err
+			}
+			err = addStableRowids(tx)
+			if err != nil {
+				return err
+			}
+		}
+		// The trigram tokenizer supports substring matches, which is what free text search tokens need
+		statements := []string{
+			"CREATE VIRTUAL TABLE " + FtsTableName + " USING fts5(command, hostname, current_working_directory, tokenize = 'trigram')",
+			`CREATE TRIGGER IF NOT EXISTS history_entries_fts_insert AFTER INSERT ON history_entries BEGIN
+				INSERT INTO ` + FtsTableName + `(rowid, command, hostname, current_working_directory) VALUES (new.rowid, new.command, new.hostname, new.current_working_directory);
+			END`,
+			`CREATE TRIGGER IF NOT EXISTS history_entries_fts_delete AFTER DELETE ON history_entries BEGIN
+				DELETE FROM ` + FtsTableName + ` WHERE rowid = old.rowid;
+			END`,
+			`CREATE TRIGGER IF NOT EXISTS history_entries_fts_update AFTER UPDATE ON history_entries BEGIN
+				DELETE FROM ` + FtsTableName + ` WHERE rowid = old.rowid;
+				INSERT INTO ` + FtsTableName + `(rowid, command, hostname, current_working_directory) VALUES (new.rowid, new.command, new.hostname, new.current_working_directory);
+			END`,
+			"INSERT INTO " + FtsTableName + "(rowid, command, hostname, current_working_directory) SELECT rowid, command, hostname, current_working_directory FROM history_entries",
+		}
+		for _, statement := range statements {
+			err := tx.Exec(statement).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The index is keyed on the rowids of history_entries. These are only stable if history_entries has an INTEGER PRIMARY
+// KEY, since otherwise a VACUUM is allowed to renumber them and the index would point at the wrong entries.
+func hasStableRowids(db *gorm.DB) (bool, error) {
+	var count int64
+	err := db.Raw("SELECT COUNT(*) FROM pragma_table_info('history_entries') WHERE pk > 0 AND type = 'INTEGER'").Scan(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Rebuilds history_entries with an INTEGER PRIMARY KEY that aliases the rowid. The table is created by AutoMigrate, so
+// SQLite can't add a primary key to it in place and instead it is copied into a new table with the same columns and indexes.
+func addStableRowids(tx *gorm.DB) error {
+	var createTable string
+	err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'history_entries'").Scan(&createTable).Error
+	if err != nil {
+		return err
+	}
+	columnsStart := strings.Index(createTable, "(")
+	if columnsStart == -1 {
+		return fmt.Errorf("failed to parse the schema of history_entries: %#v", createTable)
+	}
+	var createIndexes []string
+	err = tx.Raw("SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = 'history_entries' AND sql IS NOT NULL").Scan(&createIndexes).Error
+	if err != nil {
+		return err
+	}
+	var columns []string
+	err = tx.Raw("SELECT name FROM pragma_table_info('history_entries')").Scan(&columns).Error
+	if err != nil {
+		return err
+	}
+	columnList := "`" + strings.Join(columns, "`, `") + "`"
+	statements := []string{
+		"CREATE TABLE history_entries_migration (id INTEGER PRIMARY KEY, " + createTable[columnsStart+1:],
+		"INSERT INTO history_entries_migration(id, " + columnList + ") SELECT rowid, " + columnList + " FROM history_entries",
+		"DROP TABLE history_entries",
+		"ALTER TABLE history_entries_migration RENAME TO history_entries",
+	}
+	statements = append(statements, createIndexes...)
+	for _, statement := range statements {
+		err := tx.Exec(statement).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type hishtoryContextKey string
 
 func MakeContext() *context.Context {
@@ -155,15 +365,32 @@ func GetHome(ctx *context.Context) string {
 type ClientConfig struct {
 	// The user secret that is used to derive encryption keys for syncing history entries
 	UserSecret string `json:"user_secret"`
+	// Set if the user secret was derived from a passphrase, in which case this contains the KDF salt and parameters
+	// needed to derive it again on another device
+	KdfHeader string `json:"kdf_header"`
 	// Whether hishtory recording is enabled
 	IsEnabled bool `json:"is_enabled"`
 	// A device ID used to track which history entry came from which device for remote syncing
 	DeviceId string `json:"device_id"`
 	// Used for skipping history entries prefixed with a space in bash
 	LastSavedHistoryLine string `json:"last_saved_history_line"`
-	// Used for uploading history entries that we failed to upload due to a missing network connection
+	// Deprecated: Entries that haven't been uploaded are now tracked in the outbox table. These are only read
+	// to move entries that older versions failed to upload into the outbox.
 	HaveMissedUploads     bool  `json:"have_missed_uploads"`
 	MissedUploadTimestamp int64 `json:"missed_upload_timestamp"`
+	// When the user was last warned that entries couldn't be uploaded because of a rate limit or quota on the backend
+	LimitWarningTimestamp int64 `json:"limit_warning_timestamp"`
+	// The sequence number of the last history entry retrieved from the backend, used to only request newer entries
+	SyncCursor int64 `json:"sync_cursor"`
+	// Whether new history entries are compressed before they're encrypted, which the backend enables once all of
+	// the user's devices support it
+	CompressEntries bool `json:"compress_entries"`
+	// The encoding that the backend last said it accepts for request bodies, so that requests can be compressed
+	// before the backend has responded to this process
+	RequestEncoding string `json:"request_encoding"`
+	// The user secret that was replaced by `hishtory rotate-key`. It is kept until the history stored under it has
+	// been purged from the backend.
+	RotatedUserSecret string `json:"rotated_user_secret"`
 	// Used for avoiding double imports of .bash_history
 	HaveCompletedInitialImport bool `json:"have_completed_initial_import"`
 	// Whether control-r bindings are enabled
@@ -178,6 +405,8 @@ type ClientConfig struct {
 	FilterDuplicateCommands bool `json:"filter_duplicate_commands"`
 	// A format string for the timestamp
 	TimestampFormat string `json:"timestamp_format"`
+	// Whether the TUI uses fuzzy matching rather than substring matching for commands
+	FuzzySearchEnabled bool `json:"enable_fuzzy_search"`
 }
 
 type CustomColumnDefinition struct {
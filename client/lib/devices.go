@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// ListDevices returns all the devices that are linked to the current user, including ones that have been revoked
+func ListDevices(ctx *context.Context) ([]shared.DeviceInfo, error) {
+	config := hctx.GetConf(ctx)
+	if config.IsOffline {
+		return nil, fmt.Errorf("devices can't be managed while hishtory is in offline mode")
+	}
+	respBody, err := ApiGet(config, "/api/v1/devices?user_id="+data.UserId(config.UserSecret)+"&device_id="+config.DeviceId)
+	if err != nil {
+		return nil, err
+	}
+	var devices []shared.DeviceInfo
+	err = json.Unmarshal(respBody, &devices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the list of devices: %v", err)
+	}
+	return devices, nil
+}
+
+// RenameDevice sets the name that is displayed for the given device. An empty name clears it.
+func RenameDevice(ctx *context.Context, deviceId, name string) error {
+	if len(name) > shared.MaxDeviceNameLength {
+		return fmt.Errorf("device names can be at most %d characters long", shared.MaxDeviceNameLength)
+	}
+	config := hctx.GetConf(ctx)
+	_, err := ApiPost(config, "/api/v1/rename-device?user_id="+data.UserId(config.UserSecret)+"&device_id="+config.DeviceId+"&target_device_id="+url.QueryEscape(deviceId)+"&name="+url.QueryEscape(name), "", nil)
+	if err != nil {
+		return fmt.Errorf("failed to rename device: %v", err)
+	}
+	return nil
+}
+
+// RevokeDevice unlinks the given device so that it can no longer read or upload history entries. This doesn't stop
+// someone with the device's copy of the secret key from registering it again as a new device.
+func RevokeDevice(ctx *context.Context, deviceId string) error {
+	config := hctx.GetConf(ctx)
+	if deviceId == config.DeviceId {
+		return fmt.Errorf("refusing to revoke the current device, run `hishtory uninstall` instead")
+	}
+	_, err := ApiPost(config, "/api/v1/revoke-device?user_id="+data.UserId(config.UserSecret)+"&device_id="+config.DeviceId+"&target_device_id="+url.QueryEscape(deviceId), "", nil)
+	if err != nil {
+		return fmt.Errorf("failed to revoke device: %v", err)
+	}
+	return nil
+}
+
+// FindDevice returns the device whose ID, ID prefix or name matches the given identifier, so that users don't need
+// to type out full device IDs
+func FindDevice(devices []shared.DeviceInfo, identifier string) (shared.DeviceInfo, error) {
+	var matches []shared.DeviceInfo
+	for _, device := range devices {
+		if device.DeviceId == identifier {
+			return device, nil
+		}
+		if strings.HasPrefix(device.DeviceId, identifier) || (device.Name != "" && device.Name == identifier) {
+			matches = append(matches, device)
+		}
+	}
+	if len(matches) == 0 {
+		return shared.DeviceInfo{}, fmt.Errorf("no device matches %#v", identifier)
+	}
+	if len(matches) > 1 {
+		return shared.DeviceInfo{}, fmt.Errorf("%#v matches %d devices, please specify the full device ID", identifier, len(matches))
+	}
+	return matches[0], nil
+}
+
+func DisplayDevices(ctx *context.Context, devices []shared.DeviceInfo) {
+	config := hctx.GetConf(ctx)
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	tbl := table.New("Device ID", "Name", "Registered", "Last Used", "Status")
+	tbl.WithHeaderFormatter(headerFmt)
+	for _, device := range devices {
+		name := device.Name
+		if device.DeviceId == config.DeviceId {
+			name = strings.TrimSpace(name + " (this device)")
+		}
+		lastUsed := "Never"
+		if !device.LastUsed.IsZero() {
+			lastUsed = device.LastUsed.Local().Format(config.TimestampFormat)
+		}
+		status := "Active"
+		if device.IsRevoked {
+			status = "Revoked"
+		}
+		tbl.AddRow(device.DeviceId, name, device.RegistrationDate.Local().Format(config.TimestampFormat), lastUsed, status)
+	}
+	tbl.Print()
+}
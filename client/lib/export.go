@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+)
+
+// The formats supported by `hishtory export --format`
+var EXPORT_FORMATS = []string{"raw", "json", "ndjson", "csv", "tsv"}
+
+// The columns included in CSV and TSV exports, followed by one column per custom column
+var exportColumns = []string{"local_username", "hostname", "command", "current_working_directory", "home_directory", "exit_code", "start_time", "end_time", "device_id"}
+
+// ExportEntries writes the given entries to w in the given format. The raw format writes just the commands,
+// terminated by a NUL byte if nullSeparated is set (for piping into `xargs -0`) or by a newline otherwise.
+// All other formats include every field of the entries, including custom columns.
+func ExportEntries(w io.Writer, entries []*data.HistoryEntry, format string, nullSeparated bool) error {
+	if nullSeparated && format != "raw" {
+		return fmt.Errorf("NUL-separated output is only supported for the raw format, not %s", format)
+	}
+	switch format {
+	case "raw":
+		terminator := "\n"
+		if nullSeparated {
+			terminator = "\x00"
+		}
+		for _, entry := range entries {
+			if _, err := io.WriteString(w, entry.Command+terminator); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if entries == nil {
+			entries = []*data.HistoryEntry{}
+		}
+		return encoder.Encode(entries)
+	case "ndjson":
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		writer := csv.NewWriter(w)
+		for _, record := range makeExportRecords(entries) {
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case "tsv":
+		// TSV can't quote fields, so tabs, newlines and backslashes in fields are escaped instead
+		escaper := strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+		for _, record := range makeExportRecords(entries) {
+			for i, field := range record {
+				record[i] = escaper.Replace(field)
+			}
+			if _, err := io.WriteString(w, strings.Join(record, "\t")+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown export format %q (expected one of: %s)", format, strings.Join(EXPORT_FORMATS, ", "))
+	}
+}
+
+// Converts entries into rows for a CSV or TSV export, starting with a header row
+func makeExportRecords(entries []*data.HistoryEntry) [][]string {
+	var customColumnNames []string
+	seenCustomColumns := make(map[string]bool)
+	for _, entry := range entries {
+		for _, cc := range entry.CustomColumns {
+			if !seenCustomColumns[cc.Name] {
+				seenCustomColumns[cc.Name] = true
+				customColumnNames = append(customColumnNames, cc.Name)
+			}
+		}
+	}
+	header := append(append([]string{}, exportColumns...), customColumnNames...)
+	records := [][]string{header}
+	for _, entry := range entries {
+		record := []string{
+			entry.LocalUsername,
+			entry.Hostname,
+			entry.Command,
+			entry.CurrentWorkingDirectory,
+			entry.HomeDirectory,
+			strconv.Itoa(entry.ExitCode),
+			entry.StartTime.Format(time.RFC3339Nano),
+			entry.EndTime.Format(time.RFC3339Nano),
+			entry.DeviceId,
+		}
+		for _, name := range customColumnNames {
+			val := ""
+			for _, cc := range entry.CustomColumns {
+				if cc.Name == name {
+					val = cc.Val
+				}
+			}
+			record = append(record, val)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// ImportJsonHistory imports history entries written by `hishtory export --format json` (or `--format ndjson`)
+// from r. Unlike ImportHistory, every field of the entries is preserved. Entries that already exist are skipped,
+// and the newly imported entries are returned.
+func ImportJsonHistory(ctx *context.Context, r io.Reader) ([]*data.HistoryEntry, error) {
+	entries, err := readJsonHistoryEntries(r)
+	if err != nil {
+		return nil, err
+	}
+	return addImportedEntries(ctx, entries)
+}
+
+// Reads either a JSON array of history entries or a stream of newline-delimited JSON entries.
+func readJsonHistoryEntries(r io.Reader) ([]*data.HistoryEntry, error) {
+	reader := bufio.NewReader(r)
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return []*data.HistoryEntry{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			break
+		}
+		_, _ = reader.ReadByte()
+	}
+	b, _ := reader.Peek(1)
+	decoder := json.NewDecoder(reader)
+	if b[0] == '[' {
+		var entries []*data.HistoryEntry
+		if err := decoder.Decode(&entries); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON history entries: %v", err)
+		}
+		return entries, nil
+	}
+	entries := make([]*data.HistoryEntry, 0)
+	for {
+		var entry data.HistoryEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JSON history entry #%d: %v", len(entries)+1, err)
+		}
+		entries = append(entries, &entry)
+	}
+}
+
+// UploadImportedEntries uploads entries that were imported via ImportJsonHistory to the backend so they are synced
+// to other devices.
+func UploadImportedEntries(ctx *context.Context, entries []*data.HistoryEntry) error {
+	config := hctx.GetConf(ctx)
+	if config.IsOffline {
+		return nil
+	}
+	return uploadEntries(config, entries)
+}
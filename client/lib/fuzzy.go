@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/ddworken/hishtory/client/data"
+	"gorm.io/gorm"
+)
+
+// The maximum number of entries that are fetched from the DB and then ranked by the fuzzy matcher
+const FUZZY_CANDIDATE_LIMIT = 5000
+
+const (
+	fuzzyScoreMatch       = 16
+	fuzzyBonusConsecutive = 8
+	fuzzyBonusBoundary    = 8
+	fuzzyPenaltyGapStart  = 3
+	fuzzyPenaltyGapExtend = 1
+	// How strongly older entries are penalized relative to the match quality
+	fuzzyRecencyWeight = 4
+)
+
+// FuzzySearch searches for history entries where the command fuzzily matches the plain terms in the query. Any
+// atoms (e.g. `cwd:/tmp`) or negated terms in the query are applied as normal filters before the fuzzy matching
+// happens. Results are ranked by match quality, with a penalty for older entries, unless an explicit sort: atom
+// was given in which case that ordering is kept. In addition to the entries, it returns the rune offsets within
+// each entry's displayed command (with newlines escaped) that matched.
+func FuzzySearch(ctx *context.Context, db *gorm.DB, query string, limit int) ([]*data.HistoryEntry, [][]int, error) {
+	filters, terms, ok := splitFuzzyQuery(query)
+	if !ok || len(terms) == 0 {
+		// Boolean operators and grouping don't have a meaningful fuzzy interpretation, so fall back to a normal search
+		entries, err := Search(ctx, db, query, limit)
+		return entries, nil, err
+	}
+	sortOrder, _, err := extractSortOrder(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates, err := Search(ctx, db, strings.Join(filters, " "), FUZZY_CANDIDATE_LIMIT)
+	if err != nil {
+		return nil, nil, err
+	}
+	type scoredEntry struct {
+		entry     *data.HistoryEntry
+		score     float64
+		positions []int
+	}
+	var matches []scoredEntry
+	for i, entry := range candidates {
+		score, positions, ok := fuzzyMatchAll(terms, strings.ReplaceAll(entry.Command, "\n", "\\n"))
+		if !ok {
+			continue
+		}
+		// Candidates are ordered from newest to oldest
+		recencyPenalty := fuzzyRecencyWeight * math.Log2(float64(i+1))
+		matches = append(matches, scoredEntry{entry, float64(score) - recencyPenalty, positions})
+	}
+	if sortOrder == "" {
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].score > matches[j].score
+		})
+	}
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	entries := make([]*data.HistoryEntry, 0, len(matches))
+	positions := make([][]int, 0, len(matches))
+	for _, match := range matches {
+		entries = append(entries, match.entry)
+		positions = append(positions, match.positions)
+	}
+	return entries, positions, nil
+}
+
+// splitFuzzyQuery splits a query into the tokens that should be used as normal search filters and the
+// (unescaped) terms that should be fuzzily matched. Returns false if the query uses boolean operators or grouping.
+func splitFuzzyQuery(query string) ([]string, []string, bool) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, nil, false
+	}
+	var filters, terms []string
+	for _, token := range tokens {
+		switch {
+		case token == "":
+		case token == "OR" || token == "||" || token == "AND" || token == "&&":
+			return nil, nil, false
+		case strings.HasPrefix(token, "(") || strings.HasPrefix(token, "-(") || (strings.HasSuffix(token, ")") && !strings.HasSuffix(token, "\\)")):
+			return nil, nil, false
+		case strings.HasPrefix(token, "-") || containsUnescaped(token, ":"):
+			filters = append(filters, token)
+		default:
+			terms = append(terms, unescape(token))
+		}
+	}
+	return filters, terms, true
+}
+
+// fuzzyMatchAll matches every term against the text, returning the combined score and the sorted positions that
+// matched. Returns false if any of the terms don't match.
+func fuzzyMatchAll(terms []string, text string) (int, []int, bool) {
+	totalScore := 0
+	matchedPositions := make(map[int]bool)
+	for _, term := range terms {
+		score, positions, ok := fuzzyMatch(term, text)
+		if !ok {
+			return 0, nil, false
+		}
+		totalScore += score
+		for _, p := range positions {
+			matchedPositions[p] = true
+		}
+	}
+	positions := make([]int, 0, len(matchedPositions))
+	for p := range matchedPositions {
+		positions = append(positions, p)
+	}
+	sort.Ints(positions)
+	return totalScore, positions, true
+}
+
+// fuzzyMatch checks whether pattern is a subsequence of text and scores the match. Matching is case-insensitive
+// unless the pattern contains an upper case character. To keep matches tight, it finds the first occurrence of
+// the subsequence and then scans backwards from its end to find the shortest window containing the pattern. The
+// returned positions are rune offsets into text.
+func fuzzyMatch(pattern, text string) (int, []int, bool) {
+	patternRunes := []rune(pattern)
+	textRunes := []rune(text)
+	if len(patternRunes) == 0 {
+		return 0, nil, true
+	}
+	caseSensitive := strings.IndexFunc(pattern, unicode.IsUpper) >= 0
+	equal := func(p, t rune) bool {
+		if caseSensitive {
+			return p == t
+		}
+		return unicode.ToLower(p) == unicode.ToLower(t)
+	}
+
+	// Find the end of the first occurrence of the subsequence
+	pIdx := 0
+	end := -1
+	for tIdx := 0; tIdx < len(textRunes); tIdx++ {
+		if equal(patternRunes[pIdx], textRunes[tIdx]) {
+			pIdx++
+			if pIdx == len(patternRunes) {
+				end = tIdx
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+
+	// Scan backwards to find the start of the shortest window ending there
+	pIdx = len(patternRunes) - 1
+	start := end
+	for tIdx := end; tIdx >= 0; tIdx-- {
+		if equal(patternRunes[pIdx], textRunes[tIdx]) {
+			pIdx--
+			if pIdx < 0 {
+				start = tIdx
+				break
+			}
+		}
+	}
+
+	// And then match forwards within that window to compute the positions and the score
+	positions := make([]int, 0, len(patternRunes))
+	score := 0
+	pIdx = 0
+	for tIdx := start; tIdx <= end && pIdx < len(patternRunes); tIdx++ {
+		if !equal(patternRunes[pIdx], textRunes[tIdx]) {
+			continue
+		}
+		score += fuzzyScoreMatch
+		if tIdx == 0 || isFuzzyBoundary(textRunes[tIdx-1]) {
+			score += fuzzyBonusBoundary
+		}
+		if len(positions) > 0 {
+			prev := positions[len(positions)-1]
+			if prev == tIdx-1 {
+				score += fuzzyBonusConsecutive
+			} else {
+				score -= fuzzyPenaltyGapStart + fuzzyPenaltyGapExtend*(tIdx-prev-2)
+			}
+		}
+		positions = append(positions, tIdx)
+		pIdx++
+	}
+	return score, positions, true
+}
+
+func isFuzzyBoundary(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("/-_.=:;|&'\"", r)
+}
@@ -0,0 +1,347 @@
+package lib
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"gorm.io/gorm"
+)
+
+// HistoryImporter imports the history recorded by another shell history tool, preserving whatever metadata
+// (cwd, exit code, timestamps, etc) that tool recorded.
+type HistoryImporter struct {
+	// The name used to select this importer via `hishtory import --format`
+	Name string
+	// The locations (relative to the home directory) where the tool stores its history by default, in order of preference
+	DefaultPaths []string
+	// Reads the history entries from the given path. Fields that the tool doesn't record may be left empty
+	// and are filled in with defaults for the current device.
+	read func(path string) ([]*data.HistoryEntry, error)
+}
+
+var HISTORY_IMPORTERS = []HistoryImporter{
+	{
+		Name:         "atuin",
+		DefaultPaths: []string{".local/share/atuin/history.db"},
+		read:         readAtuinHistory,
+	},
+	{
+		Name:         "mcfly",
+		DefaultPaths: []string{".local/share/mcfly/history.db", "Library/Application Support/McFly/history.db", ".mcfly/history.db"},
+		read:         readMcflyHistory,
+	},
+	{
+		Name:         "resh",
+		DefaultPaths: []string{".local/share/resh/history.reshjson", ".resh_history.json"},
+		read:         readReshHistory,
+	},
+	{
+		Name:         "nushell",
+		DefaultPaths: []string{".config/nushell/history.sqlite3", "Library/Application Support/nushell/history.sqlite3"},
+		read:         readNushellHistory,
+	},
+}
+
+func GetHistoryImporter(name string) (HistoryImporter, bool) {
+	for _, importer := range HISTORY_IMPORTERS {
+		if importer.Name == name {
+			return importer, true
+		}
+	}
+	return HistoryImporter{}, false
+}
+
+// ImportFromTool imports the history from the given importer. If path is empty, the tool's default
+// history location is used. Entries that already exist are skipped, and the newly imported entries are returned.
+func ImportFromTool(ctx *context.Context, importer HistoryImporter, path string) ([]*data.HistoryEntry, error) {
+	if path == "" {
+		for _, defaultPath := range importer.DefaultPaths {
+			p := filepath.Join(hctx.GetHome(ctx), defaultPath)
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return nil, fmt.Errorf("failed to find %s history in any of the default locations (%s), please specify the path to it", importer.Name, strings.Join(importer.DefaultPaths, ", "))
+		}
+	} else if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to read %s history: %v", importer.Name, err)
+	}
+	entries, err := importer.read(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s history from %s: %v", importer.Name, path, err)
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.LocalUsername == "" {
+			entry.LocalUsername = currentUser.Name
+		}
+		if entry.Hostname == "" {
+			entry.Hostname = hostname
+		}
+		if entry.CurrentWorkingDirectory == "" {
+			entry.CurrentWorkingDirectory = "Unknown"
+		}
+		if entry.HomeDirectory == "" {
+			entry.HomeDirectory = hctx.GetHome(ctx)
+		}
+	}
+	return addImportedEntries(ctx, entries)
+}
+
+// Adds the imported entries to the DB, skipping any that already exist. Returns the entries that were added. This is
+// done in one transaction so that an invalid entry part way through doesn't leave a partial import behind.
+func addImportedEntries(ctx *context.Context, entries []*data.HistoryEntry) ([]*data.HistoryEntry, error) {
+	config := hctx.GetConf(ctx)
+	db := hctx.GetDb(ctx)
+	importedEntries := make([]*data.HistoryEntry, 0)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i, entry := range entries {
+			if entry.Command == "" || entry.StartTime.IsZero() || entry.EndTime.IsZero() {
+				return fmt.Errorf("entry #%d is missing a command, start_time or end_time: %#v", i+1, entry)
+			}
+			if entry.DeviceId == "" {
+				entry.DeviceId = config.DeviceId
+			}
+			isNew, err := AddToDbIfNew(tx, *entry)
+			if err != nil {
+				return fmt.Errorf("failed to import entry #%d: %v", i+1, err)
+			}
+			if isNew {
+				importedEntries = append(importedEntries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return importedEntries, nil
+}
+
+func openImportedSqliteDb(path string) (*sql.DB, error) {
+	// The driver is registered by github.com/glebarez/go-sqlite, which is what we use for our own DB
+	dsn := url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}
+	return sql.Open("sqlite", dsn.String())
+}
+
+func sqliteHasColumn(db *sql.DB, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	return count > 0, err
+}
+
+// Reads atuin's history DB, where timestamps and durations are in nanoseconds and the hostname
+// column is of the form `hostname:username`.
+func readAtuinHistory(path string) ([]*data.HistoryEntry, error) {
+	db, err := openImportedSqliteDb(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	query := "SELECT command, cwd, hostname, exit, timestamp, duration FROM history"
+	hasDeletedAt, err := sqliteHasColumn(db, "history", "deleted_at")
+	if err != nil {
+		return nil, err
+	}
+	if hasDeletedAt {
+		query += " WHERE deleted_at IS NULL"
+	}
+	rows, err := db.Query(query + " ORDER BY timestamp")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*data.HistoryEntry, 0)
+	for rows.Next() {
+		var command, cwd, hostAndUser string
+		var exitCode int
+		var timestamp, duration int64
+		if err := rows.Scan(&command, &cwd, &hostAndUser, &exitCode, &timestamp, &duration); err != nil {
+			return nil, err
+		}
+		entry := data.HistoryEntry{
+			Command:                 command,
+			CurrentWorkingDirectory: cwd,
+			Hostname:                hostAndUser,
+			ExitCode:                exitCode,
+			StartTime:               time.Unix(0, timestamp),
+		}
+		if idx := strings.LastIndex(hostAndUser, ":"); idx >= 0 {
+			entry.Hostname = hostAndUser[:idx]
+			entry.LocalUsername = hostAndUser[idx+1:]
+		}
+		// atuin records a duration of -1 if it is unknown
+		entry.EndTime = entry.StartTime.Add(time.Duration(max64(duration, 0)))
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// Reads mcfly's history DB, where timestamps are in seconds.
+func readMcflyHistory(path string) ([]*data.HistoryEntry, error) {
+	db, err := openImportedSqliteDb(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// Older versions of mcfly didn't record when commands finished
+	whenFinished := "when_run"
+	hasWhenFinished, err := sqliteHasColumn(db, "commands", "when_finished")
+	if err != nil {
+		return nil, err
+	}
+	if hasWhenFinished {
+		whenFinished = "COALESCE(when_finished, when_run)"
+	}
+	rows, err := db.Query("SELECT cmd, COALESCE(dir, ''), COALESCE(exit_code, 0), when_run, " + whenFinished + " FROM commands ORDER BY when_run, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*data.HistoryEntry, 0)
+	for rows.Next() {
+		var command, cwd string
+		var exitCode int
+		var whenRun, whenFinished int64
+		if err := rows.Scan(&command, &cwd, &exitCode, &whenRun, &whenFinished); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &data.HistoryEntry{
+			Command:                 command,
+			CurrentWorkingDirectory: cwd,
+			ExitCode:                exitCode,
+			StartTime:               time.Unix(whenRun, 0),
+			EndTime:                 time.Unix(max64(whenRun, whenFinished), 0),
+		})
+	}
+	return entries, rows.Err()
+}
+
+// Reads Nushell's SQLite history, where timestamps and durations are in milliseconds.
+func readNushellHistory(path string) ([]*data.HistoryEntry, error) {
+	db, err := openImportedSqliteDb(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT command_line, COALESCE(cwd, ''), COALESCE(hostname, ''), COALESCE(exit_status, 0), start_timestamp, COALESCE(duration_ms, 0) FROM history WHERE start_timestamp IS NOT NULL ORDER BY start_timestamp, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*data.HistoryEntry, 0)
+	for rows.Next() {
+		var command, cwd, hostname string
+		var exitCode int
+		var startTimestamp, durationMs int64
+		if err := rows.Scan(&command, &cwd, &hostname, &exitCode, &startTimestamp, &durationMs); err != nil {
+			return nil, err
+		}
+		startTime := time.UnixMilli(startTimestamp)
+		entries = append(entries, &data.HistoryEntry{
+			Command:                 command,
+			CurrentWorkingDirectory: cwd,
+			Hostname:                hostname,
+			ExitCode:                exitCode,
+			StartTime:               startTime,
+			EndTime:                 startTime.Add(time.Duration(max64(durationMs, 0)) * time.Millisecond),
+		})
+	}
+	return entries, rows.Err()
+}
+
+// A record in resh's history file. Older versions of resh (v2) use realtimeBefore and realtimeDuration as
+// floats, while newer versions (v3) use time and duration as strings.
+type reshRecord struct {
+	CmdLine          string  `json:"cmdLine"`
+	ExitCode         int     `json:"exitCode"`
+	Pwd              string  `json:"pwd"`
+	Home             string  `json:"home"`
+	Host             string  `json:"host"`
+	Device           string  `json:"device"`
+	Login            string  `json:"login"`
+	RealtimeBefore   float64 `json:"realtimeBefore"`
+	RealtimeDuration float64 `json:"realtimeDuration"`
+	Time             string  `json:"time"`
+	Duration         string  `json:"duration"`
+}
+
+// Reads resh's history file, which contains one JSON record per line.
+func readReshHistory(path string) ([]*data.HistoryEntry, error) {
+	lines, err := readFileToArray(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*data.HistoryEntry, 0)
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var record reshRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("failed to parse line %d: %v", i+1, err)
+		}
+		startTime, duration := record.RealtimeBefore, record.RealtimeDuration
+		if record.Time != "" {
+			startTime, err = strconv.ParseFloat(record.Time, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the time on line %d: %v", i+1, err)
+			}
+			duration, err = strconv.ParseFloat(record.Duration, 64)
+			if err != nil && record.Duration != "" {
+				return nil, fmt.Errorf("failed to parse the duration on line %d: %v", i+1, err)
+			}
+		}
+		if startTime == 0 {
+			return nil, fmt.Errorf("failed to find a timestamp on line %d", i+1)
+		}
+		hostname := record.Host
+		if record.Device != "" {
+			hostname = record.Device
+		}
+		entries = append(entries, &data.HistoryEntry{
+			LocalUsername:           record.Login,
+			Hostname:                hostname,
+			Command:                 record.CmdLine,
+			CurrentWorkingDirectory: record.Pwd,
+			HomeDirectory:           record.Home,
+			ExitCode:                record.ExitCode,
+			StartTime:               unixSecondsToTime(startTime),
+			EndTime:                 unixSecondsToTime(startTime + math.Max(duration, 0)),
+		})
+	}
+	return entries, nil
+}
+
+func unixSecondsToTime(seconds float64) time.Time {
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)).Round(time.Microsecond)
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
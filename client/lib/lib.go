@@ -10,7 +10,9 @@ import (
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
@@ -20,6 +22,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -206,23 +209,52 @@ func buildCustomColumns(ctx *context.Context) (data.CustomColumns, error) {
 	return ccs, nil
 }
 
-func stripZshWeirdness(cmd string) string {
-	// Zsh has this weird behavior where sometimes commands are saved in the hishtory file
-	// with a weird prefix. I've never been able to figure out why this happens, but we
-	// can at least strip it.
-	firstCommandBugRegex := regexp.MustCompile(`: \d+:\d;(.*)`)
-	matches := firstCommandBugRegex.FindStringSubmatch(cmd)
-	if len(matches) == 2 {
-		return matches[1]
-	}
-	return cmd
+// Zsh's EXTENDED_HISTORY option saves commands in the history file with a prefix containing
+// the start time and the duration in seconds, e.g. `: 1664342754:3;ls`. This isn't anchored since
+// zsh sometimes saves the prefix after other junk, and it can be stripped from those too.
+var zshExtendedHistoryRegex = regexp.MustCompile(`: (\d+):(\d+);(.*)`)
+
+// Bash (with HISTTIMEFORMAT set) saves the start time of each command on the line before it, e.g. `#1664342754`
+var bashTimestampRegex = regexp.MustCompile(`^#(\d+)\s*$`)
+
+// A command read from a shell's history file, along with any metadata that the history file recorded for it
+type importedCommand struct {
+	command string
+	// When the command was run, or the zero time if the history file didn't record it
+	startTime time.Time
+	// How long the command ran for, if the history file recorded it
+	duration      time.Duration
+	customColumns data.CustomColumns
 }
 
-func isBashWeirdness(cmd string) bool {
-	// Bash has this weird behavior where the it has entries like `#1664342754` in the
-	// history file. We want to skip these.
-	firstCommandBugRegex := regexp.MustCompile(`^#\d+\s+$`)
-	return firstCommandBugRegex.MatchString(cmd)
+// Parses the lines of a bash or zsh history file, including any timestamps and durations that were recorded
+func parseShellHistory(lines []string) []importedCommand {
+	ret := make([]importedCommand, 0, len(lines))
+	var pendingStartTime time.Time
+	for _, line := range lines {
+		if matches := bashTimestampRegex.FindStringSubmatch(line); matches != nil {
+			epoch, err := strconv.ParseInt(matches[1], 10, 64)
+			if err == nil {
+				pendingStartTime = time.Unix(epoch, 0)
+			}
+			continue
+		}
+		cmd := importedCommand{command: line, startTime: pendingStartTime}
+		pendingStartTime = time.Time{}
+		if matches := zshExtendedHistoryRegex.FindStringSubmatch(line); matches != nil {
+			cmd.command = matches[3]
+			epoch, err := strconv.ParseInt(matches[1], 10, 64)
+			if err == nil {
+				cmd.startTime = time.Unix(epoch, 0)
+			}
+			duration, err := strconv.ParseInt(matches[2], 10, 64)
+			if err == nil {
+				cmd.duration = time.Duration(duration) * time.Second
+			}
+		}
+		ret = append(ret, cmd)
+	}
+	return ret
 }
 
 func buildRegexFromTimeFormat(timeFormat string) string {
@@ -353,11 +385,36 @@ func Setup(userSecret string, isOffline bool) error {
 	if userSecret == "" {
 		userSecret = uuid.Must(uuid.NewRandom()).String()
 	}
+	return setup(userSecret, "", isOffline)
+}
+
+// SetupWithPassphrase is the same as Setup, except that the user secret is derived from a passphrase. If kdfHeader
+// is empty a new salt is generated, otherwise the header from another device is used so that the same secret is
+// derived.
+func SetupWithPassphrase(passphrase, kdfHeader string, isOffline bool) error {
+	if len(passphrase) < data.MinPassphraseLength {
+		return fmt.Errorf("passphrases must be at least %d characters long", data.MinPassphraseLength)
+	}
+	var params data.KdfParams
+	var err error
+	if kdfHeader == "" {
+		params, err = data.NewKdfParams()
+	} else {
+		params, err = data.ParseKdfHeader(kdfHeader)
+	}
+	if err != nil {
+		return err
+	}
+	return setup(data.DeriveUserSecret(passphrase, params), params.Header(), isOffline)
+}
+
+func setup(userSecret, kdfHeader string, isOffline bool) error {
 	fmt.Println("Setting secret hishtory key to " + string(userSecret))
 
 	// Create and set the config
 	var config hctx.ClientConfig
 	config.UserSecret = userSecret
+	config.KdfHeader = kdfHeader
 	config.IsEnabled = true
 	config.DeviceId = uuid.Must(uuid.NewRandom()).String()
 	config.ControlRSearchEnabled = true
@@ -378,32 +435,56 @@ func Setup(userSecret string, isOffline bool) error {
 	if config.IsOffline {
 		return nil
 	}
-	_, err = ApiGet("/api/v1/register?user_id=" + data.UserId(userSecret) + "&device_id=" + config.DeviceId)
+	err = registerDevice(config)
 	if err != nil {
-		return fmt.Errorf("failed to register device with backend: %v", err)
+		return err
 	}
+	return bootstrapFromRemote(db, config)
+}
 
-	respBody, err := ApiGet("/api/v1/bootstrap?user_id=" + data.UserId(userSecret) + "&device_id=" + config.DeviceId)
+// Downloads and persists all of the user's history entries. The entries are streamed and decrypted one at a time, so
+// that syncing a large history uses a bounded amount of memory.
+func bootstrapFromRemote(db *gorm.DB, config hctx.ClientConfig) error {
+	resp, err := openApiRequest(config, "GET", "/api/v1/bootstrap?user_id="+data.UserId(config.UserSecret)+"&device_id="+config.DeviceId+"&format=ndjson", "", nil)
 	if err != nil {
 		return fmt.Errorf("failed to bootstrap device from the backend: %v", err)
 	}
-	var retrievedEntries []*shared.EncHistoryEntry
-	err = json.Unmarshal(respBody, &retrievedEntries)
-	if err != nil {
-		return fmt.Errorf("failed to load JSON response: %v", err)
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	if resp.Header.Get("Content-Type") != shared.NdjsonContentType {
+		// Older backends return a single JSON array, which can still be decoded one entry at a time
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("failed to load JSON response: %v", err)
+		}
+		if delim, ok := token.(json.Delim); token != nil && (!ok || delim != '[') {
+			return fmt.Errorf("failed to load JSON response: expected an array, got %v", token)
+		}
 	}
-	for _, entry := range retrievedEntries {
-		decEntry, err := data.DecryptHistoryEntry(userSecret, *entry)
+	totalEntries, _ := strconv.ParseInt(resp.Header.Get(shared.TotalEntriesHeader), 10, 64)
+	progress := newProgressReporter("Syncing history entries", totalEntries)
+	defer progress.Done()
+	for decoder.More() {
+		var entry shared.EncHistoryEntry
+		err = decoder.Decode(&entry)
+		if err != nil {
+			return fmt.Errorf("failed to load JSON response: %v", err)
+		}
+		decEntry, err := data.DecryptHistoryEntry(config.UserSecret, entry)
 		if err != nil {
 			return fmt.Errorf("failed to decrypt history entry from server: %v", err)
 		}
-		AddToDbIfNew(db, decEntry)
+		_, err = AddToDbIfNew(db, decEntry)
+		if err != nil {
+			return fmt.Errorf("failed to persist history entry from server: %v", err)
+		}
+		progress.Increment()
 	}
-
 	return nil
 }
 
-func AddToDbIfNew(db *gorm.DB, entry data.HistoryEntry) {
+// AddToDbIfNew inserts the entry unless an identical one already exists, returning whether it was inserted.
+func AddToDbIfNew(db *gorm.DB, entry data.HistoryEntry) (bool, error) {
 	tx := db.Where("local_username = ?", entry.LocalUsername)
 	tx = tx.Where("hostname = ?", entry.Hostname)
 	tx = tx.Where("command = ?", entry.Command)
@@ -413,11 +494,18 @@ func AddToDbIfNew(db *gorm.DB, entry data.HistoryEntry) {
 	tx = tx.Where("start_time = ?", entry.StartTime)
 	tx = tx.Where("end_time = ?", entry.EndTime)
 	var results []data.HistoryEntry
-	tx.Limit(1).Find(&results)
-	if len(results) == 0 {
-		db.Create(entry)
-		// TODO: check the error here and bubble it up
+	result := tx.Limit(1).Find(&results)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to check whether the entry already exists: %v", result.Error)
 	}
+	if len(results) > 0 {
+		return false, nil
+	}
+	result = db.Create(entry)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to insert entry: %v", result.Error)
+	}
+	return true, nil
 }
 
 func getCustomColumnValue(ctx *context.Context, header string, entry data.HistoryEntry) (string, error) {
@@ -522,34 +610,35 @@ func ImportHistory(ctx *context.Context, shouldReadStdin, force bool) (int, erro
 	}
 	homedir := hctx.GetHome(ctx)
 	bashHistPath := filepath.Join(homedir, ".bash_history")
-	historyEntries, err := readFileToArray(bashHistPath)
+	lines, err := readFileToArray(bashHistPath)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse bash history: %v", err)
 	}
+	historyEntries := parseShellHistory(lines)
 	zshHistPath := filepath.Join(homedir, ".zsh_history")
-	extraEntries, err := readFileToArray(zshHistPath)
+	lines, err = readFileToArray(zshHistPath)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse zsh history: %v", err)
 	}
-	historyEntries = append(historyEntries, extraEntries...)
-	extraEntries, err = parseFishHistory(homedir)
+	historyEntries = append(historyEntries, parseShellHistory(lines)...)
+	extraEntries, err := parseFishHistory(homedir)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse fish history: %v", err)
 	}
 	historyEntries = append(historyEntries, extraEntries...)
 	if histfile := os.Getenv("HISTFILE"); histfile != "" && histfile != zshHistPath && histfile != bashHistPath {
-		extraEntries, err := readFileToArray(histfile)
+		lines, err := readFileToArray(histfile)
 		if err != nil {
 			return 0, fmt.Errorf("failed to parse histfile: %v", err)
 		}
-		historyEntries = append(historyEntries, extraEntries...)
+		historyEntries = append(historyEntries, parseShellHistory(lines)...)
 	}
 	if shouldReadStdin {
-		extraEntries, err = readStdin()
+		lines, err = readStdin()
 		if err != nil {
 			return 0, fmt.Errorf("failed to read stdin: %v", err)
 		}
-		historyEntries = append(historyEntries, extraEntries...)
+		historyEntries = append(historyEntries, parseShellHistory(lines)...)
 	}
 	db := hctx.GetDb(ctx)
 	currentUser, err := user.Current()
@@ -561,23 +650,31 @@ func ImportHistory(ctx *context.Context, shouldReadStdin, force bool) (int, erro
 		return 0, err
 	}
 	for _, cmd := range historyEntries {
-		cmd := stripZshWeirdness(cmd)
-		if isBashWeirdness(cmd) || strings.HasPrefix(cmd, " ") {
+		if strings.HasPrefix(cmd.command, " ") {
 			// Skip it
 			continue
 		}
 		entry := data.HistoryEntry{
 			LocalUsername:           currentUser.Name,
 			Hostname:                hostname,
-			Command:                 cmd,
+			Command:                 cmd.command,
 			CurrentWorkingDirectory: "Unknown",
 			HomeDirectory:           homedir,
 			ExitCode:                0,
 			StartTime:               time.Now(),
 			EndTime:                 time.Now(),
 			DeviceId:                config.DeviceId,
+			CustomColumns:           cmd.customColumns,
+		}
+		if cmd.startTime.IsZero() {
+			err = ReliableDbCreate(db, entry)
+		} else {
+			entry.StartTime = cmd.startTime
+			entry.EndTime = cmd.startTime.Add(cmd.duration)
+			// Timestamps in history files only have second granularity, so the same command may legitimately
+			// appear with an identical timestamp (and re-importing the same file shouldn't duplicate it)
+			_, err = AddToDbIfNew(db, entry)
 		}
-		err = ReliableDbCreate(db, entry)
 		if err != nil {
 			return 0, fmt.Errorf("failed to insert imported history entry: %v", err)
 		}
@@ -615,18 +712,50 @@ func readStdin() ([]string, error) {
 	return ret, nil
 }
 
-func parseFishHistory(homedir string) ([]string, error) {
+// Parses fish's history file, which is YAML-like and looks like:
+//
+//	# ~/.local/share/fish/fish_history
+//	- cmd: cat foo.txt
+//	  when: 1664342754
+//	  paths:
+//	    - foo.txt
+//
+// The paths (which fish records for arguments that were files) are stored in a `fish_paths` custom column.
+func parseFishHistory(homedir string) ([]importedCommand, error) {
 	lines, err := readFileToArray(filepath.Join(homedir, ".local/share/fish/fish_history"))
 	if err != nil {
 		return nil, err
 	}
-	ret := make([]string, 0)
+	ret := make([]importedCommand, 0)
+	var paths []string
+	inPaths := false
+	finishCommand := func() {
+		if len(ret) > 0 && len(paths) > 0 {
+			ret[len(ret)-1].customColumns = data.CustomColumns{{Name: "fish_paths", Val: strings.Join(paths, " ")}}
+		}
+		paths = nil
+		inPaths = false
+	}
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if strings.HasPrefix(line, "- cmd: ") {
-			ret = append(ret, strings.SplitN(line, ": ", 2)[1])
+			finishCommand()
+			ret = append(ret, importedCommand{command: strings.SplitN(line, ": ", 2)[1]})
+		} else if len(ret) == 0 {
+			continue
+		} else if strings.HasPrefix(line, "when: ") {
+			inPaths = false
+			epoch, err := strconv.ParseInt(strings.TrimPrefix(line, "when: "), 10, 64)
+			if err == nil {
+				ret[len(ret)-1].startTime = time.Unix(epoch, 0)
+			}
+		} else if line == "paths:" {
+			inPaths = true
+		} else if inPaths && strings.HasPrefix(line, "- ") {
+			paths = append(paths, strings.TrimPrefix(line, "- "))
 		}
 	}
+	finishCommand()
 	return ret, nil
 }
 
@@ -656,7 +785,8 @@ func readFileToArray(path string) ([]string, error) {
 }
 
 func GetDownloadData() (shared.UpdateInfo, error) {
-	respBody, err := ApiGet("/api/v1/download")
+	// Downloading updates doesn't require authentication
+	respBody, err := ApiGet(hctx.ClientConfig{}, "/api/v1/download")
 	if err != nil {
 		return shared.UpdateInfo{}, fmt.Errorf("failed to download update info: %v", err)
 	}
@@ -901,74 +1031,266 @@ func httpClient() *http.Client {
 	return &http.Client{}
 }
 
-func ApiGet(path string) ([]byte, error) {
-	if os.Getenv("HISHTORY_SIMULATE_NETWORK_ERROR") != "" {
-		return nil, fmt.Errorf("simulated network error: dial tcp: lookup api.hishtory.dev")
+// ApiGet makes a GET request to the backend, authenticated as the device in the given config. Requests to endpoints
+// that don't require authentication can pass an empty config.
+func ApiGet(config hctx.ClientConfig, path string) ([]byte, error) {
+	respBody, _, err := apiRequest(config, "GET", path, "", nil)
+	return respBody, err
+}
+
+// ApiPost makes a POST request to the backend, authenticated as the device in the given config
+func ApiPost(config hctx.ClientConfig, path, contentType string, reqBody []byte) ([]byte, error) {
+	respBody, _, err := apiRequest(config, "POST", path, contentType, reqBody)
+	return respBody, err
+}
+
+// Request bodies smaller than this aren't worth compressing
+const minCompressedRequestSize = 1024
+
+var (
+	requestEncodingMutex sync.Mutex
+	// The encoding to compress request bodies with, or "" if the backend hasn't responded to this process yet
+	requestEncoding = ""
+)
+
+// Returns the encoding to compress request bodies with. Older backends can't decompress request bodies, so this is
+// identity until a response from the backend says which encodings it accepts. That is persisted in the config so that
+// the first request of each process can be compressed too.
+func getRequestEncoding(config hctx.ClientConfig) string {
+	requestEncodingMutex.Lock()
+	defer requestEncodingMutex.Unlock()
+	if requestEncoding != "" {
+		return requestEncoding
 	}
-	start := time.Now()
-	req, err := http.NewRequest("GET", getServerHostname()+path, nil)
+	if config.RequestEncoding != "" {
+		return config.RequestEncoding
+	}
+	return shared.EncodingIdentity
+}
+
+func setRequestEncoding(config hctx.ClientConfig, acceptEncoding string) {
+	encoding := shared.NegotiateEncoding(acceptEncoding)
+	requestEncodingMutex.Lock()
+	requestEncoding = encoding
+	requestEncodingMutex.Unlock()
+	// Requests to endpoints that don't require authentication (e.g. for updates) don't have a config to persist to
+	if config.UserSecret == "" || config.RequestEncoding == encoding {
+		return
+	}
+	err := updateRequestEncoding(encoding)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GET: %v", err)
+		// Not fatal since the encoding will be negotiated again by the next process
+		hctx.GetLogger().Infof("failed to persist the request encoding: %v", err)
 	}
-	req.Header.Set("X-Hishtory-Version", "v0."+Version)
-	resp, err := httpClient().Do(req)
+}
+
+func resetRequestEncoding() {
+	requestEncodingMutex.Lock()
+	defer requestEncodingMutex.Unlock()
+	requestEncoding = ""
+}
+
+func apiRequest(config hctx.ClientConfig, method, path, contentType string, reqBody []byte) ([]byte, http.Header, error) {
+	start := time.Now()
+	resp, err := openApiRequest(config, method, path, contentType, reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to GET %s%s: %v", getServerHostname(), path, err)
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to GET %s%s: status_code=%d", getServerHostname(), path, resp.StatusCode)
-	}
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body from GET %s%s: %v", getServerHostname(), path, err)
+		return nil, nil, fmt.Errorf("failed to read response body from %s %s%s: %w", method, getServerHostname(), path, err)
 	}
 	duration := time.Since(start)
-	hctx.GetLogger().Infof("ApiGet(%#v): %s\n", path, duration.String())
-	return respBody, nil
+	hctx.GetLogger().Infof("%s %#v: %s\n", method, path, duration.String())
+	return respBody, resp.Header, nil
 }
 
-func ApiPost(path, contentType string, data []byte) ([]byte, error) {
+// Makes a request to the backend and checks that it succeeded. The body of the returned response is decompressed
+// as it is read, so large responses can be streamed. The caller must close it.
+func openApiRequest(config hctx.ClientConfig, method, path, contentType string, reqBody []byte) (*http.Response, error) {
 	if os.Getenv("HISHTORY_SIMULATE_NETWORK_ERROR") != "" {
-		return nil, fmt.Errorf("simulated network error: dial tcp: lookup api.hishtory.dev")
+		return nil, fmt.Errorf("simulated network error: %w", &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "api.hishtory.dev", IsNotFound: true}})
 	}
-	start := time.Now()
-	req, err := http.NewRequest("POST", getServerHostname()+path, bytes.NewBuffer(data))
+	resp, err := doApiRequest(config, method, path, contentType, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s %s%s: %w", method, getServerHostname(), path, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized && canRegisterDevice(config) && !strings.HasPrefix(path, "/api/v1/register") {
+		// Devices that were registered before the backend required device tokens need to register their token, so
+		// register it and then retry the request. Any other authentication failure can't be fixed by registering.
+		apiErr := parseApiError(resp)
+		resp.Body.Close()
+		if apiErr.Code != shared.ErrorCodeDeviceTokenNotRegistered {
+			return nil, fmt.Errorf("failed to %s %s%s: %w", method, getServerHostname(), path, apiErr)
+		}
+		hctx.GetLogger().Infof("%s %s was unauthorized, registering the device token and retrying", method, path)
+		err = registerDevice(config)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = doApiRequest(config, method, path, contentType, reqBody)
+		if err != nil {
+			return nil, fmt.Errorf("failed to %s %s%s: %w", method, getServerHostname(), path, err)
+		}
+	}
+	setRequestEncoding(config, resp.Header.Get("Accept-Encoding"))
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("failed to %s %s%s: %w", method, getServerHostname(), path, parseApiError(resp))
+	}
+	body, err := shared.NewDecompressingReader(resp.Body, resp.Header.Get("Content-Encoding"), shared.MaxDecompressedSize)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to decompress response body from %s %s%s: %v", method, getServerHostname(), path, err)
+	}
+	resp.Body = decompressedBody{ReadCloser: body, underlying: resp.Body}
+	return resp, nil
+}
+
+// The most that is read of an error response body, since errors from proxies in front of the backend can be large
+const maxErrorBodySize = 64 * 1024
+
+// Reads the error that the backend responded with. Older backends respond with a plain text message rather than a
+// JSON shared.ApiError, in which case the error doesn't have a code.
+func parseApiError(resp *http.Response) *shared.ApiError {
+	apiErr := &shared.ApiError{StatusCode: resp.StatusCode}
+	body, err := shared.NewDecompressingReader(resp.Body, resp.Header.Get("Content-Encoding"), shared.MaxDecompressedSize)
+	if err != nil {
+		return apiErr
+	}
+	defer body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(body, maxErrorBodySize))
+	if err != nil {
+		return apiErr
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/json") {
+		err = json.Unmarshal(respBody, apiErr)
+		if err != nil {
+			hctx.GetLogger().Infof("failed to parse error response from the backend: %v", err)
+		}
+	} else if strings.HasPrefix(contentType, "text/plain") {
+		apiErr.Message = strings.TrimSpace(string(respBody))
+	}
+	return apiErr
+}
+
+// GetApiErrorCode returns the code of the error that the backend responded with, or "" if the error didn't come
+// from the backend
+func GetApiErrorCode(err error) string {
+	var apiErr *shared.ApiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+// GetLimitErrorMessage returns the backend's explanation if it rejected the request because one of its rate limits or
+// quotas was exceeded, or "" otherwise. Unlike being offline, this is worth telling the user about.
+func GetLimitErrorMessage(err error) string {
+	var apiErr *shared.ApiError
+	if errors.As(err, &apiErr) && (apiErr.Code == shared.ErrorCodeRateLimited || apiErr.Code == shared.ErrorCodeQuotaExceeded) {
+		return apiErr.Message
+	}
+	return ""
+}
+
+type decompressedBody struct {
+	io.ReadCloser
+	underlying io.Closer
+}
+
+func (d decompressedBody) Close() error {
+	d.ReadCloser.Close()
+	return d.underlying.Close()
+}
+
+func doApiRequest(config hctx.ClientConfig, method, path, contentType string, reqBody []byte) (*http.Response, error) {
+	var body io.Reader
+	contentEncoding := ""
+	if reqBody != nil {
+		if encoding := getRequestEncoding(config); encoding != shared.EncodingIdentity && len(reqBody) >= minCompressedRequestSize {
+			compressed, err := shared.Compress(reqBody, encoding)
+			if err != nil {
+				return nil, err
+			}
+			reqBody = compressed
+			contentEncoding = encoding
+		}
+		body = bytes.NewBuffer(reqBody)
+	}
+	req, err := http.NewRequest(method, getServerHostname()+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", method, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	req.Header.Set("Accept-Encoding", shared.SupportedEncodings)
+	req.Header.Set(shared.EntryEncodingsHeader, shared.EncodingZstd)
+	req.Header.Set("X-Hishtory-Version", "v0."+Version)
+	if canRegisterDevice(config) {
+		req.Header.Set("Authorization", "Bearer "+data.DeviceToken(config.UserSecret, config.DeviceId))
+	}
+	return httpClient().Do(req)
+}
+
+func canRegisterDevice(config hctx.ClientConfig) bool {
+	return config.UserSecret != "" && config.DeviceId != ""
+}
+
+// Registers the device with the backend. This is also used to register the device token for devices that were
+// registered before the backend required them, which doesn't create a new device.
+func registerDevice(config hctx.ClientConfig) error {
+	req, err := http.NewRequest("GET", getServerHostname()+"/api/v1/register?user_id="+data.UserId(config.UserSecret)+"&device_id="+config.DeviceId, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create POST: %v", err)
+		return fmt.Errorf("failed to create register request: %v", err)
 	}
-	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("X-Hishtory-Version", "v0."+Version)
+	req.Header.Set("Authorization", "Bearer "+data.DeviceToken(config.UserSecret, config.DeviceId))
+	req.Header.Set("X-Hishtory-User-Token", data.UserToken(config.UserSecret))
+	req.Header.Set(shared.EntryEncodingsHeader, shared.EncodingZstd)
 	resp, err := httpClient().Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to POST %s: %v", path, err)
+		return fmt.Errorf("failed to register device with backend: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to POST %s: status_code=%d", path, resp.StatusCode)
+		return fmt.Errorf("failed to register device with backend: %w", parseApiError(resp))
 	}
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body from POST %s: %v", path, err)
-	}
-	duration := time.Since(start)
-	hctx.GetLogger().Infof("ApiPost(%#v): %s\n", path, duration.String())
-	return respBody, nil
+	return nil
 }
 
 func IsOfflineError(err error) bool {
 	if err == nil {
 		return false
 	}
-	return strings.Contains(err.Error(), "dial tcp: lookup api.hishtory.dev") ||
-		strings.Contains(err.Error(), "connect: network is unreachable") ||
-		strings.Contains(err.Error(), "read: connection reset by peer") ||
-		strings.Contains(err.Error(), ": EOF") ||
-		strings.Contains(err.Error(), ": status_code=502") ||
-		strings.Contains(err.Error(), ": status_code=503") ||
-		strings.Contains(err.Error(), ": i/o timeout") ||
-		strings.Contains(err.Error(), "connect: operation timed out") ||
-		strings.Contains(err.Error(), "net/http: TLS handshake timeout")
+	var apiErr *shared.ApiError
+	if errors.As(err, &apiErr) {
+		// The request reached the backend (or a proxy in front of it), so we're only offline if it is unavailable or
+		// is asking us to back off
+		return apiErr.StatusCode == http.StatusBadGateway || apiErr.StatusCode == http.StatusServiceUnavailable || apiErr.StatusCode == http.StatusGatewayTimeout || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	// Otherwise, we're offline if the backend couldn't be reached at all (e.g. because DNS failed, the network is
+	// unreachable, or nothing is listening) or the connection failed part way through. This is checked by type rather
+	// than by message, so that it works for self-hosted backends too.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
 
 func ReliableDbCreate(db *gorm.DB, entry interface{}) error {
@@ -977,32 +1299,34 @@ func ReliableDbCreate(db *gorm.DB, entry interface{}) error {
 	for i = 0; i < 10; i++ {
 		result := db.Create(entry)
 		err = result.Error
-		if err != nil {
-			errMsg := err.Error()
-			if errMsg == "database is locked (5) (SQLITE_BUSY)" || errMsg == "database is locked (261)" {
-				time.Sleep(time.Duration(i*rand.Intn(100)) * time.Millisecond)
-				continue
-			}
-			if strings.Contains(errMsg, "UNIQUE constraint failed") {
-				if i == 0 {
-					return err
-				} else {
-					return nil
-				}
-			}
-			return fmt.Errorf("unrecoverable sqlite error: %v", err)
+		if err == nil {
+			return nil
+		}
+		errMsg := err.Error()
+		if errMsg == "database is locked (5) (SQLITE_BUSY)" || errMsg == "database is locked (261)" {
+			time.Sleep(time.Duration(i*rand.Intn(100)) * time.Millisecond)
+			continue
 		}
-		if err != nil && err.Error() != "database is locked (5) (SQLITE_BUSY)" {
-			return fmt.Errorf("unrecoverable sqlite error: %v", err)
+		if strings.Contains(errMsg, "UNIQUE constraint failed") {
+			if i == 0 {
+				return err
+			} else {
+				return nil
+			}
 		}
+		return fmt.Errorf("unrecoverable sqlite error: %v", err)
 	}
 	return fmt.Errorf("failed to create DB entry even with %d retries: %v", i, err)
 }
 
 func EncryptAndMarshal(config hctx.ClientConfig, entries []*data.HistoryEntry) ([]byte, error) {
 	var encEntries []shared.EncHistoryEntry
+	encrypt := data.EncryptHistoryEntry
+	if config.CompressEntries {
+		encrypt = data.EncryptCompressedHistoryEntry
+	}
 	for _, entry := range entries {
-		encEntry, err := data.EncryptHistoryEntry(config.UserSecret, *entry)
+		encEntry, err := encrypt(config.UserSecret, *entry)
 		if err != nil {
 			return nil, fmt.Errorf("failed to encrypt history entry")
 		}
@@ -1025,14 +1349,21 @@ func Reupload(ctx *context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to reupload due to failed search: %v", err)
 	}
-	for _, chunk := range shared.Chunks(entries, 100) {
+	return uploadEntries(config, entries)
+}
+
+// The number of entries uploaded per request when reuploading. Larger chunks compress better and take fewer requests.
+const REUPLOAD_CHUNK_SIZE = 1000
+
+func uploadEntries(config hctx.ClientConfig, entries []*data.HistoryEntry) error {
+	for _, chunk := range shared.Chunks(entries, REUPLOAD_CHUNK_SIZE) {
 		jsonValue, err := EncryptAndMarshal(config, chunk)
 		if err != nil {
 			return fmt.Errorf("failed to reupload due to failed encryption: %v", err)
 		}
-		_, err = ApiPost("/api/v1/submit?source_device_id="+config.DeviceId, "application/json", jsonValue)
+		_, err = ApiPost(config, "/api/v1/submit?source_device_id="+config.DeviceId+"&user_id="+data.UserId(config.UserSecret), "application/json", jsonValue)
 		if err != nil {
-			return fmt.Errorf("failed to reupload due to failed POST: %v", err)
+			return fmt.Errorf("failed to reupload due to failed POST: %w", err)
 		}
 	}
 	return nil
@@ -1044,34 +1375,106 @@ func RetrieveAdditionalEntriesFromRemote(ctx *context.Context) error {
 	if config.IsOffline {
 		return nil
 	}
-	respBody, err := ApiGet("/api/v1/query?device_id=" + config.DeviceId + "&user_id=" + data.UserId(config.UserSecret))
+	// Passing the cursor both requests only newer entries and acknowledges that every entry up to it has been
+	// persisted, so the backend can delete them
+	respBody, respHeader, err := apiRequest(config, "GET", "/api/v1/query?device_id="+config.DeviceId+"&user_id="+data.UserId(config.UserSecret)+"&after_seq="+strconv.FormatInt(config.SyncCursor, 10), "", nil)
 	if IsOfflineError(err) {
 		return nil
 	}
 	if err != nil {
 		return err
 	}
+	// Older backends don't say which encoding to use, in which case entries are never compressed
+	if entryEncoding := respHeader.Get(shared.EntryEncodingHeader); entryEncoding != "" {
+		err = updateCompressEntries(entryEncoding == shared.EncodingZstd)
+		if err != nil {
+			return err
+		}
+	}
 	var retrievedEntries []*shared.EncHistoryEntry
 	err = json.Unmarshal(respBody, &retrievedEntries)
 	if err != nil {
 		return fmt.Errorf("failed to load JSON response: %v", err)
 	}
+	cursor := config.SyncCursor
 	for _, entry := range retrievedEntries {
 		decEntry, err := data.DecryptHistoryEntry(config.UserSecret, *entry)
 		if err != nil {
 			return fmt.Errorf("failed to decrypt history entry from server: %v", err)
 		}
-		AddToDbIfNew(db, decEntry)
+		_, err = AddToDbIfNew(db, decEntry)
+		if err != nil {
+			return fmt.Errorf("failed to persist history entry from server: %v", err)
+		}
+		if entry.Seq > cursor {
+			cursor = entry.Seq
+		}
+	}
+	if cursor > config.SyncCursor {
+		err = updateSyncCursor(cursor)
+		if err != nil {
+			return err
+		}
 	}
 	return ProcessDeletionRequests(ctx)
 }
 
+// Persists the sync cursor. The config is re-read from disk rather than taken from the context so that a
+// concurrent invocation that already advanced the cursor isn't rolled back.
+func updateSyncCursor(cursor int64) error {
+	config, err := hctx.GetConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read config to update the sync cursor: %v", err)
+	}
+	if config.SyncCursor >= cursor {
+		return nil
+	}
+	config.SyncCursor = cursor
+	err = hctx.SetConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to persist the sync cursor: %v", err)
+	}
+	return nil
+}
+
+// Persists the encoding that the backend accepts for request bodies, re-reading the config from disk for the same
+// reason as updateSyncCursor
+func updateRequestEncoding(encoding string) error {
+	config, err := hctx.GetConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read config to update the request encoding: %v", err)
+	}
+	if config.RequestEncoding == encoding {
+		return nil
+	}
+	config.RequestEncoding = encoding
+	return hctx.SetConfig(config)
+}
+
+// Persists whether new entries should be compressed, re-reading the config from disk for the same reason as
+// updateSyncCursor
+func updateCompressEntries(compressEntries bool) error {
+	config, err := hctx.GetConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read config to update entry compression: %v", err)
+	}
+	if config.CompressEntries == compressEntries {
+		return nil
+	}
+	config.CompressEntries = compressEntries
+	err = hctx.SetConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to persist entry compression: %v", err)
+	}
+	return nil
+}
+
 func ProcessDeletionRequests(ctx *context.Context) error {
 	config := hctx.GetConf(ctx)
 	if config.IsOffline {
 		return nil
 	}
-	resp, err := ApiGet("/api/v1/get-deletion-requests?user_id=" + data.UserId(config.UserSecret) + "&device_id=" + config.DeviceId)
+	resp, err := ApiGet(config, "/api/v1/get-deletion-requests?user_id="+data.UserId(config.UserSecret)+"&device_id="+config.DeviceId)
 	if IsOfflineError(err) {
 		return nil
 	}
@@ -1101,55 +1504,418 @@ func GetBanner(ctx *context.Context) ([]byte, error) {
 		return []byte{}, nil
 	}
 	url := "/api/v1/banner?commit_hash=" + GitCommit + "&user_id=" + data.UserId(config.UserSecret) + "&device_id=" + config.DeviceId + "&version=" + Version + "&forced_banner=" + os.Getenv("FORCED_BANNER")
-	return ApiGet(url)
+	return ApiGet(config, url)
 }
 
 func parseTimeGenerously(input string) (time.Time, error) {
-	input = strings.ReplaceAll(input, "_", " ")
-	return dateparse.ParseLocal(input)
+	return parseTimeRelativeTo(input, time.Now())
 }
 
-func MakeWhereQueryFromSearch(ctx *context.Context, db *gorm.DB, query string) (*gorm.DB, error) {
-	tokens, err := tokenize(query)
+var relativeTimeRegex = regexp.MustCompile(`^(\d+)\s*(s|secs?|seconds?|m|mins?|minutes?|h|hrs?|hours?|d|days?|w|wks?|weeks?|mo|months?|y|yrs?|years?)(\s+ago)?$`)
+
+// Parses a timestamp which may either be an absolute date (in nearly any format), a relative time
+// such as `2h` or `3 days ago`, or a phrase such as `yesterday` or `last monday`. Underscores are
+// treated as spaces so that multi-word phrases can be written without quoting.
+func parseTimeRelativeTo(input string, now time.Time) (time.Time, error) {
+	input = strings.TrimSpace(strings.ReplaceAll(input, "_", " "))
+	normalized := strings.ToLower(strings.Join(strings.Fields(input), " "))
+	startOfToday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch normalized {
+	case "now":
+		return now, nil
+	case "today":
+		return startOfToday, nil
+	case "yesterday":
+		return startOfToday.AddDate(0, 0, -1), nil
+	case "last week":
+		return now.AddDate(0, 0, -7), nil
+	case "last month":
+		return now.AddDate(0, -1, 0), nil
+	case "last year":
+		return now.AddDate(-1, 0, 0), nil
+	}
+	if weekday, ok := parseWeekday(strings.TrimPrefix(normalized, "last ")); ok {
+		// The most recent occurrence of that day, not including today
+		daysAgo := (int(now.Weekday())-int(weekday)+6)%7 + 1
+		return startOfToday.AddDate(0, 0, -daysAgo), nil
+	}
+	if matches := relativeTimeRegex.FindStringSubmatch(normalized); matches != nil {
+		n, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch unit := matches[2]; {
+		case unit == "mo" || strings.HasPrefix(unit, "month"):
+			return now.AddDate(0, -n, 0), nil
+		case strings.HasPrefix(unit, "y"):
+			return now.AddDate(-n, 0, 0), nil
+		case strings.HasPrefix(unit, "w"):
+			return now.AddDate(0, 0, -7*n), nil
+		case strings.HasPrefix(unit, "d"):
+			return now.AddDate(0, 0, -n), nil
+		case strings.HasPrefix(unit, "h"):
+			return now.Add(-time.Duration(n) * time.Hour), nil
+		case strings.HasPrefix(unit, "m"):
+			return now.Add(-time.Duration(n) * time.Minute), nil
+		default:
+			return now.Add(-time.Duration(n) * time.Second), nil
+		}
+	}
+	if d, err := time.ParseDuration(normalized); err == nil {
+		// Compound durations like 1h30m
+		return now.Add(-d), nil
+	}
+	t, err := dateparse.ParseIn(input, now.Location())
 	if err != nil {
-		return nil, fmt.Errorf("failed to tokenize query: %v", err)
+		return time.Time{}, fmt.Errorf("%q is not a recognized time (expected a date like 2024-03-01, a relative time like 2h or 3d, or a phrase like yesterday or last_monday)", input)
 	}
-	tx := db.Model(&data.HistoryEntry{}).Where("true")
-	for _, token := range tokens {
-		if strings.HasPrefix(token, "-") {
-			if token == "-" {
-				// The entire token is a -, just ignore this token. Otherwise we end up
-				// interpreting "-" as exluding literally all results which is pretty useless.
-				continue
-			}
-			if containsUnescaped(token, ":") {
-				query, v1, v2, err := parseAtomizedToken(ctx, token[1:])
-				if err != nil {
-					return nil, err
-				}
-				tx = tx.Where("NOT "+query, v1, v2)
+	return t, nil
+}
+
+// Parses a time range for a `during:` atom, returning the inclusive start and the exclusive end of the range.
+// Supports years (2024), months (2024-03), days (2024-03-05 or yesterday) and phrases like `this week`.
+func parseTimeRangeRelativeTo(input string, now time.Time) (time.Time, time.Time, error) {
+	input = strings.TrimSpace(strings.ReplaceAll(input, "_", " "))
+	normalized := strings.ToLower(strings.Join(strings.Fields(input), " "))
+	startOfToday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	startOfWeek := startOfToday.AddDate(0, 0, -((int(now.Weekday()) + 6) % 7))
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	startOfYear := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
+	switch normalized {
+	case "this week":
+		return startOfWeek, startOfWeek.AddDate(0, 0, 7), nil
+	case "last week":
+		return startOfWeek.AddDate(0, 0, -7), startOfWeek, nil
+	case "this month":
+		return startOfMonth, startOfMonth.AddDate(0, 1, 0), nil
+	case "last month":
+		return startOfMonth.AddDate(0, -1, 0), startOfMonth, nil
+	case "this year":
+		return startOfYear, startOfYear.AddDate(1, 0, 0), nil
+	case "last year":
+		return startOfYear.AddDate(-1, 0, 0), startOfYear, nil
+	}
+	for _, layout := range []struct {
+		format string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006", 1, 0, 0},
+		{"2006-01", 0, 1, 0},
+		{"2006-01-02", 0, 0, 1},
+	} {
+		if t, err := time.ParseInLocation(layout.format, normalized, now.Location()); err == nil {
+			return t, t.AddDate(layout.years, layout.months, layout.days), nil
+		}
+	}
+	if normalized == "today" || normalized == "yesterday" {
+		t, err := parseTimeRelativeTo(normalized, now)
+		return t, t.AddDate(0, 0, 1), err
+	}
+	if _, ok := parseWeekday(strings.TrimPrefix(normalized, "last ")); ok {
+		t, err := parseTimeRelativeTo(normalized, now)
+		return t, t.AddDate(0, 0, 1), err
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("%q is not a recognized time range (expected a year like 2024, a month like 2024-03, a day like 2024-03-05 or yesterday, or a phrase like this_week or last_month)", input)
+}
+
+func parseWeekday(input string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if input == name || input == name[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// A node in the AST for a search query. Each node compiles down to a SQL fragment (with
+// placeholders) and the corresponding arguments for the placeholders. hasFtsIndex is whether
+// free text search terms can use the full-text search index, which is checked once per query.
+type queryNode interface {
+	compile(ctx *context.Context, hasFtsIndex bool) (string, []interface{}, error)
+}
+
+// A list of nodes that must all match. Adjacent search terms are implicitly ANDed together.
+type andNode struct {
+	children []queryNode
+}
+
+// A list of nodes where at least one must match.
+type orNode struct {
+	children []queryNode
+}
+
+// A node that must not match, created via a `-` prefix.
+type notNode struct {
+	child queryNode
+}
+
+// A single search term, either an atom like `cwd:/tmp/` or a free text search like `ls`.
+type termNode struct {
+	token string
+}
+
+func compileChildren(ctx *context.Context, hasFtsIndex bool, children []queryNode, operator string) (string, []interface{}, error) {
+	clauses := make([]string, 0)
+	args := make([]interface{}, 0)
+	for _, child := range children {
+		clause, childArgs, err := child.compile(ctx, hasFtsIndex)
+		if err != nil {
+			return "", nil, err
+		}
+		clauses = append(clauses, clause)
+		args = append(args, childArgs...)
+	}
+	return "(" + strings.Join(clauses, " "+operator+" ") + ")", args, nil
+}
+
+func (n andNode) compile(ctx *context.Context, hasFtsIndex bool) (string, []interface{}, error) {
+	if len(n.children) == 0 {
+		return "(true)", []interface{}{}, nil
+	}
+	return compileChildren(ctx, hasFtsIndex, n.children, "AND")
+}
+
+func (n orNode) compile(ctx *context.Context, hasFtsIndex bool) (string, []interface{}, error) {
+	if len(n.children) == 0 {
+		return "(false)", []interface{}{}, nil
+	}
+	return compileChildren(ctx, hasFtsIndex, n.children, "OR")
+}
+
+func (n notNode) compile(ctx *context.Context, hasFtsIndex bool) (string, []interface{}, error) {
+	clause, args, err := n.child.compile(ctx, hasFtsIndex)
+	if err != nil {
+		return "", nil, err
+	}
+	return "(NOT " + clause + ")", args, nil
+}
+
+func (n termNode) compile(ctx *context.Context, hasFtsIndex bool) (string, []interface{}, error) {
+	if containsUnescaped(n.token, ":") {
+		return parseAtomizedToken(ctx, n.token)
+	}
+	return parseNonAtomizedToken(n.token, hasFtsIndex)
+}
+
+// The types of tokens that are produced by lexQuery
+const (
+	queryTokenTerm = iota
+	queryTokenOpenParen
+	queryTokenCloseParen
+	queryTokenOr
+	queryTokenAnd
+	queryTokenNegation
+)
+
+type queryToken struct {
+	kind int
+	// The raw (still escaped) text of the token. Only set for queryTokenTerm.
+	value string
+}
+
+// Splits the query into a stream of tokens for parseQuery. Unescaped parentheses at the start
+// of a word open a group and unescaped parentheses at the end of a word close a group, so that
+// commands like `echo $(date)` can still be searched for without escaping.
+func lexQuery(query string) ([]queryToken, error) {
+	words, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]queryToken, 0)
+	depth := 0
+	for _, word := range words {
+		for {
+			if strings.HasPrefix(word, "(") {
+				tokens = append(tokens, queryToken{kind: queryTokenOpenParen})
+				word = word[1:]
+				depth += 1
+			} else if strings.HasPrefix(word, "-(") {
+				tokens = append(tokens, queryToken{kind: queryTokenNegation}, queryToken{kind: queryTokenOpenParen})
+				word = word[2:]
+				depth += 1
 			} else {
-				query, v1, v2, v3, err := parseNonAtomizedToken(token[1:])
-				if err != nil {
-					return nil, err
-				}
-				tx = tx.Where("NOT "+query, v1, v2, v3)
-			}
-		} else if containsUnescaped(token, ":") {
-			query, v1, v2, err := parseAtomizedToken(ctx, token)
-			if err != nil {
-				return nil, err
+				break
 			}
-			tx = tx.Where(query, v1, v2)
-		} else {
-			query, v1, v2, v3, err := parseNonAtomizedToken(token)
-			if err != nil {
-				return nil, err
+		}
+		numClosingParens := 0
+		for depth > 0 && strings.HasSuffix(word, ")") && !strings.HasSuffix(word, "\\)") {
+			word = word[:len(word)-1]
+			numClosingParens += 1
+			depth -= 1
+		}
+		switch word {
+		case "":
+		case "OR", "||":
+			tokens = append(tokens, queryToken{kind: queryTokenOr})
+		case "AND", "&&":
+			tokens = append(tokens, queryToken{kind: queryTokenAnd})
+		default:
+			tokens = append(tokens, queryToken{kind: queryTokenTerm, value: word})
+		}
+		for i := 0; i < numClosingParens; i++ {
+			tokens = append(tokens, queryToken{kind: queryTokenCloseParen})
+		}
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() *queryToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+// Parses an expression of the form `term OR term OR ...`. OR binds less tightly than AND.
+func (p *queryParser) parseOr() (queryNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []queryNode{first}
+	for p.peek() != nil && p.peek().kind == queryTokenOr {
+		if isEmptyNode(children[len(children)-1]) {
+			return nil, fmt.Errorf("search query contains an OR that isn't preceded by a search term")
+		}
+		p.pos += 1
+		if p.peek() == nil || p.peek().kind == queryTokenCloseParen || p.peek().kind == queryTokenOr {
+			return nil, fmt.Errorf("search query contains an OR that isn't followed by a search term")
+		}
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return orNode{children: children}, nil
+}
+
+// Parses an expression of the form `term term AND term ...`.
+func (p *queryParser) parseAnd() (queryNode, error) {
+	children := make([]queryNode, 0)
+	for {
+		token := p.peek()
+		if token == nil || token.kind == queryTokenOr || token.kind == queryTokenCloseParen {
+			break
+		}
+		if token.kind == queryTokenAnd {
+			p.pos += 1
+			continue
+		}
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return andNode{children: children}, nil
+}
+
+// Parses a single (possibly negated) search term or a parenthesized group.
+func (p *queryParser) parseUnary() (queryNode, error) {
+	token := p.peek()
+	p.pos += 1
+	switch token.kind {
+	case queryTokenNegation:
+		if p.peek() == nil {
+			return nil, nil
+		}
+		child, err := p.parseUnary()
+		if err != nil || child == nil {
+			return nil, err
+		}
+		return notNode{child: child}, nil
+	case queryTokenOpenParen:
+		child, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		// Any unclosed groups are implicitly closed at the end of the query so that partially typed
+		// queries in the TUI still return results.
+		if p.peek() != nil && p.peek().kind == queryTokenCloseParen {
+			p.pos += 1
+		}
+		if isEmptyNode(child) {
+			return nil, nil
+		}
+		return child, nil
+	case queryTokenTerm:
+		if strings.HasPrefix(token.value, "-") {
+			if token.value == "-" {
+				// The entire token is a -, just ignore this token. Otherwise we end up
+				// interpreting "-" as exluding literally all results which is pretty useless.
+				return nil, nil
 			}
-			tx = tx.Where(query, v1, v2, v3)
+			return notNode{child: termNode{token: token.value[1:]}}, nil
 		}
+		return termNode{token: token.value}, nil
+	default:
+		return nil, fmt.Errorf("search query contains an unexpected token at position %d", p.pos)
+	}
+}
+
+func isEmptyNode(node queryNode) bool {
+	and, ok := node.(andNode)
+	return ok && len(and.children) == 0
+}
+
+// Parses a search query into an AST. The grammar is:
+//
+//	query := and ("OR" and)*
+//	and   := unary (["AND"] unary)*
+//	unary := "-" unary | "(" query ")" | term
+func parseQuery(query string) (queryNode, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	p := queryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != nil {
+		return nil, fmt.Errorf("search query contains an unmatched closing parenthesis")
+	}
+	return node, nil
+}
+
+func MakeWhereQueryFromSearch(ctx *context.Context, db *gorm.DB, query string) (*gorm.DB, error) {
+	// Sorting doesn't affect which entries match
+	_, query, err := extractSortOrder(query)
+	if err != nil {
+		return nil, err
+	}
+	ast, err := parseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %v", err)
+	}
+	hasFtsIndex, err := hctx.HasFullTextSearchIndex(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for the full-text search index: %v", err)
+	}
+	clause, args, err := ast.compile(ctx, hasFtsIndex)
+	if err != nil {
+		return nil, err
 	}
-	return tx, nil
+	tx := db.Model(&data.HistoryEntry{}).Where("true")
+	return tx.Where(clause, args...), nil
 }
 
 func Search(ctx *context.Context, db *gorm.DB, query string, limit int) ([]*data.HistoryEntry, error) {
@@ -1157,11 +1923,15 @@ func Search(ctx *context.Context, db *gorm.DB, query string, limit int) ([]*data
 		return nil, fmt.Errorf("lib.Search called with a nil context and a non-empty query (this should never happen)")
 	}
 
+	sortOrder, query, err := extractSortOrder(query)
+	if err != nil {
+		return nil, err
+	}
 	tx, err := MakeWhereQueryFromSearch(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
-	tx = tx.Order("end_time DESC")
+	tx = tx.Order(sortOrderSql[sortOrder])
 	if limit > 0 {
 		tx = tx.Limit(limit)
 	}
@@ -1173,38 +1943,130 @@ func Search(ctx *context.Context, db *gorm.DB, query string, limit int) ([]*data
 	return historyEntries, nil
 }
 
-func parseNonAtomizedToken(token string) (string, interface{}, interface{}, interface{}, error) {
-	wildcardedToken := "%" + unescape(token) + "%"
-	return "(command LIKE ? OR hostname LIKE ? OR current_working_directory LIKE ?)", wildcardedToken, wildcardedToken, wildcardedToken, nil
+// The orderings supported by the sort: atom. The first one is the default.
+var SORT_ORDERS = []string{"recent", "frequency", "frecency", "runtime", "exit_code"}
+
+// The ORDER BY clause for each sort order. Ties are broken by recency, and entries for the same command are kept
+// adjacent when sorting by frequency or frecency so that duplicates can be filtered out.
+var sortOrderSql = map[string]string{
+	"":          "end_time DESC",
+	"recent":    "end_time DESC",
+	"frequency": "COUNT(*) OVER (PARTITION BY command) DESC, MAX(end_time) OVER (PARTITION BY command) DESC, command, end_time DESC",
+	// Each use of a command contributes to its score, with older uses contributing less
+	"frecency":  "SUM(1.0 / (1.0 + julianday('now') - julianday(end_time))) OVER (PARTITION BY command) DESC, MAX(end_time) OVER (PARTITION BY command) DESC, command, end_time DESC",
+	"runtime":   "ROUND((julianday(end_time) - julianday(start_time)) * 86400000) DESC, end_time DESC",
+	"exit_code": "exit_code DESC, end_time DESC",
 }
 
-func parseAtomizedToken(ctx *context.Context, token string) (string, interface{}, interface{}, error) {
+// Removes any top-level sort: atoms from the query, returning the requested sort order (or an empty string if
+// none was requested) and the remainder of the query. If there are multiple sort: atoms, the last one wins.
+func extractSortOrder(query string) (string, string, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return "", "", err
+	}
+	sortOrder := ""
+	remainingTokens := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		splitToken := splitEscaped(token, ':', 2)
+		if len(splitToken) == 2 && unescape(splitToken[0]) == "sort" {
+			sortOrder = strings.ToLower(unescape(splitToken[1]))
+			if _, ok := sortOrderSql[sortOrder]; !ok || sortOrder == "" {
+				return "", "", fmt.Errorf("unknown sort order sort:%s (expected one of: %s)", unescape(splitToken[1]), strings.Join(SORT_ORDERS, ", "))
+			}
+			continue
+		}
+		remainingTokens = append(remainingTokens, token)
+	}
+	return sortOrder, strings.Join(remainingTokens, " "), nil
+}
+
+func parseNonAtomizedToken(token string, hasFtsIndex bool) (string, []interface{}, error) {
+	val := unescape(token)
+	// The trigram tokenizer used by the full-text search index can only match strings of at least 3 characters
+	if hasFtsIndex && len([]rune(val)) >= 3 {
+		phrase := "\"" + strings.ReplaceAll(val, "\"", "\"\"") + "\""
+		return "(rowid IN (SELECT rowid FROM " + hctx.FtsTableName + " WHERE " + hctx.FtsTableName + " MATCH ?))", []interface{}{phrase}, nil
+	}
+	wildcardedToken := "%" + val + "%"
+	return "(command LIKE ? OR hostname LIKE ? OR current_working_directory LIKE ?)", []interface{}{wildcardedToken, wildcardedToken, wildcardedToken}, nil
+}
+
+func parseAtomizedToken(ctx *context.Context, token string) (string, []interface{}, error) {
 	splitToken := splitEscaped(token, ':', 2)
 	field := unescape(splitToken[0])
+	if isQuotedAtomValue(splitToken[1]) {
+		splitToken[1] = splitToken[1][1 : len(splitToken[1])-1]
+	}
 	val := unescape(splitToken[1])
 	switch field {
+	case "regex", "command~":
+		re, err := parseRegexAtom(field, splitToken[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return "(command REGEXP ?)", []interface{}{re}, nil
+	case "host~", "hostname~":
+		re, err := parseRegexAtom(field, splitToken[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return "(hostname REGEXP ?)", []interface{}{re}, nil
+	case "cwd~":
+		re, err := parseRegexAtom(field, splitToken[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return "(current_working_directory REGEXP ? OR REPLACE(current_working_directory, '~/', home_directory) REGEXP ?)", []interface{}{re, re}, nil
+	case "sort":
+		return "", nil, fmt.Errorf("sort:%s can't be used inside of a group or negated", val)
 	case "user":
-		return "(local_username = ?)", val, nil, nil
+		return "(local_username = ?)", []interface{}{val}, nil
 	case "host":
 		fallthrough
 	case "hostname":
-		return "(instr(hostname, ?) > 0)", val, nil, nil
+		return "(instr(hostname, ?) > 0)", []interface{}{val}, nil
 	case "cwd":
-		return "(instr(current_working_directory, ?) > 0 OR instr(REPLACE(current_working_directory, '~/', home_directory), ?) > 0)", strings.TrimSuffix(val, "/"), strings.TrimSuffix(val, "/"), nil
+		return "(instr(current_working_directory, ?) > 0 OR instr(REPLACE(current_working_directory, '~/', home_directory), ?) > 0)", []interface{}{strings.TrimSuffix(val, "/"), strings.TrimSuffix(val, "/")}, nil
 	case "exit_code":
-		return "(exit_code = ?)", val, nil, nil
+		op, operand := parseComparison(val)
+		if op == "" {
+			return "(exit_code = ?)", []interface{}{val}, nil
+		}
+		exitCode, err := strconv.Atoi(operand)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse exit_code:%s as a number: %v", val, err)
+		}
+		return "(exit_code " + op + " ?)", []interface{}{exitCode}, nil
+	case "runtime":
+		op, operand := parseComparison(val)
+		if op == "" {
+			return "", nil, fmt.Errorf("runtime:%s is missing a comparison operator (e.g. runtime:>30s or runtime:<100ms)", val)
+		}
+		runtime, err := parseRuntime(operand)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse runtime:%s as a duration: %v", val, err)
+		}
+		// Compare at millisecond granularity (the same as is displayed) to avoid floating point errors from julianday
+		return "(ROUND((julianday(end_time) - julianday(start_time)) * 86400000) " + op + " ?)", []interface{}{runtime.Milliseconds()}, nil
 	case "before":
 		t, err := parseTimeGenerously(val)
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to parse before:%s as a timestamp: %v", val, err)
+			return "", nil, fmt.Errorf("failed to parse before:%s as a timestamp: %v", val, err)
 		}
-		return "(CAST(strftime(\"%s\",start_time) AS INTEGER) < ?)", t.Unix(), nil, nil
+		return "(CAST(strftime(\"%s\",start_time) AS INTEGER) < ?)", []interface{}{t.Unix()}, nil
 	case "after":
 		t, err := parseTimeGenerously(val)
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to parse after:%s as a timestamp: %v", val, err)
+			return "", nil, fmt.Errorf("failed to parse after:%s as a timestamp: %v", val, err)
 		}
-		return "(CAST(strftime(\"%s\",start_time) AS INTEGER) > ?)", t.Unix(), nil, nil
+		return "(CAST(strftime(\"%s\",start_time) AS INTEGER) > ?)", []interface{}{t.Unix()}, nil
+	case "during":
+		start, end, err := parseTimeRangeRelativeTo(val, time.Now())
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse during:%s as a time range: %v", val, err)
+		}
+		return "(CAST(strftime(\"%s\",start_time) AS INTEGER) >= ? AND CAST(strftime(\"%s\",start_time) AS INTEGER) < ?)", []interface{}{start.Unix(), end.Unix()}, nil
 	default:
 		knownCustomColumns := make([]string, 0)
 		// Get custom columns that are defined on this machine
@@ -1215,7 +2077,7 @@ func parseAtomizedToken(ctx *context.Context, token string) (string, interface{}
 		// Also get all ones that are in the DB
 		names, err := getAllCustomColumnNames(ctx)
 		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to get custom column names from the DB: %v", err)
+			return "", nil, fmt.Errorf("failed to get custom column names from the DB: %v", err)
 		}
 		knownCustomColumns = append(knownCustomColumns, names...)
 		// Check if the atom is for a custom column that exists and if it isn't, return an error
@@ -1226,13 +2088,54 @@ func parseAtomizedToken(ctx *context.Context, token string) (string, interface{}
 			}
 		}
 		if !isCustomColumn {
-			return "", nil, nil, fmt.Errorf("search query contains unknown search atom '%s' that doesn't match any column names", field)
+			return "", nil, fmt.Errorf("search query contains unknown search atom '%s' that doesn't match any column names", field)
+		}
+		// Build the where clause for the custom column, using a numeric comparison if one was requested
+		op, operand := parseComparison(val)
+		if num, err := strconv.ParseFloat(operand, 64); op != "" && err == nil {
+			return "EXISTS (SELECT 1 FROM json_each(custom_columns) WHERE json_extract(value, '$.name') = ? AND " + isNumericSql("trim(json_extract(value, '$.value'))") + " AND CAST(trim(json_extract(value, '$.value')) AS REAL) " + op + " ?)", []interface{}{field, num}, nil
 		}
-		// Build the where clause for the custom column
-		return "EXISTS (SELECT 1 FROM json_each(custom_columns) WHERE json_extract(value, '$.name') = ? and instr(json_extract(value, '$.value'), ?) > 0)", field, val, nil
+		return "EXISTS (SELECT 1 FROM json_each(custom_columns) WHERE json_extract(value, '$.name') = ? and instr(json_extract(value, '$.value'), ?) > 0)", []interface{}{field, val}, nil
 	}
 }
 
+// Splits a value like `>=30` into the SQL comparison operator and the operand. The operator is empty if the
+// value doesn't start with one.
+func parseComparison(val string) (string, string) {
+	for _, op := range []string{">=", "<=", "!=", ">", "<", "="} {
+		if strings.HasPrefix(val, op) {
+			return op, strings.TrimPrefix(val, op)
+		}
+	}
+	return "", val
+}
+
+// Parses a runtime such as `30s` or `1m30s`. A bare number is treated as a number of seconds.
+func parseRuntime(val string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(val, 64)
+	if err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(val)
+}
+
+// Returns a SQL expression that checks whether the given SQL expression is a plain decimal number, since
+// sqlite will happily cast any string (e.g. `v1.2`) to a number.
+func isNumericSql(expr string) string {
+	return "(" + expr + " != '' AND " + expr + " GLOB '*[0-9]*' AND ltrim(" + expr + ", '-') NOT GLOB '*[^0-9.]*' AND " + expr + " NOT GLOB '*.*.*')"
+}
+
+// Parses the value of a regex atom like `command~:^git`. Unlike other atoms, backslashes are
+// preserved (apart from escaped spaces) since they are meaningful in regexes.
+func parseRegexAtom(field, rawVal string) (string, error) {
+	re := strings.ReplaceAll(rawVal, "\\ ", " ")
+	_, err := regexp.Compile(re)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s:%s as a regex: %v", field, re, err)
+	}
+	return re, nil
+}
+
 func getAllCustomColumnNames(ctx *context.Context) ([]string, error) {
 	db := hctx.GetDb(ctx)
 	query := `
@@ -1261,7 +2164,39 @@ func tokenize(query string) ([]string, error) {
 	if query == "" {
 		return []string{}, nil
 	}
-	return splitEscaped(query, ' ', -1), nil
+	return joinQuotedAtomValues(splitEscaped(query, ' ', -1)), nil
+}
+
+// Rejoins atoms with double quoted values that contain spaces (e.g. `before:"last monday"`) into a single token.
+// An unterminated quote is left as is.
+func joinQuotedAtomValues(tokens []string) []string {
+	joinedTokens := make([]string, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		splitToken := splitEscaped(token, ':', 2)
+		if len(splitToken) != 2 || !strings.HasPrefix(splitToken[1], "\"") || isQuotedAtomValue(splitToken[1]) {
+			joinedTokens = append(joinedTokens, token)
+			continue
+		}
+		end := -1
+		for j := i + 1; j < len(tokens); j++ {
+			if strings.HasSuffix(strings.TrimRight(tokens[j], ")"), "\"") {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			joinedTokens = append(joinedTokens, token)
+			continue
+		}
+		joinedTokens = append(joinedTokens, strings.Join(tokens[i:end+1], " "))
+		i = end
+	}
+	return joinedTokens
+}
+
+func isQuotedAtomValue(val string) bool {
+	return len(val) >= 2 && strings.HasPrefix(val, "\"") && strings.HasSuffix(val, "\"")
 }
 
 func splitEscaped(query string, separator rune, maxSplit int) []string {
@@ -1315,7 +2250,7 @@ func GetDumpRequests(config hctx.ClientConfig) ([]*shared.DumpRequest, error) {
 	if config.IsOffline {
 		return make([]*shared.DumpRequest, 0), nil
 	}
-	resp, err := ApiGet("/api/v1/get-dump-requests?user_id=" + data.UserId(config.UserSecret) + "&device_id=" + config.DeviceId)
+	resp, err := ApiGet(config, "/api/v1/get-dump-requests?user_id="+data.UserId(config.UserSecret)+"&device_id="+config.DeviceId)
 	if IsOfflineError(err) {
 		return []*shared.DumpRequest{}, nil
 	}
@@ -1327,12 +2262,13 @@ func GetDumpRequests(config hctx.ClientConfig) ([]*shared.DumpRequest, error) {
 	return dumpRequests, err
 }
 
-func SendDeletionRequest(deletionRequest shared.DeletionRequest) error {
-	data, err := json.Marshal(deletionRequest)
+func SendDeletionRequest(ctx *context.Context, deletionRequest shared.DeletionRequest) error {
+	config := hctx.GetConf(ctx)
+	reqBody, err := json.Marshal(deletionRequest)
 	if err != nil {
 		return err
 	}
-	_, err = ApiPost("/api/v1/add-deletion-request", "application/json", data)
+	_, err = ApiPost(config, "/api/v1/add-deletion-request?user_id="+data.UserId(config.UserSecret)+"&device_id="+config.DeviceId, "application/json", reqBody)
 	if err != nil {
 		return fmt.Errorf("failed to send deletion request to backend service, this may cause commands to not get deleted on other instances of hishtory: %v", err)
 	}
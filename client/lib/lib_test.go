@@ -1,6 +1,14 @@
 package lib
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/user"
 	"path"
@@ -13,6 +21,7 @@ import (
 	"github.com/ddworken/hishtory/client/hctx"
 	"github.com/ddworken/hishtory/shared"
 	"github.com/ddworken/hishtory/shared/testutils"
+	"github.com/go-test/deep"
 )
 
 func TestSetup(t *testing.T) {
@@ -428,6 +437,38 @@ func TestChunks(t *testing.T) {
 		}
 	}
 }
+
+func TestParseShellHistory(t *testing.T) {
+	actual := parseShellHistory([]string{
+		": 1666062975:0;bash",
+		": 1666062980:12;make build",
+		"ls",
+		"#1664342754",
+		"echo foo",
+		"#1664342760",
+		"#1664342761 ",
+		"echo bar",
+		"echo baz",
+		"\x00\x00: 1666062990:0;git status",
+		": 16660:0;pwd",
+		"0",
+	})
+	expected := []importedCommand{
+		{command: "bash", startTime: time.Unix(1666062975, 0)},
+		{command: "make build", startTime: time.Unix(1666062980, 0), duration: 12 * time.Second},
+		{command: "ls"},
+		{command: "echo foo", startTime: time.Unix(1664342754, 0)},
+		{command: "echo bar", startTime: time.Unix(1664342761, 0)},
+		{command: "echo baz"},
+		{command: "git status", startTime: time.Unix(1666062990, 0)},
+		{command: "pwd", startTime: time.Unix(16660, 0)},
+		{command: "0"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("parseShellHistory returned %#v, expected %#v", actual, expected)
+	}
+}
+
 func TestZshWeirdness(t *testing.T) {
 	testcases := []struct {
 		input  string
@@ -435,18 +476,47 @@ func TestZshWeirdness(t *testing.T) {
 	}{
 		{": 1666062975:0;bash", "bash"},
 		{": 16660:0;ls", "ls"},
+		{": 1666062975:0;ls", "ls"},
+		{": 1666062975:125;sleep 125", "sleep 125"},
+		{"garbage: 1666062975:0;ls", "ls"},
 		{"ls", "ls"},
 		{"0", "0"},
 		{"hgffddxsdsrzsz xddfgdxfdv gdfc ghcvhgfcfg vgv", "hgffddxsdsrzsz xddfgdxfdv gdfc ghcvhgfcfg vgv"},
 	}
 	for _, tc := range testcases {
-		actual := stripZshWeirdness(tc.input)
-		if !reflect.DeepEqual(actual, tc.output) {
-			t.Fatalf("weirdness failure for %#v", tc.input)
+		actual := parseShellHistory([]string{tc.input})
+		if len(actual) != 1 || actual[0].command != tc.output {
+			t.Fatalf("weirdness failure for %#v: %#v", tc.input, actual)
 		}
 	}
 }
 
+func TestParseFishHistory(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	homedir, err := os.UserHomeDir()
+	testutils.Check(t, err)
+	testutils.Check(t, os.MkdirAll(path.Join(homedir, ".local/share/fish"), 0o755))
+	testutils.Check(t, os.WriteFile(path.Join(homedir, ".local/share/fish/fish_history"), []byte(`- cmd: ls
+  when: 1664342754
+- cmd: cat foo.txt bar.txt
+  when: 1664342760
+  paths:
+    - foo.txt
+    - bar.txt
+- cmd: echo hi
+`), 0o644))
+	actual, err := parseFishHistory(homedir)
+	testutils.Check(t, err)
+	expected := []importedCommand{
+		{command: "ls", startTime: time.Unix(1664342754, 0)},
+		{command: "cat foo.txt bar.txt", startTime: time.Unix(1664342760, 0), customColumns: data.CustomColumns{{Name: "fish_paths", Val: "foo.txt bar.txt"}}},
+		{command: "echo hi"},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("parseFishHistory returned %#v, expected %#v", actual, expected)
+	}
+}
+
 func TestParseTimeGenerously(t *testing.T) {
 	ts, err := parseTimeGenerously("2006-01-02T15:04:00-08:00")
 	testutils.Check(t, err)
@@ -495,6 +565,118 @@ func TestParseTimeGenerously(t *testing.T) {
 	}
 }
 
+func TestParseRelativeTime(t *testing.T) {
+	// Wednesday
+	now := time.Date(2024, 3, 13, 15, 30, 0, 0, time.UTC)
+	testcases := []struct {
+		input    string
+		expected time.Time
+	}{
+		{"now", now},
+		{"2h", now.Add(-2 * time.Hour)},
+		{"90m", now.Add(-90 * time.Minute)},
+		{"1h30m", now.Add(-90 * time.Minute)},
+		{"3d", time.Date(2024, 3, 10, 15, 30, 0, 0, time.UTC)},
+		{"2w", time.Date(2024, 2, 28, 15, 30, 0, 0, time.UTC)},
+		{"1mo", time.Date(2024, 2, 13, 15, 30, 0, 0, time.UTC)},
+		{"3_days_ago", time.Date(2024, 3, 10, 15, 30, 0, 0, time.UTC)},
+		{"5 minutes ago", now.Add(-5 * time.Minute)},
+		{"today", time.Date(2024, 3, 13, 0, 0, 0, 0, time.UTC)},
+		{"Yesterday", time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC)},
+		{"last monday", time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"last_wednesday", time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC)},
+		{"thursday", time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC)},
+		{"2022-02-01", time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range testcases {
+		actual, err := parseTimeRelativeTo(tc.input, now)
+		testutils.Check(t, err)
+		if !actual.Equal(tc.expected) {
+			t.Fatalf("parseTimeRelativeTo(%#v) returned %v, expected %v", tc.input, actual, tc.expected)
+		}
+	}
+	_, err := parseTimeRelativeTo("yesterdya", now)
+	if err == nil || !strings.Contains(err.Error(), "is not a recognized time") {
+		t.Fatalf("expected an error about an unrecognized time, got %v", err)
+	}
+
+	rangeTestcases := []struct {
+		input         string
+		expectedStart time.Time
+		expectedEnd   time.Time
+	}{
+		{"2024", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-02", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-02-29", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"yesterday", time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 13, 0, 0, 0, 0, time.UTC)},
+		{"last_monday", time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC)},
+		{"this week", time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC)},
+		{"last_month", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range rangeTestcases {
+		start, end, err := parseTimeRangeRelativeTo(tc.input, now)
+		testutils.Check(t, err)
+		if !start.Equal(tc.expectedStart) || !end.Equal(tc.expectedEnd) {
+			t.Fatalf("parseTimeRangeRelativeTo(%#v) returned [%v, %v), expected [%v, %v)", tc.input, start, end, tc.expectedStart, tc.expectedEnd)
+		}
+	}
+	_, _, err = parseTimeRangeRelativeTo("2024-13", now)
+	if err == nil || !strings.Contains(err.Error(), "is not a recognized time range") {
+		t.Fatalf("expected an error about an unrecognized time range, got %v", err)
+	}
+}
+
+func TestSearchWithRelativeTimes(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Insert data
+	entry1 := testutils.MakeFakeHistoryEntry("ls old")
+	entry1.StartTime = time.Date(2022, 3, 15, 12, 0, 0, 0, time.Local)
+	entry1.EndTime = entry1.StartTime.Add(time.Second)
+	testutils.Check(t, db.Create(entry1).Error)
+	entry2 := testutils.MakeFakeHistoryEntry("ls recent")
+	entry2.StartTime = time.Now().Add(-time.Hour)
+	entry2.EndTime = entry2.StartTime.Add(time.Second)
+	testutils.Check(t, db.Create(entry2).Error)
+
+	testcases := []struct {
+		query           string
+		expectedResults []string
+	}{
+		{"ls after:2h", []string{"ls recent"}},
+		{"ls before:2h", []string{"ls old"}},
+		{"ls after:\"3 days ago\"", []string{"ls recent"}},
+		{"ls (before:\"3 days ago\" OR after:10m)", []string{"ls old"}},
+		{"ls during:2022-03", []string{"ls old"}},
+		{"ls during:2022-04", []string{}},
+		{"ls -during:2022", []string{"ls recent"}},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 0)
+		testutils.Check(t, err)
+		actualResults := make([]string, 0)
+		for _, r := range results {
+			actualResults = append(actualResults, r.Command)
+		}
+		if !reflect.DeepEqual(actualResults, tc.expectedResults) {
+			t.Fatalf("Search(%#v) returned %#v, expected %#v", tc.query, actualResults, tc.expectedResults)
+		}
+	}
+
+	// Mistyped values should be clear errors
+	_, err := Search(ctx, db, "after:yesterdya", 0)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse after:yesterdya as a timestamp") {
+		t.Fatalf("expected an error about an invalid timestamp, got %v", err)
+	}
+	_, err = Search(ctx, db, "during:march", 0)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse during:march as a time range") {
+		t.Fatalf("expected an error about an invalid time range, got %v", err)
+	}
+}
+
 func TestUnescape(t *testing.T) {
 	testcases := []struct {
 		input  string
@@ -568,3 +750,1274 @@ func TestSplitEscaped(t *testing.T) {
 		}
 	}
 }
+
+func TestSearchWithBooleanOperators(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Insert data
+	entry1 := testutils.MakeFakeHistoryEntry("kubectl get pods")
+	entry1.CurrentWorkingDirectory = "~/infra"
+	testutils.Check(t, db.Create(entry1).Error)
+	entry2 := testutils.MakeFakeHistoryEntry("helm install foo")
+	entry2.CurrentWorkingDirectory = "~/infra"
+	testutils.Check(t, db.Create(entry2).Error)
+	entry3 := testutils.MakeFakeHistoryEntry("kubectl get nodes")
+	entry3.CurrentWorkingDirectory = "~/code"
+	testutils.Check(t, db.Create(entry3).Error)
+	entry4 := testutils.MakeFakeHistoryEntry("echo $(date)")
+	testutils.Check(t, db.Create(entry4).Error)
+
+	testcases := []struct {
+		query           string
+		expectedResults []string
+	}{
+		{"kubectl OR helm", []string{"kubectl get nodes", "helm install foo", "kubectl get pods"}},
+		{"(kubectl OR helm) cwd:~/infra", []string{"helm install foo", "kubectl get pods"}},
+		{"kubectl OR helm cwd:~/infra", []string{"kubectl get nodes", "helm install foo", "kubectl get pods"}},
+		{"helm OR kubectl AND nodes", []string{"kubectl get nodes", "helm install foo"}},
+		{"-(kubectl OR helm)", []string{"echo $(date)"}},
+		{"(kubectl OR helm) -pods", []string{"kubectl get nodes", "helm install foo"}},
+		{"((kubectl) OR (echo)) -nodes", []string{"echo $(date)", "kubectl get pods"}},
+		{"$(date)", []string{"echo $(date)"}},
+		{"(kubectl OR helm", []string{"kubectl get nodes", "helm install foo", "kubectl get pods"}},
+		{"kubectl \\OR nodes", []string{}},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 0)
+		testutils.Check(t, err)
+		actualResults := make([]string, 0)
+		for _, r := range results {
+			actualResults = append(actualResults, r.Command)
+		}
+		if !reflect.DeepEqual(actualResults, tc.expectedResults) {
+			t.Fatalf("Search(%#v) returned %#v, expected %#v", tc.query, actualResults, tc.expectedResults)
+		}
+	}
+
+	// And some malformed queries
+	for _, query := range []string{"kubectl OR", "OR kubectl", "kubectl OR OR helm", "(kubectl OR) helm"} {
+		_, err := Search(ctx, db, query, 0)
+		if err == nil {
+			t.Fatalf("Search(%#v) should have returned an error", query)
+		}
+	}
+}
+
+func TestSearchWithRegex(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Insert data
+	entry1 := testutils.MakeFakeHistoryEntry("git status")
+	entry1.Hostname = "server-01"
+	testutils.Check(t, db.Create(entry1).Error)
+	entry2 := testutils.MakeFakeHistoryEntry("echo git")
+	entry2.Hostname = "laptop"
+	entry2.CurrentWorkingDirectory = "~/code/hishtory"
+	testutils.Check(t, db.Create(entry2).Error)
+	entry3 := testutils.MakeFakeHistoryEntry("ls -la")
+	entry3.Hostname = "server-02"
+	testutils.Check(t, db.Create(entry3).Error)
+
+	testcases := []struct {
+		query           string
+		expectedResults []string
+	}{
+		{"regex:^git", []string{"git status"}},
+		{"command~:git$", []string{"echo git"}},
+		{"command~:^(git|ls)\\s", []string{"ls -la", "git status"}},
+		{"regex:^echo\\ git$", []string{"echo git"}},
+		{"-regex:^git", []string{"ls -la", "echo git"}},
+		{"host~:^server-\\d+$", []string{"ls -la", "git status"}},
+		{"cwd~:hishtory$", []string{"echo git"}},
+		{"cwd~:^/home/david/code", []string{"echo git"}},
+		{"regex:^git OR host~:02$", []string{"ls -la", "git status"}},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 0)
+		testutils.Check(t, err)
+		actualResults := make([]string, 0)
+		for _, r := range results {
+			actualResults = append(actualResults, r.Command)
+		}
+		if !reflect.DeepEqual(actualResults, tc.expectedResults) {
+			t.Fatalf("Search(%#v) returned %#v, expected %#v", tc.query, actualResults, tc.expectedResults)
+		}
+	}
+
+	// An invalid regex should be a clear error rather than a DB error
+	_, err := Search(ctx, db, "regex:(git", 0)
+	if err == nil || !strings.Contains(err.Error(), "as a regex") {
+		t.Fatalf("expected an error about an invalid regex, got %v", err)
+	}
+}
+
+func TestSearchWithComparisons(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Insert data
+	entry1 := testutils.MakeFakeHistoryEntry("make build")
+	entry1.ExitCode = 0
+	entry1.EndTime = entry1.StartTime.Add(45 * time.Second)
+	entry1.CustomColumns = data.CustomColumns{{Name: "lines", Val: "1200"}}
+	testutils.Check(t, db.Create(entry1).Error)
+	entry2 := testutils.MakeFakeHistoryEntry("ls")
+	entry2.ExitCode = 0
+	entry2.EndTime = entry2.StartTime.Add(20 * time.Millisecond)
+	entry2.CustomColumns = data.CustomColumns{{Name: "lines", Val: "15"}}
+	testutils.Check(t, db.Create(entry2).Error)
+	entry3 := testutils.MakeFakeHistoryEntry("grep foo")
+	entry3.ExitCode = 1
+	entry3.EndTime = entry3.StartTime.Add(2 * time.Second)
+	entry3.CustomColumns = data.CustomColumns{{Name: "lines", Val: "v1.2"}}
+	testutils.Check(t, db.Create(entry3).Error)
+	entry4 := testutils.MakeFakeHistoryEntry("foo")
+	entry4.ExitCode = 127
+	entry4.EndTime = entry4.StartTime.Add(5 * time.Millisecond)
+	testutils.Check(t, db.Create(entry4).Error)
+
+	testcases := []struct {
+		query           string
+		expectedResults []string
+	}{
+		{"exit_code:0", []string{"make build", "ls"}},
+		{"exit_code:!=0", []string{"foo", "grep foo"}},
+		{"exit_code:>1", []string{"foo"}},
+		{"exit_code:<=1", []string{"make build", "grep foo", "ls"}},
+		{"runtime:>30s", []string{"make build"}},
+		{"runtime:<100ms", []string{"foo", "ls"}},
+		{"runtime:>=2", []string{"make build", "grep foo"}},
+		{"runtime:>10ms runtime:<10s", []string{"grep foo", "ls"}},
+		{"-exit_code:0 runtime:<1s", []string{"foo"}},
+		{"lines:>100", []string{"make build"}},
+		{"lines:<=15", []string{"ls"}},
+		{"lines:1.2", []string{"grep foo"}},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 0)
+		testutils.Check(t, err)
+		actualResults := make([]string, 0)
+		for _, r := range results {
+			actualResults = append(actualResults, r.Command)
+		}
+		if !reflect.DeepEqual(actualResults, tc.expectedResults) {
+			t.Fatalf("Search(%#v) returned %#v, expected %#v", tc.query, actualResults, tc.expectedResults)
+		}
+	}
+
+	// Invalid comparisons should be clear errors
+	_, err := Search(ctx, db, "exit_code:>abc", 0)
+	if err == nil || !strings.Contains(err.Error(), "as a number") {
+		t.Fatalf("expected an error about an invalid number, got %v", err)
+	}
+	_, err = Search(ctx, db, "runtime:>3sec", 0)
+	if err == nil || !strings.Contains(err.Error(), "as a duration") {
+		t.Fatalf("expected an error about an invalid duration, got %v", err)
+	}
+	_, err = Search(ctx, db, "runtime:30s", 0)
+	if err == nil || !strings.Contains(err.Error(), "missing a comparison operator") {
+		t.Fatalf("expected an error about a missing operator, got %v", err)
+	}
+}
+
+func TestSearchWithSortOrder(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Insert data
+	now := time.Now()
+	for i, cmd := range []string{"ls", "make build", "ls", "git status", "ls", "make build"} {
+		entry := testutils.MakeFakeHistoryEntry(cmd)
+		entry.StartTime = now.Add(time.Duration(i-10) * time.Hour)
+		entry.EndTime = entry.StartTime.Add(time.Duration(len(cmd)) * time.Second)
+		entry.ExitCode = i
+		testutils.Check(t, db.Create(entry).Error)
+	}
+	oldEntry := testutils.MakeFakeHistoryEntry("git status")
+	oldEntry.StartTime = now.AddDate(0, 0, -300)
+	oldEntry.EndTime = oldEntry.StartTime.Add(time.Second)
+	testutils.Check(t, db.Create(oldEntry).Error)
+	oldEntry.StartTime = now.AddDate(0, 0, -301)
+	oldEntry.EndTime = oldEntry.StartTime.Add(time.Second)
+	testutils.Check(t, db.Create(oldEntry).Error)
+
+	testcases := []struct {
+		query           string
+		expectedResults []string
+	}{
+		{"", []string{"make build", "ls", "git status", "ls", "make build", "ls", "git status", "git status"}},
+		{"sort:recent", []string{"make build", "ls", "git status", "ls", "make build", "ls", "git status", "git status"}},
+		{"sort:frequency", []string{"ls", "ls", "ls", "git status", "git status", "git status", "make build", "make build"}},
+		{"sort:frecency", []string{"ls", "ls", "ls", "make build", "make build", "git status", "git status", "git status"}},
+		{"sort:runtime s", []string{"make build", "git status", "make build", "ls", "ls", "ls", "git status", "git status"}},
+		{"sort:exit_code -git", []string{"make build", "ls", "ls", "make build", "ls"}},
+		{"sort:FREQUENCY s -git", []string{"ls", "ls", "ls", "make build", "make build"}},
+	}
+	for _, tc := range testcases {
+		results, err := Search(ctx, db, tc.query, 0)
+		testutils.Check(t, err)
+		actualResults := make([]string, 0)
+		for _, r := range results {
+			actualResults = append(actualResults, r.Command)
+		}
+		if !reflect.DeepEqual(actualResults, tc.expectedResults) {
+			t.Fatalf("Search(%#v) returned %#v, expected %#v", tc.query, actualResults, tc.expectedResults)
+		}
+	}
+
+	// Sort orders don't change which entries are matched
+	tx, err := MakeWhereQueryFromSearch(ctx, db, "sort:runtime ls")
+	testutils.Check(t, err)
+	var count int64
+	testutils.Check(t, tx.Count(&count).Error)
+	if count != 3 {
+		t.Fatalf("expected 3 matches, got %d", count)
+	}
+
+	// Invalid sort orders should be clear errors
+	_, err = Search(ctx, db, "sort:alphabetical", 0)
+	if err == nil || !strings.Contains(err.Error(), "unknown sort order") {
+		t.Fatalf("expected an error about an unknown sort order, got %v", err)
+	}
+	_, err = Search(ctx, db, "ls (sort:runtime OR git)", 0)
+	if err == nil || !strings.Contains(err.Error(), "can't be used inside of a group") {
+		t.Fatalf("expected an error about a nested sort order, got %v", err)
+	}
+}
+
+func TestFullTextSearchIndex(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Simulate a DB from before the full-text search index existed, where history_entries didn't have an INTEGER PRIMARY KEY
+	testutils.Check(t, db.Exec("DROP TABLE "+hctx.FtsTableName).Error)
+	testutils.Check(t, db.Exec("DROP TABLE history_entries").Error)
+	testutils.Check(t, db.AutoMigrate(&data.HistoryEntry{}))
+	testutils.Check(t, db.Exec("CREATE INDEX end_time_index ON history_entries(end_time)").Error)
+	testutils.Check(t, db.Create(testutils.MakeFakeHistoryEntry("kubectl get pods")).Error)
+	testutils.Check(t, db.Create(testutils.MakeFakeHistoryEntry("helm install")).Error)
+
+	// Re-opening the DB should migrate history_entries to stable rowids, keep its indexes, and backfill the index
+	db, err := hctx.OpenLocalSqliteDb()
+	testutils.Check(t, err)
+	var numPrimaryKeys, numIndexes int64
+	testutils.Check(t, db.Raw("SELECT COUNT(*) FROM pragma_table_info('history_entries') WHERE pk > 0 AND type = 'INTEGER'").Scan(&numPrimaryKeys).Error)
+	testutils.Check(t, db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name IN ('compositeindex', 'end_time_index')").Scan(&numIndexes).Error)
+	if numPrimaryKeys != 1 || numIndexes != 2 {
+		t.Fatalf("expected history_entries to have an INTEGER PRIMARY KEY and its indexes, got %d and %d", numPrimaryKeys, numIndexes)
+	}
+	assertFtsRowCount := func(expected int64) {
+		var count int64
+		testutils.Check(t, db.Raw("SELECT COUNT(*) FROM "+hctx.FtsTableName).Scan(&count).Error)
+		if count != expected {
+			t.Fatalf("expected %d rows in the FTS index, found %d", expected, count)
+		}
+	}
+	assertFtsRowCount(2)
+	results, err := Search(ctx, db, "KUBECTL", 0)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "kubectl get pods" {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+
+	// New entries are indexed
+	testutils.Check(t, ReliableDbCreate(db, testutils.MakeFakeHistoryEntry("kubectl apply")))
+	assertFtsRowCount(3)
+	results, err = Search(ctx, db, "kubectl", 0)
+	testutils.Check(t, err)
+	if len(results) != 2 {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+
+	// Deleted entries (e.g. from redaction) are removed from the index
+	tx, err := MakeWhereQueryFromSearch(ctx, db, "apply")
+	testutils.Check(t, err)
+	testutils.Check(t, tx.Delete(&data.HistoryEntry{}).Error)
+	assertFtsRowCount(2)
+	results, err = Search(ctx, db, "kubectl", 0)
+	testutils.Check(t, err)
+	if len(results) != 1 {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+
+	// Updated entries are reindexed
+	testutils.Check(t, db.Exec("UPDATE history_entries SET command = 'helm upgrade' WHERE command = 'helm install'").Error)
+	results, err = Search(ctx, db, "install", 0)
+	testutils.Check(t, err)
+	if len(results) != 0 {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+	results, err = Search(ctx, db, "upgrade", 0)
+	testutils.Check(t, err)
+	if len(results) != 1 {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+
+	// The rowids that the index is keyed on are stable across a VACUUM
+	testutils.Check(t, db.Exec("DELETE FROM history_entries WHERE command = 'kubectl get pods'").Error)
+	testutils.Check(t, db.Exec("VACUUM").Error)
+	assertFtsRowCount(1)
+	results, err = Search(ctx, db, "upgrade", 0)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "helm upgrade" {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+
+	// Re-opening the DB doesn't scan or rebuild the index, it is only maintained by the triggers
+	testutils.Check(t, db.Exec("INSERT INTO "+hctx.FtsTableName+"(rowid, command) VALUES (1000, 'stray')").Error)
+	db, err = hctx.OpenLocalSqliteDb()
+	testutils.Check(t, err)
+	assertFtsRowCount(2)
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	testcases := []struct {
+		pattern           string
+		text              string
+		expectedMatch     bool
+		expectedPositions []int
+	}{
+		{"gco", "git checkout main", true, []int{0, 4, 9}},
+		{"kgp", "kubectl get pods", true, []int{0, 8, 12}},
+		{"KGP", "kubectl get pods", false, nil},
+		{"Kgp", "Kubectl get pods", true, []int{0, 8, 12}},
+		{"main", "git checkout main", true, []int{13, 14, 15, 16}},
+		{"kubectl", "k kubectl", true, []int{2, 3, 4, 5, 6, 7, 8}},
+		{"xyz", "git status", false, nil},
+	}
+	for _, tc := range testcases {
+		_, positions, ok := fuzzyMatch(tc.pattern, tc.text)
+		if ok != tc.expectedMatch {
+			t.Fatalf("fuzzyMatch(%#v, %#v) matched=%v, expected %v", tc.pattern, tc.text, ok, tc.expectedMatch)
+		}
+		if ok && !reflect.DeepEqual(positions, tc.expectedPositions) {
+			t.Fatalf("fuzzyMatch(%#v, %#v) returned positions=%#v, expected %#v", tc.pattern, tc.text, positions, tc.expectedPositions)
+		}
+	}
+
+	// Tighter and boundary-aligned matches score higher
+	tightScore, _, _ := fuzzyMatch("gst", "git status")
+	looseScore, _, _ := fuzzyMatch("gst", "grep --start")
+	if tightScore <= looseScore {
+		t.Fatalf("expected %d > %d", tightScore, looseScore)
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	entry := testutils.MakeFakeHistoryEntry("kubectl get pods")
+	entry.CurrentWorkingDirectory = "/home/david/infra/"
+	testutils.Check(t, db.Create(entry).Error)
+	testutils.Check(t, db.Create(testutils.MakeFakeHistoryEntry("echo kangaroo up")).Error)
+	testutils.Check(t, db.Create(testutils.MakeFakeHistoryEntry("ls -l")).Error)
+
+	// Matches are ranked by quality, even though the worse match is more recent
+	results, positions, err := FuzzySearch(ctx, db, "kgp", 0)
+	testutils.Check(t, err)
+	if len(results) != 2 || results[0].Command != "kubectl get pods" || results[1].Command != "echo kangaroo up" {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+	if !reflect.DeepEqual(positions[0], []int{0, 8, 12}) {
+		t.Fatalf("unexpected positions: %#v", positions)
+	}
+
+	// Atoms are applied as filters
+	results, _, err = FuzzySearch(ctx, db, "kgp cwd:/tmp/", 0)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "echo kangaroo up" {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+	results, _, err = FuzzySearch(ctx, db, "kgp -echo", 0)
+	testutils.Check(t, err)
+	if len(results) != 1 || results[0].Command != "kubectl get pods" {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+
+	// Queries with boolean operators fall back to a normal search
+	results, positions, err = FuzzySearch(ctx, db, "ls OR kubectl", 0)
+	testutils.Check(t, err)
+	if len(results) != 2 || positions != nil {
+		t.Fatalf("unexpected search results: %#v", results)
+	}
+}
+
+func TestExportEntries(t *testing.T) {
+	entry1 := testutils.MakeFakeHistoryEntry("echo foo\nbar")
+	entry1.CustomColumns = data.CustomColumns{{Name: "git_remote", Val: "github.com/ddworken/hishtory"}}
+	entry2 := testutils.MakeFakeHistoryEntry("ls\t-la")
+	entries := []*data.HistoryEntry{&entry1, &entry2}
+
+	// Raw
+	var buf bytes.Buffer
+	testutils.Check(t, ExportEntries(&buf, entries, "raw", false))
+	if buf.String() != "echo foo\nbar\nls\t-la\n" {
+		t.Fatalf("unexpected raw export: %#v", buf.String())
+	}
+	buf.Reset()
+	testutils.Check(t, ExportEntries(&buf, entries, "raw", true))
+	if buf.String() != "echo foo\nbar\x00ls\t-la\x00" {
+		t.Fatalf("unexpected NUL-separated export: %#v", buf.String())
+	}
+
+	// JSON and NDJSON round trip
+	buf.Reset()
+	testutils.Check(t, ExportEntries(&buf, entries, "json", false))
+	var jsonEntries []*data.HistoryEntry
+	testutils.Check(t, json.Unmarshal(buf.Bytes(), &jsonEntries))
+	if len(jsonEntries) != 2 || !reflect.DeepEqual(jsonEntries[0].CustomColumns, entry1.CustomColumns) || jsonEntries[1].Command != entry2.Command || !jsonEntries[1].StartTime.Equal(entry2.StartTime) {
+		t.Fatalf("unexpected JSON export: %#v", buf.String())
+	}
+	buf.Reset()
+	testutils.Check(t, ExportEntries(&buf, entries, "ndjson", false))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected NDJSON export: %#v", buf.String())
+	}
+	var ndjsonEntry data.HistoryEntry
+	testutils.Check(t, json.Unmarshal([]byte(lines[0]), &ndjsonEntry))
+	if ndjsonEntry.Command != entry1.Command || ndjsonEntry.Hostname != entry1.Hostname || ndjsonEntry.ExitCode != entry1.ExitCode {
+		t.Fatalf("unexpected NDJSON export: %#v", buf.String())
+	}
+
+	// CSV
+	buf.Reset()
+	testutils.Check(t, ExportEntries(&buf, entries, "csv", false))
+	records, err := csv.NewReader(&buf).ReadAll()
+	testutils.Check(t, err)
+	if len(records) != 3 || records[0][2] != "command" || records[0][9] != "git_remote" || records[1][2] != entry1.Command || records[1][9] != "github.com/ddworken/hishtory" || records[2][9] != "" {
+		t.Fatalf("unexpected CSV export: %#v", records)
+	}
+
+	// TSV
+	buf.Reset()
+	testutils.Check(t, ExportEntries(&buf, entries, "tsv", false))
+	lines = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 || strings.Split(lines[1], "\t")[2] != "echo foo\\nbar" || strings.Split(lines[2], "\t")[2] != "ls\\t-la" {
+		t.Fatalf("unexpected TSV export: %#v", buf.String())
+	}
+
+	// Invalid options
+	if err := ExportEntries(&buf, entries, "yaml", false); err == nil || !strings.Contains(err.Error(), "unknown export format") {
+		t.Fatalf("expected an error about an unknown format, got %v", err)
+	}
+	if err := ExportEntries(&buf, entries, "json", true); err == nil {
+		t.Fatalf("expected an error about NUL-separated JSON")
+	}
+}
+
+func TestImportJsonHistory(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// Export some entries
+	entry1 := testutils.MakeFakeHistoryEntry("echo foo\nbar")
+	entry1.CurrentWorkingDirectory = "/home/david/code/"
+	entry1.ExitCode = 3
+	entry1.DeviceId = "other-device"
+	entry1.CustomColumns = data.CustomColumns{{Name: "git_remote", Val: "github.com/ddworken/hishtory"}}
+	entry2 := testutils.MakeFakeHistoryEntry("ls")
+	for _, format := range []string{"json", "ndjson"} {
+		var buf bytes.Buffer
+		testutils.Check(t, ExportEntries(&buf, []*data.HistoryEntry{&entry1, &entry2}, format, false))
+
+		// And import them, twice to check that duplicates are skipped
+		importedEntries, err := ImportJsonHistory(ctx, bytes.NewReader(buf.Bytes()))
+		testutils.Check(t, err)
+		if format == "json" && len(importedEntries) != 2 {
+			t.Fatalf("expected 2 imported entries, got %#v", importedEntries)
+		}
+		importedEntries, err = ImportJsonHistory(ctx, bytes.NewReader(buf.Bytes()))
+		testutils.Check(t, err)
+		if len(importedEntries) != 0 {
+			t.Fatalf("expected no imported entries, got %#v", importedEntries)
+		}
+	}
+
+	// Check that all fields were preserved
+	var entries []data.HistoryEntry
+	testutils.Check(t, db.Order("end_time ASC").Find(&entries).Error)
+	if len(entries) != 2 {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+	if entries[0].Command != entry1.Command || entries[0].CurrentWorkingDirectory != entry1.CurrentWorkingDirectory || entries[0].ExitCode != 3 || entries[0].DeviceId != "other-device" || !entries[0].StartTime.Equal(entry1.StartTime) || !entries[0].EndTime.Equal(entry1.EndTime) || !reflect.DeepEqual(entries[0].CustomColumns, entry1.CustomColumns) {
+		t.Fatalf("imported entry doesn't match the exported entry: %#v", entries[0])
+	}
+	if entries[1].DeviceId != hctx.GetConf(ctx).DeviceId {
+		t.Fatalf("expected an entry without a device ID to be attributed to this device: %#v", entries[1])
+	}
+
+	// Invalid input is rejected, without importing any of the valid entries before it
+	validEntry := testutils.MakeFakeHistoryEntry("echo valid")
+	var buf bytes.Buffer
+	testutils.Check(t, ExportEntries(&buf, []*data.HistoryEntry{&validEntry}, "ndjson", false))
+	buf.WriteString(`{"command": "ls"}` + "\n")
+	_, err := ImportJsonHistory(ctx, &buf)
+	if err == nil || !strings.Contains(err.Error(), "missing a command, start_time or end_time") {
+		t.Fatalf("expected an error about a missing field, got %v", err)
+	}
+	var count int64
+	testutils.Check(t, db.Model(&data.HistoryEntry{}).Count(&count).Error)
+	if count != 2 {
+		t.Fatalf("expected the import to be rolled back, found %d entries", count)
+	}
+	_, err = ImportJsonHistory(ctx, strings.NewReader(`[{"command": "ls"`))
+	if err == nil || !strings.Contains(err.Error(), "failed to parse") {
+		t.Fatalf("expected an error about invalid JSON, got %v", err)
+	}
+}
+
+func TestImportFromTool(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	tmpDir := t.TempDir()
+	currentUser, err := user.Current()
+	testutils.Check(t, err)
+
+	createSqliteDb := func(name string, statements ...string) string {
+		path := path.Join(tmpDir, name)
+		sqliteDb, err := sql.Open("sqlite", path)
+		testutils.Check(t, err)
+		defer sqliteDb.Close()
+		for _, statement := range statements {
+			_, err := sqliteDb.Exec(statement)
+			testutils.Check(t, err)
+		}
+		return path
+	}
+	atuinPath := createSqliteDb("atuin.db",
+		"CREATE TABLE history (id text primary key, timestamp integer not null, duration integer not null, exit integer not null, command text not null, cwd text not null, session text not null, hostname text not null, deleted_at integer)",
+		"INSERT INTO history VALUES ('1', 1664342754000000000, 2500000000, 1, 'make test', '/home/david/code', 's', 'laptop:david', NULL)",
+		"INSERT INTO history VALUES ('2', 1664342760000000000, -1, 0, 'ls', '/tmp', 's', 'laptop:david', NULL)",
+		"INSERT INTO history VALUES ('3', 1664342770000000000, 0, 0, 'rm secret', '/tmp', 's', 'laptop:david', 1664342780000000000)",
+	)
+	mcflyPath := createSqliteDb("mcfly.db",
+		"CREATE TABLE commands (id INTEGER PRIMARY KEY AUTOINCREMENT, cmd TEXT NOT NULL, cmd_tpl TEXT, session_id TEXT NOT NULL, when_run INTEGER NOT NULL, exit_code INTEGER NOT NULL, selected INTEGER NOT NULL, dir TEXT, old_dir TEXT, when_finished INTEGER)",
+		"INSERT INTO commands (cmd, session_id, when_run, exit_code, selected, dir, when_finished) VALUES ('git status', 's', 1664342754, 128, 0, '/home/david/repo', 1664342756)",
+	)
+	// Older versions of mcfly don't have the when_finished column
+	legacyMcflyPath := createSqliteDb("legacy-mcfly.db",
+		"CREATE TABLE commands (id INTEGER PRIMARY KEY AUTOINCREMENT, cmd TEXT NOT NULL, cmd_tpl TEXT, session_id TEXT NOT NULL, when_run INTEGER NOT NULL, exit_code INTEGER NOT NULL, selected INTEGER NOT NULL, dir TEXT, old_dir TEXT)",
+		"INSERT INTO commands (cmd, session_id, when_run, exit_code, selected, dir) VALUES ('git log', 's', 1664342758, 0, 0, '/home/david/repo')",
+	)
+	nushellPath := createSqliteDb("history.sqlite3",
+		"CREATE TABLE history (id INTEGER PRIMARY KEY AUTOINCREMENT, command_line TEXT NOT NULL, start_timestamp INTEGER, session_id INTEGER, hostname TEXT, cwd TEXT, duration_ms INTEGER, exit_status INTEGER, more_info TEXT)",
+		"INSERT INTO history (command_line, start_timestamp, hostname, cwd, duration_ms, exit_status) VALUES ('ls | where size > 1mb', 1664342754123, 'desktop', '/home/david', 150, 0)",
+	)
+	reshPath := path.Join(tmpDir, "history.reshjson")
+	testutils.Check(t, os.WriteFile(reshPath, []byte(`{"cmdLine":"curl example.com","exitCode":6,"pwd":"/home/david","home":"/home/david","host":"server","login":"david","realtimeBefore":1664342754.5,"realtimeDuration":1.25}
+{"version":"v1","cmdLine":"echo hi","exitCode":0,"pwd":"/tmp","home":"/home/david","device":"server2","time":"1664342760.000","duration":"0.010"}
+`), 0o644))
+
+	testcases := []struct {
+		importer        string
+		path            string
+		expectedEntries []data.HistoryEntry
+	}{
+		{"atuin", atuinPath, []data.HistoryEntry{
+			{Command: "make test", CurrentWorkingDirectory: "/home/david/code", Hostname: "laptop", LocalUsername: "david", ExitCode: 1, StartTime: time.Unix(1664342754, 0), EndTime: time.Unix(1664342756, 500000000)},
+			{Command: "ls", CurrentWorkingDirectory: "/tmp", Hostname: "laptop", LocalUsername: "david", ExitCode: 0, StartTime: time.Unix(1664342760, 0), EndTime: time.Unix(1664342760, 0)},
+		}},
+		{"mcfly", mcflyPath, []data.HistoryEntry{
+			{Command: "git status", CurrentWorkingDirectory: "/home/david/repo", ExitCode: 128, StartTime: time.Unix(1664342754, 0), EndTime: time.Unix(1664342756, 0)},
+		}},
+		{"mcfly", legacyMcflyPath, []data.HistoryEntry{
+			{Command: "git log", CurrentWorkingDirectory: "/home/david/repo", ExitCode: 0, StartTime: time.Unix(1664342758, 0), EndTime: time.Unix(1664342758, 0)},
+		}},
+		{"nushell", nushellPath, []data.HistoryEntry{
+			{Command: "ls | where size > 1mb", CurrentWorkingDirectory: "/home/david", Hostname: "desktop", ExitCode: 0, StartTime: time.UnixMilli(1664342754123), EndTime: time.UnixMilli(1664342754273)},
+		}},
+		{"resh", reshPath, []data.HistoryEntry{
+			{Command: "curl example.com", CurrentWorkingDirectory: "/home/david", HomeDirectory: "/home/david", Hostname: "server", LocalUsername: "david", ExitCode: 6, StartTime: time.Unix(1664342754, 500000000), EndTime: time.Unix(1664342755, 750000000)},
+			{Command: "echo hi", CurrentWorkingDirectory: "/tmp", HomeDirectory: "/home/david", Hostname: "server2", ExitCode: 0, StartTime: time.Unix(1664342760, 0), EndTime: time.Unix(1664342760, 10000000)},
+		}},
+	}
+	for _, tc := range testcases {
+		importer, ok := GetHistoryImporter(tc.importer)
+		if !ok {
+			t.Fatalf("failed to find importer %s", tc.importer)
+		}
+		importedEntries, err := ImportFromTool(ctx, importer, tc.path)
+		testutils.Check(t, err)
+		if len(importedEntries) != len(tc.expectedEntries) {
+			t.Fatalf("%s: expected %d entries, got %#v", tc.importer, len(tc.expectedEntries), importedEntries)
+		}
+		for i, expected := range tc.expectedEntries {
+			actual := importedEntries[i]
+			if actual.Command != expected.Command || actual.CurrentWorkingDirectory != expected.CurrentWorkingDirectory || actual.ExitCode != expected.ExitCode || !actual.StartTime.Equal(expected.StartTime) || !actual.EndTime.Equal(expected.EndTime) {
+				t.Fatalf("%s: entry #%d doesn't match, actual=%#v, expected=%#v", tc.importer, i, actual, expected)
+			}
+			if expected.Hostname != "" && actual.Hostname != expected.Hostname {
+				t.Fatalf("%s: entry #%d has the wrong hostname: %#v", tc.importer, i, actual)
+			}
+			if expected.LocalUsername != "" && actual.LocalUsername != expected.LocalUsername {
+				t.Fatalf("%s: entry #%d has the wrong username: %#v", tc.importer, i, actual)
+			}
+			// Entries without a username get the same one as `hishtory import`
+			if expected.LocalUsername == "" && actual.LocalUsername != currentUser.Name {
+				t.Fatalf("%s: entry #%d has the wrong default username: %#v", tc.importer, i, actual)
+			}
+			if expected.HomeDirectory != "" && actual.HomeDirectory != expected.HomeDirectory {
+				t.Fatalf("%s: entry #%d has the wrong home directory: %#v", tc.importer, i, actual)
+			}
+			if actual.DeviceId != hctx.GetConf(ctx).DeviceId || actual.LocalUsername == "" || actual.Hostname == "" || actual.HomeDirectory == "" {
+				t.Fatalf("%s: entry #%d is missing defaults: %#v", tc.importer, i, actual)
+			}
+		}
+
+		// Importing again is a no-op
+		importedEntries, err = ImportFromTool(ctx, importer, tc.path)
+		testutils.Check(t, err)
+		if len(importedEntries) != 0 {
+			t.Fatalf("%s: expected re-importing to skip existing entries, got %#v", tc.importer, importedEntries)
+		}
+	}
+	var count int64
+	testutils.Check(t, db.Model(&data.HistoryEntry{}).Count(&count).Error)
+	if count != 7 {
+		t.Fatalf("expected 7 entries in the DB, got %d", count)
+	}
+
+	// Missing history files should be a clear error
+	importer, _ := GetHistoryImporter("atuin")
+	_, err = ImportFromTool(ctx, importer, "")
+	if err == nil || !strings.Contains(err.Error(), "failed to find atuin history") {
+		t.Fatalf("expected an error about missing history, got %v", err)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SERVER")()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+
+	// A fake server that records the entries it receives, and that can be taken offline
+	isOnline := false
+	isOverQuota := false
+	var receivedEntries []shared.EncHistoryEntry
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isOnline {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if isOverQuota {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"code":"quota_exceeded","message":"this server stores at most 10 entries per user"}`))
+			return
+		}
+		var entries []shared.EncHistoryEntry
+		testutils.Check(t, json.NewDecoder(r.Body).Decode(&entries))
+		receivedEntries = append(receivedEntries, entries...)
+	}))
+	defer server.Close()
+	os.Setenv("HISHTORY_SERVER", server.URL)
+
+	saveEntry := func(command string) data.HistoryEntry {
+		entry := testutils.MakeFakeHistoryEntry(command)
+		entry.DeviceId = hctx.GetConf(ctx).DeviceId
+		testutils.Check(t, ReliableDbCreate(db, entry))
+		testutils.Check(t, AddToOutbox(db, entry))
+		return entry
+	}
+	assertNumPending := func(expected int64) {
+		t.Helper()
+		numPending, err := CountPendingUploads(db)
+		testutils.Check(t, err)
+		if numPending != expected {
+			t.Fatalf("expected %d pending uploads, got %d", expected, numPending)
+		}
+	}
+
+	// While offline, entries stay in the outbox and are backed off
+	saveEntry("ls")
+	saveEntry("echo foo")
+	testutils.Check(t, FlushOutbox(ctx))
+	assertNumPending(2)
+	var pending []data.PendingUpload
+	testutils.Check(t, db.Find(&pending).Error)
+	for _, p := range pending {
+		if p.NumFailures != 1 || !p.NextAttempt.After(time.Now()) {
+			t.Fatalf("expected the pending upload to be backed off: %#v", p)
+		}
+	}
+
+	// Flushing again doesn't retry the entries that are backed off
+	isOnline = true
+	testutils.Check(t, db.Where("device_id = ? AND end_time = ?", pending[0].DeviceId, pending[0].EndTime).Delete(&data.HistoryEntry{}).Error)
+	testutils.Check(t, FlushOutbox(ctx))
+	assertNumPending(2)
+	if len(receivedEntries) != 0 {
+		t.Fatalf("expected no uploads, got %d", len(receivedEntries))
+	}
+
+	// But once a new entry is uploaded successfully, all of the remaining entries are uploaded too, except
+	// for the one that was redacted in the meantime
+	saveEntry("echo bar")
+	testutils.Check(t, FlushOutbox(ctx))
+	assertNumPending(0)
+	if len(receivedEntries) != 2 {
+		t.Fatalf("expected 2 uploaded entries, got %d", len(receivedEntries))
+	}
+
+	// Adding an entry to the outbox twice only uploads it once
+	entry := saveEntry("echo baz")
+	testutils.Check(t, AddToOutbox(db, entry))
+	assertNumPending(1)
+	testutils.Check(t, FlushOutbox(ctx))
+	assertNumPending(0)
+	if len(receivedEntries) != 3 {
+		t.Fatalf("expected 3 uploaded entries, got %d", len(receivedEntries))
+	}
+
+	// Exceeding a quota keeps the entries in the outbox, and the user is warned about it at most once an hour
+	isOverQuota = true
+	getLimitWarningTimestamp := func() int64 {
+		config, err := hctx.GetConfig()
+		testutils.Check(t, err)
+		return config.LimitWarningTimestamp
+	}
+	saveEntry("echo quota1")
+	testutils.Check(t, FlushOutbox(ctx))
+	assertNumPending(1)
+	firstWarning := getLimitWarningTimestamp()
+	if time.Since(time.Unix(firstWarning, 0)) > time.Minute {
+		t.Fatalf("expected the user to be warned about the quota, last warning was at %d", firstWarning)
+	}
+	config, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	config.LimitWarningTimestamp = time.Now().Add(-30 * time.Minute).Unix()
+	testutils.Check(t, hctx.SetConfig(config))
+	saveEntry("echo quota2")
+	testutils.Check(t, FlushOutbox(ctx))
+	if warning := getLimitWarningTimestamp(); warning != config.LimitWarningTimestamp {
+		t.Fatalf("expected the user to not be warned again within an hour, last warning was at %d", warning)
+	}
+	config.LimitWarningTimestamp = time.Now().Add(-2 * time.Hour).Unix()
+	testutils.Check(t, hctx.SetConfig(config))
+	saveEntry("echo quota3")
+	testutils.Check(t, FlushOutbox(ctx))
+	if warning := getLimitWarningTimestamp(); warning == config.LimitWarningTimestamp {
+		t.Fatalf("expected the user to be warned again after an hour")
+	}
+	assertNumPending(3)
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	testcases := []struct {
+		numFailures int
+		expected    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, tc := range testcases {
+		if actual := outboxBackoff(tc.numFailures); actual != tc.expected {
+			t.Fatalf("outboxBackoff(%d)=%v, expected %v", tc.numFailures, actual, tc.expected)
+		}
+	}
+}
+
+func TestMigrateMissedUploads(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	testutils.Check(t, hctx.InitConfig())
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	old := testutils.MakeFakeHistoryEntry("echo old")
+	old.StartTime = time.Now().AddDate(0, 0, -5)
+	old.EndTime = time.Now().AddDate(0, 0, -5)
+	testutils.Check(t, ReliableDbCreate(db, old))
+	recent := testutils.MakeFakeHistoryEntry("echo recent")
+	recent.StartTime = time.Now().Add(-time.Minute)
+	recent.EndTime = time.Now()
+	testutils.Check(t, ReliableDbCreate(db, recent))
+
+	// Simulate an older version that failed to upload entries since yesterday
+	config := hctx.GetConf(ctx)
+	config.HaveMissedUploads = true
+	config.MissedUploadTimestamp = time.Now().AddDate(0, 0, -1).Unix()
+	testutils.Check(t, hctx.SetConfig(config))
+	ctx = hctx.MakeContext()
+	testutils.Check(t, migrateMissedUploads(ctx))
+
+	var pending []data.PendingUpload
+	testutils.Check(t, db.Find(&pending).Error)
+	if len(pending) != 1 || pending[0].DeviceId != recent.DeviceId || !pending[0].EndTime.Equal(recent.EndTime) {
+		t.Fatalf("expected only the recent entry to be in the outbox, got %#v", pending)
+	}
+	config, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	if config.HaveMissedUploads || config.MissedUploadTimestamp != 0 {
+		t.Fatalf("expected the missed uploads to be cleared from the config: %#v", config)
+	}
+}
+
+func TestFindDevice(t *testing.T) {
+	devices := []shared.DeviceInfo{
+		{DeviceId: "abc123", Name: "laptop"},
+		{DeviceId: "abd456", Name: "desktop"},
+		{DeviceId: "xyz789"},
+	}
+	for _, tc := range []struct {
+		identifier       string
+		expectedDeviceId string
+	}{
+		{"abc123", "abc123"},
+		{"abc", "abc123"},
+		{"x", "xyz789"},
+		{"desktop", "abd456"},
+	} {
+		device, err := FindDevice(devices, tc.identifier)
+		testutils.Check(t, err)
+		if device.DeviceId != tc.expectedDeviceId {
+			t.Fatalf("FindDevice(%#v) returned %#v, expected %#v", tc.identifier, device.DeviceId, tc.expectedDeviceId)
+		}
+	}
+	for _, identifier := range []string{"ab", "foo", ""} {
+		_, err := FindDevice(devices, identifier)
+		if err == nil {
+			t.Fatalf("expected FindDevice(%#v) to fail", identifier)
+		}
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SERVER")()
+	testutils.Check(t, hctx.InitConfig())
+	oldConfig, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	oldConfig.UserSecret = "rotatekey"
+	oldConfig.DeviceId = "this-device"
+	oldConfig.IsOffline = false
+	testutils.Check(t, hctx.SetConfig(oldConfig))
+	ctx := hctx.MakeContext()
+	db := hctx.GetDb(ctx)
+	testutils.Check(t, ReliableDbCreate(db, testutils.MakeFakeHistoryEntry("ls")))
+	testutils.Check(t, ReliableDbCreate(db, testutils.MakeFakeHistoryEntry("echo foo")))
+
+	// A fake server that records the uploaded entries and purged users
+	failPurges := true
+	var submittedEntries []shared.EncHistoryEntry
+	var purgedUserIds []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/query", "/api/v1/get-deletion-requests":
+			w.Write([]byte("[]"))
+		case "/api/v1/devices":
+			devices := []shared.DeviceInfo{{DeviceId: oldConfig.DeviceId}, {DeviceId: "other-device", Name: "laptop"}, {DeviceId: "revoked-device", IsRevoked: true}}
+			testutils.Check(t, json.NewEncoder(w).Encode(devices))
+		case "/api/v1/submit":
+			var entries []shared.EncHistoryEntry
+			testutils.Check(t, json.NewDecoder(r.Body).Decode(&entries))
+			submittedEntries = append(submittedEntries, entries...)
+		case "/api/v1/purge-user":
+			if r.Method != http.MethodPost || failPurges {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			purgedUserIds = append(purgedUserIds, r.URL.Query().Get("user_id"))
+		}
+	}))
+	defer server.Close()
+	os.Setenv("HISHTORY_SERVER", server.URL)
+
+	// If purging fails, the key is still rotated and the old key is remembered so the purge can be retried
+	_, _, err = RotateKey(ctx)
+	if err == nil || !strings.Contains(err.Error(), "failed to purge") {
+		t.Fatalf("expected the purge to fail, got err=%v", err)
+	}
+	config, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	firstSecret := config.UserSecret
+	if firstSecret == oldConfig.UserSecret || config.RotatedUserSecret != oldConfig.UserSecret {
+		t.Fatalf("expected the key to be rotated with the old key pending a purge, got %#v", config)
+	}
+
+	// Rotating again retries the purge and then rotates to another new key
+	failPurges = false
+	submittedEntries = nil
+	ctx = hctx.MakeContext()
+	newSecret, otherDevices, err := RotateKey(ctx)
+	testutils.Check(t, err)
+	if diff := deep.Equal(purgedUserIds, []string{data.UserId(oldConfig.UserSecret), data.UserId(firstSecret)}); diff != nil {
+		t.Fatalf("unexpected purged user IDs: %v", diff)
+	}
+	if len(otherDevices) != 1 || otherDevices[0].DeviceId != "other-device" {
+		t.Fatalf("unexpected other devices: %#v", otherDevices)
+	}
+	config, err = hctx.GetConfig()
+	testutils.Check(t, err)
+	if config.UserSecret != newSecret || config.RotatedUserSecret != "" {
+		t.Fatalf("expected the config to only contain the new key, got %#v", config)
+	}
+
+	// The entries were uploaded encrypted with the new key
+	if len(submittedEntries) != 2 {
+		t.Fatalf("expected 2 entries to be uploaded, got %d", len(submittedEntries))
+	}
+	for _, entry := range submittedEntries {
+		if entry.UserId != data.UserId(newSecret) {
+			t.Fatalf("expected the entry to be uploaded under the new user ID, got %#v", entry.UserId)
+		}
+		_, err := data.DecryptHistoryEntry(newSecret, entry)
+		testutils.Check(t, err)
+		_, err = data.DecryptHistoryEntry(oldConfig.UserSecret, entry)
+		if err == nil {
+			t.Fatalf("expected the entry to not be decryptable with the old key")
+		}
+	}
+}
+
+func TestPassphraseSetup(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+
+	// Passphrases that are too short are rejected
+	err := SetupWithPassphrase("hunter2", "", true)
+	if err == nil || !strings.Contains(err.Error(), "at least") {
+		t.Fatalf("expected a short passphrase to be rejected, got err=%v", err)
+	}
+
+	// Setting up with a passphrase stores the KDF header along with the derived secret
+	testutils.Check(t, SetupWithPassphrase("correct horse battery staple", "", true))
+	config, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	params, err := data.ParseKdfHeader(config.KdfHeader)
+	testutils.Check(t, err)
+	firstSecret := config.UserSecret
+	if firstSecret != data.DeriveUserSecret("correct horse battery staple", params) {
+		t.Fatalf("expected the user secret to be derived from the passphrase, got %#v", firstSecret)
+	}
+
+	// Another device with the same passphrase and header derives the same secret
+	testutils.Check(t, SetupWithPassphrase("correct horse battery staple", config.KdfHeader, true))
+	config, err = hctx.GetConfig()
+	testutils.Check(t, err)
+	if config.UserSecret != firstSecret {
+		t.Fatalf("expected the same secret to be derived, got %#v and %#v", config.UserSecret, firstSecret)
+	}
+
+	// But without the header, a new salt is used
+	testutils.Check(t, SetupWithPassphrase("correct horse battery staple", "", true))
+	config, err = hctx.GetConfig()
+	testutils.Check(t, err)
+	if config.UserSecret == firstSecret {
+		t.Fatalf("expected a new salt to derive a different secret")
+	}
+
+	// Random secrets still work and don't have a header
+	testutils.Check(t, Setup("", true))
+	config, err = hctx.GetConfig()
+	testutils.Check(t, err)
+	if config.KdfHeader != "" {
+		t.Fatalf("expected no KDF header for a random secret, got %#v", config.KdfHeader)
+	}
+}
+
+func TestApiErrors(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SERVER")()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SIMULATE_NETWORK_ERROR")()
+	testutils.Check(t, hctx.InitConfig())
+	config, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	config.UserSecret = "errorkey"
+	config.DeviceId = "this-device"
+	config.IsOffline = false
+
+	// A fake server that responds with an error from the backend, an error from an older backend, or an error from a proxy
+	numRegistrations := 0
+	tokenRegistered := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/register":
+			numRegistrations++
+			tokenRegistered = true
+		case "/api/v1/legacy-device":
+			if !tokenRegistered {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"code":"device_token_not_registered","message":"this device needs to register its token"}`))
+			}
+		case "/api/v1/unauthorized":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":"unauthorized","message":"invalid device token"}`))
+		case "/api/v1/revoked":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"code":"device_revoked","message":"this device has been revoked"}`))
+		case "/api/v1/legacy":
+			http.Error(w, "no device with device_id=foo", http.StatusNotFound)
+		case "/api/v1/rate-limited":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":"rate_limited","message":"too many requests from this user, retry in 5s"}`))
+		case "/api/v1/quota":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"code":"quota_exceeded","message":"this server stores at most 10 entries per user"}`))
+		case "/api/v1/hang-up":
+			conn, _, err := w.(http.Hijacker).Hijack()
+			testutils.Check(t, err)
+			conn.Close()
+		case "/api/v1/proxy":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html>Bad Gateway</html>"))
+		}
+	}))
+	defer server.Close()
+	os.Setenv("HISHTORY_SERVER", server.URL)
+
+	_, err = ApiGet(config, "/api/v1/revoked")
+	if code := GetApiErrorCode(err); code != shared.ErrorCodeDeviceRevoked {
+		t.Fatalf("expected code=%s, got code=%#v for err=%v", shared.ErrorCodeDeviceRevoked, code, err)
+	}
+	if IsOfflineError(err) || !strings.Contains(err.Error(), "this device has been revoked") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Devices from before device tokens existed register their token and retry, but other auth failures aren't retried
+	_, err = ApiGet(config, "/api/v1/legacy-device")
+	testutils.Check(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = ApiGet(config, "/api/v1/unauthorized")
+		if code := GetApiErrorCode(err); code != shared.ErrorCodeUnauthorized {
+			t.Fatalf("expected code=%s, got code=%#v for err=%v", shared.ErrorCodeUnauthorized, code, err)
+		}
+	}
+	if numRegistrations != 1 {
+		t.Fatalf("expected the device to register exactly once, got %d registrations", numRegistrations)
+	}
+
+	_, err = ApiGet(config, "/api/v1/legacy")
+	if code := GetApiErrorCode(err); code != "" {
+		t.Fatalf("expected no code for an error from an older backend, got code=%#v", code)
+	}
+	if IsOfflineError(err) || !strings.Contains(err.Error(), "status_code=404: no device with device_id=foo") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = ApiGet(config, "/api/v1/proxy")
+	if !IsOfflineError(err) || strings.Contains(err.Error(), "html") {
+		t.Fatalf("expected a 502 from a proxy to be an offline error, got err=%v", err)
+	}
+	if msg := GetLimitErrorMessage(err); msg != "" {
+		t.Fatalf("expected no limit message for a proxy error, got %#v", msg)
+	}
+
+	// A self-hosted server that is down, or that drops the connection, is treated as being offline
+	_, err = ApiGet(config, "/api/v1/hang-up")
+	if !IsOfflineError(err) {
+		t.Fatalf("expected a dropped connection to be an offline error, got err=%v", err)
+	}
+	downServer := httptest.NewServer(http.NotFoundHandler())
+	downServer.Close()
+	os.Setenv("HISHTORY_SERVER", downServer.URL)
+	_, err = ApiGet(config, "/api/v1/revoked")
+	if !IsOfflineError(err) {
+		t.Fatalf("expected a refused connection to be an offline error, got err=%v", err)
+	}
+	os.Setenv("HISHTORY_SIMULATE_NETWORK_ERROR", "1")
+	_, err = ApiGet(config, "/api/v1/revoked")
+	os.Unsetenv("HISHTORY_SIMULATE_NETWORK_ERROR")
+	if !IsOfflineError(err) {
+		t.Fatalf("expected a simulated network error to be an offline error, got err=%v", err)
+	}
+	if IsOfflineError(errors.New("failed to parse the response")) {
+		t.Fatalf("expected other errors to not be offline errors")
+	}
+	os.Setenv("HISHTORY_SERVER", server.URL)
+
+	// Rate limits are retried later like being offline, and both rate limits and quotas are explained to the user
+	_, err = ApiGet(config, "/api/v1/rate-limited")
+	if !IsOfflineError(err) {
+		t.Fatalf("expected being rate limited to be retried later, got err=%v", err)
+	}
+	if msg := GetLimitErrorMessage(err); msg != "too many requests from this user, retry in 5s" {
+		t.Fatalf("unexpected limit message: %#v", msg)
+	}
+	_, err = ApiGet(config, "/api/v1/quota")
+	if IsOfflineError(err) {
+		t.Fatalf("expected exceeding a quota to not be an offline error, got err=%v", err)
+	}
+	if msg := GetLimitErrorMessage(err); msg != "this server stores at most 10 entries per user" {
+		t.Fatalf("unexpected limit message: %#v", msg)
+	}
+}
+
+func TestApiCompression(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SERVER")()
+	defer resetRequestEncoding()
+	testutils.Check(t, hctx.InitConfig())
+	config, err := hctx.GetConfig()
+	testutils.Check(t, err)
+	config.UserSecret = "compressionkey"
+	config.DeviceId = "this-device"
+	config.IsOffline = false
+	testutils.Check(t, hctx.SetConfig(config))
+
+	// A fake server that accepts compressed bodies once acceptEncoding is set, and always compresses its responses
+	acceptEncoding := ""
+	entryEncoding := ""
+	var requestEncodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestEncodings = append(requestEncodings, r.Header.Get("Content-Encoding"))
+		if r.Header.Get(shared.EntryEncodingsHeader) != shared.EncodingZstd {
+			t.Fatalf("expected the client to say it supports compressed entries")
+		}
+		body, err := shared.NewDecompressingReader(r.Body, r.Header.Get("Content-Encoding"), shared.MaxDecompressedSize)
+		testutils.Check(t, err)
+		reqBody, err := io.ReadAll(body)
+		testutils.Check(t, err)
+		if acceptEncoding != "" {
+			w.Header().Set("Accept-Encoding", acceptEncoding)
+		}
+		if entryEncoding != "" {
+			w.Header().Set(shared.EntryEncodingHeader, entryEncoding)
+		}
+		respBody := reqBody
+		if r.URL.Path == "/api/v1/query" || r.URL.Path == "/api/v1/get-deletion-requests" {
+			respBody = []byte("[]")
+		}
+		encoding := shared.NegotiateEncoding(r.Header.Get("Accept-Encoding"))
+		compressed, err := shared.Compress(respBody, encoding)
+		testutils.Check(t, err)
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(compressed)
+	}))
+	defer server.Close()
+	os.Setenv("HISHTORY_SERVER", server.URL)
+
+	// Request bodies are only compressed once the server says it accepts them, and only if they're large enough
+	largeBody := []byte(strings.Repeat("hello world ", 1000))
+	for _, body := range [][]byte{largeBody, []byte("small"), largeBody} {
+		respBody, err := ApiPost(config, "/api/v1/echo", "application/json", body)
+		testutils.Check(t, err)
+		if !bytes.Equal(respBody, body) {
+			t.Fatalf("expected the response to be decompressed, got %d bytes", len(respBody))
+		}
+		acceptEncoding = shared.SupportedEncodings
+	}
+	if diff := deep.Equal(requestEncodings, []string{"", "", shared.EncodingZstd}); diff != nil {
+		t.Fatalf("unexpected request encodings: %v", diff)
+	}
+
+	// The negotiated encoding is persisted, so a new process compresses its first request
+	resetRequestEncoding()
+	requestEncodings = nil
+	config, err = hctx.GetConfig()
+	testutils.Check(t, err)
+	if config.RequestEncoding != shared.EncodingZstd {
+		t.Fatalf("expected the request encoding to be persisted, got %#v", config.RequestEncoding)
+	}
+	_, err = ApiPost(config, "/api/v1/echo", "application/json", largeBody)
+	testutils.Check(t, err)
+	if diff := deep.Equal(requestEncodings, []string{shared.EncodingZstd}); diff != nil {
+		t.Fatalf("unexpected request encodings: %v", diff)
+	}
+
+	// Entries are compressed once the server says all devices support it
+	assertCompressEntries := func(expected bool) {
+		t.Helper()
+		testutils.Check(t, RetrieveAdditionalEntriesFromRemote(hctx.MakeContext()))
+		config, err := hctx.GetConfig()
+		testutils.Check(t, err)
+		if config.CompressEntries != expected {
+			t.Fatalf("expected CompressEntries=%v, got %v", expected, config.CompressEntries)
+		}
+	}
+	assertCompressEntries(false)
+	entryEncoding = shared.EncodingZstd
+	assertCompressEntries(true)
+	entryEncoding = shared.EncodingIdentity
+	assertCompressEntries(false)
+}
+
+func TestBootstrapFromRemote(t *testing.T) {
+	defer testutils.BackupAndRestore(t)()
+	defer testutils.BackupAndRestoreEnv("HISHTORY_SERVER")()
+	testutils.Check(t, hctx.InitConfig())
+	db := hctx.GetDb(hctx.MakeContext())
+	config := hctx.ClientConfig{UserSecret: "bootstrapkey", DeviceId: "this-device"}
+	var encEntries []shared.EncHistoryEntry
+	for _, command := range []string{"ls", "echo foo", "echo bar"} {
+		encEntry, err := data.EncryptHistoryEntry(config.UserSecret, testutils.MakeFakeHistoryEntry(command))
+		testutils.Check(t, err)
+		encEntries = append(encEntries, encEntry)
+	}
+
+	// A fake server that returns the entries as NDJSON if requested and supported, and otherwise as a JSON array
+	supportsNdjson := true
+	returnNull := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if returnNull {
+			w.Write([]byte("null"))
+			return
+		}
+		if supportsNdjson && r.URL.Query().Get("format") == "ndjson" {
+			w.Header().Set("Content-Type", shared.NdjsonContentType)
+			w.Header().Set(shared.TotalEntriesHeader, "3")
+			for _, entry := range encEntries {
+				testutils.Check(t, json.NewEncoder(w).Encode(entry))
+			}
+			return
+		}
+		testutils.Check(t, json.NewEncoder(w).Encode(encEntries))
+	}))
+	defer server.Close()
+	os.Setenv("HISHTORY_SERVER", server.URL)
+
+	assertCommands := func(expected ...string) {
+		t.Helper()
+		var entries []*data.HistoryEntry
+		testutils.Check(t, db.Order("end_time").Find(&entries).Error)
+		var commands []string
+		for _, entry := range entries {
+			commands = append(commands, entry.Command)
+		}
+		if diff := deep.Equal(commands, expected); diff != nil {
+			t.Fatalf("unexpected commands: %v", diff)
+		}
+	}
+
+	testutils.Check(t, bootstrapFromRemote(db, config))
+	assertCommands("ls", "echo foo", "echo bar")
+
+	testutils.Check(t, db.Exec("DELETE FROM history_entries").Error)
+	supportsNdjson = false
+	testutils.Check(t, bootstrapFromRemote(db, config))
+	assertCommands("ls", "echo foo", "echo bar")
+
+	testutils.Check(t, db.Exec("DELETE FROM history_entries").Error)
+	returnNull = true
+	testutils.Check(t, bootstrapFromRemote(db, config))
+	assertCommands()
+}
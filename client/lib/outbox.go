@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// How long to wait before retrying an upload after it first fails. This doubles after each subsequent failure.
+	OUTBOX_INITIAL_BACKOFF = 10 * time.Second
+	OUTBOX_MAX_BACKOFF     = time.Hour
+	OUTBOX_CHUNK_SIZE      = 100
+)
+
+// AddToOutbox records that the given entry needs to be uploaded to the backend. It stays in the outbox until the
+// backend acknowledges it.
+func AddToOutbox(db *gorm.DB, entry data.HistoryEntry) error {
+	pending := data.PendingUpload{DeviceId: entry.DeviceId, EndTime: entry.EndTime, NextAttempt: time.Now()}
+	err := ReliableDbCreate(db.Clauses(clause.OnConflict{DoNothing: true}), &pending)
+	if err != nil {
+		return fmt.Errorf("failed to add entry to the outbox: %v", err)
+	}
+	return nil
+}
+
+// CountPendingUploads returns the number of entries in the outbox
+func CountPendingUploads(db *gorm.DB) (int64, error) {
+	var count int64
+	err := db.Model(&data.PendingUpload{}).Count(&count).Error
+	return count, err
+}
+
+// FlushOutbox uploads the entries in the outbox whose backoff has expired. If that succeeds then the backend is
+// reachable again, so the remaining entries are uploaded immediately rather than waiting out their backoff. Failing
+// to reach the backend isn't an error since the entries will be retried later.
+func FlushOutbox(ctx *context.Context) error {
+	config := hctx.GetConf(ctx)
+	if config.IsOffline {
+		return nil
+	}
+	err := migrateMissedUploads(ctx)
+	if err != nil {
+		return err
+	}
+	db := hctx.GetDb(ctx)
+	now := time.Now()
+	var pending []*data.PendingUpload
+	err = db.Where("next_attempt <= ?", now).Order("end_time").Find(&pending).Error
+	if err != nil {
+		return fmt.Errorf("failed to read the outbox: %v", err)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	uploaded, err := uploadPendingEntries(ctx, pending)
+	if err != nil || !uploaded {
+		return err
+	}
+	pending = nil
+	err = db.Where("next_attempt > ?", now).Order("end_time").Find(&pending).Error
+	if err != nil {
+		return fmt.Errorf("failed to read the outbox: %v", err)
+	}
+	_, err = uploadPendingEntries(ctx, pending)
+	return err
+}
+
+// Uploads the given entries in chunks, removing each chunk from the outbox once the backend has acknowledged it.
+// If a chunk fails to upload, it and all the following chunks are backed off. Returns whether all the entries were
+// uploaded, and an error unless the uploads succeeded or failed because we're offline.
+func uploadPendingEntries(ctx *context.Context, pending []*data.PendingUpload) (bool, error) {
+	config := hctx.GetConf(ctx)
+	db := hctx.GetDb(ctx)
+	chunks := shared.Chunks(pending, OUTBOX_CHUNK_SIZE)
+	for i, chunk := range chunks {
+		var entries []*data.HistoryEntry
+		for _, p := range chunk {
+			var matches []*data.HistoryEntry
+			err := db.Where("device_id = ? AND end_time = ?", p.DeviceId, p.EndTime).Find(&matches).Error
+			if err != nil {
+				return false, fmt.Errorf("failed to read the entry for a pending upload: %v", err)
+			}
+			// If there is no matching entry, it was redacted before we got a chance to upload it
+			entries = append(entries, matches...)
+		}
+		if len(entries) > 0 {
+			jsonValue, err := EncryptAndMarshal(config, entries)
+			if err != nil {
+				return false, err
+			}
+			_, err = ApiPost(config, "/api/v1/submit?source_device_id="+config.DeviceId+"&user_id="+data.UserId(config.UserSecret), "application/json", jsonValue)
+			if err != nil {
+				for _, remainingChunk := range chunks[i:] {
+					if backoffErr := backOffPendingUploads(db, remainingChunk); backoffErr != nil {
+						return false, backoffErr
+					}
+				}
+				if msg := GetLimitErrorMessage(err); msg != "" {
+					WarnAboutLimitError(len(pending), msg)
+					return false, nil
+				}
+				if IsOfflineError(err) {
+					hctx.GetLogger().Infof("Failed to upload %d history entries because we failed to connect to the remote server, will retry later: %v", len(pending), err)
+					return false, nil
+				}
+				return false, fmt.Errorf("failed to upload history entries: %v", err)
+			}
+		}
+		for _, p := range chunk {
+			err := db.Where("device_id = ? AND end_time = ?", p.DeviceId, p.EndTime).Delete(&data.PendingUpload{}).Error
+			if err != nil {
+				return false, fmt.Errorf("failed to remove uploaded entries from the outbox: %v", err)
+			}
+		}
+	}
+	return true, nil
+}
+
+// How often the user is warned that uploads are failing because of a limit on the backend. Exceeding a quota lasts
+// until the other devices sync, so warning on every command would be noisy.
+const limitWarningInterval = time.Hour
+
+// WarnAboutLimitError tells the user that entries couldn't be synced because of a limit on the backend, at most once
+// every limitWarningInterval
+func WarnAboutLimitError(numEntries int, msg string) {
+	hctx.GetLogger().Infof("Failed to upload %d history entries because of a limit on the backend, will retry later: %s", numEntries, msg)
+	// Re-read the config from disk for the same reason as updateSyncCursor
+	config, err := hctx.GetConfig()
+	if err != nil {
+		hctx.GetLogger().Infof("failed to read config to check when the user was last warned about a limit: %v", err)
+		return
+	}
+	if time.Since(time.Unix(config.LimitWarningTimestamp, 0)) < limitWarningInterval {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: hishtory failed to sync %d history entries to your other devices and will retry later: %s\n", numEntries, msg)
+	config.LimitWarningTimestamp = time.Now().Unix()
+	err = hctx.SetConfig(config)
+	if err != nil {
+		hctx.GetLogger().Infof("failed to persist when the user was last warned about a limit: %v", err)
+	}
+}
+
+func backOffPendingUploads(db *gorm.DB, pending []*data.PendingUpload) error {
+	now := time.Now()
+	for _, p := range pending {
+		numFailures := p.NumFailures + 1
+		err := db.Model(&data.PendingUpload{}).Where("device_id = ? AND end_time = ?", p.DeviceId, p.EndTime).Updates(map[string]interface{}{
+			"num_failures": numFailures,
+			"next_attempt": now.Add(outboxBackoff(numFailures)),
+		}).Error
+		if err != nil {
+			return fmt.Errorf("failed to back off pending uploads: %v", err)
+		}
+	}
+	return nil
+}
+
+func outboxBackoff(numFailures int) time.Duration {
+	backoff := OUTBOX_INITIAL_BACKOFF
+	for i := 1; i < numFailures && backoff < OUTBOX_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > OUTBOX_MAX_BACKOFF {
+		return OUTBOX_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// Older versions recorded failed uploads as a timestamp in the config rather than in the outbox, so move the
+// entries since then into the outbox.
+func migrateMissedUploads(ctx *context.Context) error {
+	config := hctx.GetConf(ctx)
+	if !config.HaveMissedUploads {
+		return nil
+	}
+	db := hctx.GetDb(ctx)
+	query := fmt.Sprintf("after:%s", time.Unix(config.MissedUploadTimestamp, 0).Format("2006-01-02"))
+	entries, err := Search(ctx, db, query, 0)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve history entries that haven't been uploaded yet: %v", err)
+	}
+	for _, entry := range entries {
+		err = AddToOutbox(db, *entry)
+		if err != nil {
+			return err
+		}
+	}
+	config.HaveMissedUploads = false
+	config.MissedUploadTimestamp = 0
+	err = hctx.SetConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to mark the missed uploads as migrated: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// How often the progress line is redrawn
+const progressInterval = 100 * time.Millisecond
+
+// progressReporter displays a single line counting the items that have been processed. It only displays anything
+// when stderr is a terminal, so that it doesn't clutter logs and scripted output.
+type progressReporter struct {
+	out         io.Writer
+	description string
+	total       int64
+	count       int64
+	lastDrawn   time.Time
+}
+
+func newProgressReporter(description string, total int64) *progressReporter {
+	p := &progressReporter{description: description, total: total}
+	if term.IsTerminal(int(os.Stderr.Fd())) {
+		p.out = os.Stderr
+	}
+	return p
+}
+
+func (p *progressReporter) Increment() {
+	p.count += 1
+	if time.Since(p.lastDrawn) >= progressInterval {
+		p.draw()
+	}
+}
+
+// Done draws the final count and ends the progress line
+func (p *progressReporter) Done() {
+	if p.count == 0 {
+		return
+	}
+	p.draw()
+	if p.out != nil {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *progressReporter) draw() {
+	p.lastDrawn = time.Now()
+	if p.out == nil {
+		return
+	}
+	// The total is only an estimate since entries may be added while syncing
+	if p.total > 0 && p.count <= p.total {
+		fmt.Fprintf(p.out, "\r%s: %d/%d (%d%%)", p.description, p.count, p.total, p.count*100/p.total)
+	} else {
+		fmt.Fprintf(p.out, "\r%s: %d", p.description, p.count)
+	}
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ddworken/hishtory/client/data"
+	"github.com/ddworken/hishtory/client/hctx"
+	"github.com/ddworken/hishtory/shared"
+	"github.com/google/uuid"
+)
+
+// RotateKey replaces the user secret with a newly generated one. The local history is re-encrypted with the new
+// secret and uploaded under the new user ID, and then everything stored under the old user ID is purged from the
+// backend. Returns the new secret along with the other devices that were synced under the old secret, since they
+// need to be set up again with the new secret.
+func RotateKey(ctx *context.Context) (string, []shared.DeviceInfo, error) {
+	config := hctx.GetConf(ctx)
+	newSecret := uuid.Must(uuid.NewRandom()).String()
+	if config.IsOffline {
+		config.UserSecret = newSecret
+		config.KdfHeader = ""
+		err := hctx.SetConfig(config)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to persist the new secret key: %v", err)
+		}
+		return newSecret, nil, nil
+	}
+
+	// Finish purging a previously rotated key, if that failed last time
+	err := purgeRotatedUserSecret(config)
+	if err != nil {
+		return "", nil, err
+	}
+	config.RotatedUserSecret = ""
+
+	// Pull in everything that hasn't been synced yet, since it won't be readable once the old key is purged
+	err = RetrieveAdditionalEntriesFromRemote(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to retrieve history entries before rotating the secret key: %v", err)
+	}
+	devices, err := ListDevices(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	var otherDevices []shared.DeviceInfo
+	for _, device := range devices {
+		if device.DeviceId != config.DeviceId && !device.IsRevoked {
+			otherDevices = append(otherDevices, device)
+		}
+	}
+
+	// Register under the new secret and upload the history re-encrypted with it
+	oldSecret := config.UserSecret
+	config.UserSecret = newSecret
+	config.KdfHeader = ""
+	config.SyncCursor = 0
+	err = registerDevice(config)
+	if err != nil {
+		return "", nil, err
+	}
+	entries, err := Search(ctx, hctx.GetDb(ctx), "", 0)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read history entries to re-encrypt: %v", err)
+	}
+	err = uploadEntries(config, entries)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Switch over to the new secret before purging the old one, so that a failed purge can be retried
+	config.RotatedUserSecret = oldSecret
+	err = hctx.SetConfig(config)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to persist the new secret key: %v", err)
+	}
+	err = purgeRotatedUserSecret(config)
+	if err != nil {
+		return "", nil, fmt.Errorf("rotated the secret key but %v, run `hishtory rotate-key` again to retry", err)
+	}
+	return newSecret, otherDevices, nil
+}
+
+// Purges everything stored under the rotated user secret from the backend, and then forgets the rotated secret
+func purgeRotatedUserSecret(config hctx.ClientConfig) error {
+	if config.RotatedUserSecret == "" {
+		return nil
+	}
+	oldConfig := config
+	oldConfig.UserSecret = config.RotatedUserSecret
+	_, err := ApiPost(oldConfig, "/api/v1/purge-user?user_id="+data.UserId(oldConfig.UserSecret)+"&device_id="+oldConfig.DeviceId, "", nil)
+	if GetApiErrorCode(err) == shared.ErrorCodeDeviceRevoked {
+		// The device was already revoked under the old key, which happens when an earlier purge succeeded but we
+		// failed to record that
+		hctx.GetLogger().Infof("Skipping purging the rotated secret key since the device was already revoked: %v", err)
+	} else if err != nil {
+		return fmt.Errorf("failed to purge history stored under the old secret key: %v", err)
+	}
+	config.RotatedUserSecret = ""
+	err = hctx.SetConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to persist config after purging the old secret key: %v", err)
+	}
+	return nil
+}
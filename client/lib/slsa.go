@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/ddworken/hishtory/client/hctx"
 	"github.com/slsa-framework/slsa-verifier/options"
 	"github.com/slsa-framework/slsa-verifier/verifiers"
 )
@@ -46,7 +47,7 @@ func verifyBinary(ctx *context.Context, binaryPath, attestationPath, versionTag
 	if os.Getenv("HISHTORY_DISABLE_SLSA_ATTESTATION") == "true" {
 		return nil
 	}
-	resp, err := ApiGet("/api/v1/slsa-status?newVersion=" + versionTag)
+	resp, err := ApiGet(hctx.ClientConfig{}, "/api/v1/slsa-status?newVersion="+versionTag)
 	if err != nil {
 		return nil
 	}
@@ -43,6 +43,8 @@ type keyMap struct {
 	TableLeft   key.Binding
 	TableRight  key.Binding
 	DeleteEntry key.Binding
+	ToggleFuzzy key.Binding
+	CycleSort   key.Binding
 	Help        key.Binding
 	Quit        key.Binding
 }
@@ -63,8 +65,8 @@ func (k keyMap) ShortHelp() []key.Binding {
 
 func (k keyMap) FullHelp() [][]key.Binding {
 	return [][]key.Binding{
-		{fakeTitleKeyBinding, k.Up, k.Left, k.SelectEntry},
-		{fakeEmptyKeyBinding, k.Down, k.Right, k.DeleteEntry},
+		{fakeTitleKeyBinding, k.Up, k.Left, k.SelectEntry, k.ToggleFuzzy},
+		{fakeEmptyKeyBinding, k.Down, k.Right, k.DeleteEntry, k.CycleSort},
 		{fakeEmptyKeyBinding, k.PageUp, k.TableLeft, k.Quit},
 		{fakeEmptyKeyBinding, k.PageDown, k.TableRight, k.Help},
 	}
@@ -111,6 +113,14 @@ var keys = keyMap{
 		key.WithKeys("ctrl+k"),
 		key.WithHelp("ctrl+k", "delete the highlighted entry"),
 	),
+	ToggleFuzzy: key.NewBinding(
+		key.WithKeys("ctrl+t"),
+		key.WithHelp("ctrl+t", "toggle fuzzy search"),
+	),
+	CycleSort: key.NewBinding(
+		key.WithKeys("ctrl+o"),
+		key.WithHelp("ctrl+o", "change the sort order"),
+	),
 	Help: key.NewBinding(
 		key.WithKeys("ctrl+h"),
 		key.WithHelp("ctrl+h", "help"),
@@ -149,6 +159,10 @@ type model struct {
 	runQuery *string
 	// The previous query that was run.
 	lastQuery string
+	// Whether the query is fuzzily matched against commands rather than substring matched.
+	fuzzy bool
+	// The index into SORT_ORDERS of the order that results are displayed in.
+	sortOrderIdx int
 
 	// Unrecoverable error.
 	fatalErr error
@@ -179,7 +193,7 @@ func initialModel(ctx *context.Context, t table.Model, tableEntries []*data.Hist
 	if initialQuery != "" {
 		queryInput.SetValue(initialQuery)
 	}
-	return model{ctx: ctx, spinner: s, isLoading: true, table: t, tableEntries: tableEntries, runQuery: &initialQuery, queryInput: queryInput, help: help.New()}
+	return model{ctx: ctx, spinner: s, isLoading: true, table: t, tableEntries: tableEntries, runQuery: &initialQuery, queryInput: queryInput, help: help.New(), fuzzy: hctx.GetConf(ctx).FuzzySearchEnabled}
 }
 
 func (m model) Init() tea.Cmd {
@@ -191,7 +205,7 @@ func runQueryAndUpdateTable(m model, updateTable bool) model {
 		if m.runQuery == nil {
 			m.runQuery = &m.lastQuery
 		}
-		rows, entries, err := getRows(m.ctx, hctx.GetConf(m.ctx).DisplayedColumns, *m.runQuery, PADDED_NUM_ENTRIES)
+		rows, highlights, entries, err := getRows(m.ctx, hctx.GetConf(m.ctx).DisplayedColumns, withSortOrder(*m.runQuery, m.sortOrderIdx), m.fuzzy, PADDED_NUM_ENTRIES)
 		m.searchErr = err
 		if err != nil {
 			return m
@@ -206,6 +220,7 @@ func runQueryAndUpdateTable(m model, updateTable bool) model {
 			m.table = t
 		}
 		m.table.SetRows(rows)
+		m.table.SetHighlights(highlights)
 		m.table.SetCursor(0)
 		m.lastQuery = *m.runQuery
 		m.runQuery = nil
@@ -237,6 +252,21 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			m = runQueryAndUpdateTable(m, true)
 			return m, nil
+		case key.Matches(msg, keys.ToggleFuzzy):
+			m.fuzzy = !m.fuzzy
+			config := hctx.GetConf(m.ctx)
+			config.FuzzySearchEnabled = m.fuzzy
+			err := hctx.SetConfig(config)
+			if err != nil {
+				m.fatalErr = err
+				return m, nil
+			}
+			m = runQueryAndUpdateTable(m, true)
+			return m, nil
+		case key.Matches(msg, keys.CycleSort):
+			m.sortOrderIdx = (m.sortOrderIdx + 1) % len(SORT_ORDERS)
+			m = runQueryAndUpdateTable(m, true)
+			return m, nil
 		case key.Matches(msg, keys.Help):
 			m.help.ShowAll = !m.help.ShowAll
 			return m, nil
@@ -301,17 +331,47 @@ func (m model) View() string {
 		warning += fmt.Sprintf("Warning: failed to search: %v\n\n", m.searchErr)
 	}
 	helpView := m.help.View(keys)
-	return fmt.Sprintf("\n%s\n%s%s\nSearch Query: %s\n\n%s\n", loadingMessage, warning, m.banner, m.queryInput.View(), baseStyle.Render(m.table.View())) + helpView
+	queryLabel := "Search Query"
+	if m.fuzzy {
+		queryLabel = "Fuzzy Search Query"
+	}
+	if m.sortOrderIdx != 0 {
+		queryLabel += fmt.Sprintf(" (sorted by %s)", SORT_ORDERS[m.sortOrderIdx])
+	}
+	return fmt.Sprintf("\n%s\n%s%s\n%s: %s\n\n%s\n", loadingMessage, warning, m.banner, queryLabel, m.queryInput.View(), baseStyle.Render(m.table.View())) + helpView
 }
 
-func getRows(ctx *context.Context, columnNames []string, query string, numEntries int) ([]table.Row, []*data.HistoryEntry, error) {
+// Applies the sort order selected in the TUI to the query. It is prepended so that an explicit sort: atom typed
+// into the query takes precedence.
+func withSortOrder(query string, sortOrderIdx int) string {
+	if sortOrderIdx == 0 {
+		return query
+	}
+	return "sort:" + SORT_ORDERS[sortOrderIdx] + " " + query
+}
+
+func getRows(ctx *context.Context, columnNames []string, query string, fuzzy bool, numEntries int) ([]table.Row, []table.Highlights, []*data.HistoryEntry, error) {
 	db := hctx.GetDb(ctx)
 	config := hctx.GetConf(ctx)
-	data, err := Search(ctx, db, query, numEntries)
+	var data []*data.HistoryEntry
+	var matchedPositions [][]int
+	var err error
+	if fuzzy {
+		data, matchedPositions, err = FuzzySearch(ctx, db, query, numEntries)
+	} else {
+		data, err = Search(ctx, db, query, numEntries)
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	commandColumnIdx := -1
+	for i, name := range columnNames {
+		if name == "Command" {
+			commandColumnIdx = i
+		}
 	}
 	var rows []table.Row
+	var highlights []table.Highlights
 	lastCommand := ""
 	for i := 0; i < numEntries; i++ {
 		if i < len(data) {
@@ -322,15 +382,21 @@ func getRows(ctx *context.Context, columnNames []string, query string, numEntrie
 			entry.Command = strings.ReplaceAll(entry.Command, "\n", "\\n")
 			row, err := buildTableRow(ctx, columnNames, *entry)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to build row for entry=%#v: %v", entry, err)
+				return nil, nil, nil, fmt.Errorf("failed to build row for entry=%#v: %v", entry, err)
 			}
 			rows = append(rows, row)
+			if i < len(matchedPositions) && commandColumnIdx >= 0 {
+				highlights = append(highlights, table.Highlights{commandColumnIdx: matchedPositions[i]})
+			} else {
+				highlights = append(highlights, nil)
+			}
 			lastCommand = entry.Command
 		} else {
 			rows = append(rows, table.Row{})
+			highlights = append(highlights, nil)
 		}
 	}
-	return rows, data, nil
+	return rows, highlights, data, nil
 }
 
 func calculateColumnWidths(rows []table.Row, numColumns int) []int {
@@ -352,7 +418,7 @@ var bigQueryResults []table.Row
 func makeTableColumns(ctx *context.Context, columnNames []string, rows []table.Row) ([]table.Column, error) {
 	// Handle an initial query with no results
 	if len(rows) == 0 || len(rows[0]) == 0 {
-		allRows, _, err := getRows(ctx, columnNames, "", 25)
+		allRows, _, _, err := getRows(ctx, columnNames, "", false, 25)
 		if err != nil {
 			return nil, err
 		}
@@ -378,7 +444,7 @@ func makeTableColumns(ctx *context.Context, columnNames []string, rows []table.R
 
 	// Calculate the maximum column width that is useful for each column if we search for the empty string
 	if bigQueryResults == nil {
-		bigRows, _, err := getRows(ctx, columnNames, "", 1000)
+		bigRows, _, _, err := getRows(ctx, columnNames, "", false, 1000)
 		if err != nil {
 			return nil, err
 		}
@@ -502,12 +568,12 @@ func deleteHistoryEntry(ctx *context.Context, entry data.HistoryEntry) error {
 		SendTime: time.Now(),
 	}
 	dr.Messages.Ids = append(dr.Messages.Ids, shared.MessageIdentifier{Date: entry.EndTime, DeviceId: entry.DeviceId})
-	return SendDeletionRequest(dr)
+	return SendDeletionRequest(ctx, dr)
 }
 
 func TuiQuery(ctx *context.Context, initialQuery string) error {
 	lipgloss.SetColorProfile(termenv.ANSI)
-	rows, entries, err := getRows(ctx, hctx.GetConf(ctx).DisplayedColumns, initialQuery, PADDED_NUM_ENTRIES)
+	rows, highlights, entries, err := getRows(ctx, hctx.GetConf(ctx).DisplayedColumns, initialQuery, hctx.GetConf(ctx).FuzzySearchEnabled, PADDED_NUM_ENTRIES)
 	if err != nil {
 		if initialQuery != "" {
 			// initialQuery is likely invalid in some way, let's just drop it
@@ -520,6 +586,7 @@ func TuiQuery(ctx *context.Context, initialQuery string) error {
 	if err != nil {
 		return err
 	}
+	t.SetHighlights(highlights)
 	p := tea.NewProgram(initialModel(ctx, t, entries, initialQuery), tea.WithOutput(os.Stderr))
 	// Async: Retrieve additional entries from the backend
 	go func() {
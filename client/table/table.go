@@ -16,11 +16,12 @@ import (
 type Model struct {
 	KeyMap KeyMap
 
-	cols   []Column
-	rows   []Row
-	cursor int
-	focus  bool
-	styles Styles
+	cols       []Column
+	rows       []Row
+	highlights []Highlights
+	cursor     int
+	focus      bool
+	styles     Styles
 
 	viewport viewport.Model
 	start    int
@@ -34,6 +35,10 @@ type Model struct {
 // Row represents one line in the table.
 type Row []string
 
+// Highlights maps a column index to the rune offsets within that cell that
+// should be rendered with the Highlighted style.
+type Highlights map[int][]int
+
 // Column defines the table structure.
 type Column struct {
 	Title string
@@ -105,17 +110,19 @@ func DefaultKeyMap() KeyMap {
 // Styles contains style definitions for this list component. By default, these
 // values are generated by DefaultStyles.
 type Styles struct {
-	Header   lipgloss.Style
-	Cell     lipgloss.Style
-	Selected lipgloss.Style
+	Header      lipgloss.Style
+	Cell        lipgloss.Style
+	Selected    lipgloss.Style
+	Highlighted lipgloss.Style
 }
 
 // DefaultStyles returns a set of default style definitions for this table.
 func DefaultStyles() Styles {
 	return Styles{
-		Selected: lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("212")),
-		Header:   lipgloss.NewStyle().Bold(true).Padding(0, 1),
-		Cell:     lipgloss.NewStyle().Padding(0, 1),
+		Selected:    lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("212")),
+		Header:      lipgloss.NewStyle().Bold(true).Padding(0, 1),
+		Cell:        lipgloss.NewStyle().Padding(0, 1),
+		Highlighted: lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("212")),
 	}
 }
 
@@ -167,6 +174,14 @@ func WithRows(rows []Row) Option {
 	}
 }
 
+// WithHighlights sets the highlighted characters for each row. The i-th entry
+// applies to the i-th row.
+func WithHighlights(highlights []Highlights) Option {
+	return func(m *Model) {
+		m.highlights = highlights
+	}
+}
+
 // WithHeight sets the height of the table.
 func WithHeight(h int) Option {
 	return func(m *Model) {
@@ -304,6 +319,13 @@ func (m *Model) SetRows(r []Row) {
 	m.UpdateViewport()
 }
 
+// SetHighlights sets the highlighted characters for each row. The i-th entry
+// applies to the i-th row.
+func (m *Model) SetHighlights(h []Highlights) {
+	m.highlights = h
+	m.UpdateViewport()
+}
+
 // SetColumns set a new columns state.
 func (m *Model) SetColumns(c []Column) {
 	m.cols = c
@@ -449,7 +471,13 @@ func (m *Model) renderRow(rowID int) string {
 	for i, value := range m.rows[rowID] {
 		style := lipgloss.NewStyle().Width(m.cols[i].Width).MaxWidth(m.cols[i].Width).Inline(true)
 		var renderedCell string
-		if i == m.ColIndex(m.hcol) && m.hcursor > 0 {
+		if positions := m.highlightedPositions(rowID, i); len(positions) > 0 {
+			hcursor := 0
+			if i == m.ColIndex(m.hcol) {
+				hcursor = m.hcursor
+			}
+			renderedCell = m.styles.Cell.Render(style.Render(m.renderHighlightedValue(value, positions, hcursor, m.cols[i].Width)))
+		} else if i == m.ColIndex(m.hcol) && m.hcursor > 0 {
 			renderedCell = m.styles.Cell.Render(style.Render(runewidth.Truncate(runewidth.TruncateLeft(value, m.hcursor, "…"), m.cols[i].Width, "…")))
 		} else {
 			renderedCell = m.styles.Cell.Render(style.Render(runewidth.Truncate(value, m.cols[i].Width, "…")))
@@ -466,6 +494,58 @@ func (m *Model) renderRow(rowID int) string {
 	return row
 }
 
+func (m *Model) highlightedPositions(rowID, colID int) []int {
+	// The selected row is rendered with a background color, which the resets emitted after each highlighted
+	// character would clobber, so it is left unhighlighted.
+	if rowID == m.cursor || rowID >= len(m.highlights) {
+		return nil
+	}
+	return m.highlights[rowID][colID]
+}
+
+// renderHighlightedValue truncates value in the same way as renderRow does for plain cells, while styling
+// the runes at the given positions.
+func (m *Model) renderHighlightedValue(value string, positions []int, hcursor, width int) string {
+	isHighlighted := make(map[int]bool, len(positions))
+	for _, p := range positions {
+		isHighlighted[p] = true
+	}
+	runes := []rune(value)
+	var sb strings.Builder
+	start := 0
+	usedWidth := 0
+	if hcursor > 0 {
+		skippedWidth := 0
+		for start < len(runes) && skippedWidth+runewidth.RuneWidth(runes[start]) <= hcursor {
+			skippedWidth += runewidth.RuneWidth(runes[start])
+			start += 1
+		}
+		sb.WriteString("…")
+		usedWidth = runewidth.StringWidth("…")
+	}
+	availableWidth := width - usedWidth
+	tail := ""
+	if runewidth.StringWidth(string(runes[start:])) > availableWidth {
+		tail = "…"
+		availableWidth -= runewidth.StringWidth(tail)
+	}
+	renderedWidth := 0
+	for i := start; i < len(runes); i++ {
+		w := runewidth.RuneWidth(runes[i])
+		if renderedWidth+w > availableWidth {
+			break
+		}
+		renderedWidth += w
+		if isHighlighted[i] {
+			sb.WriteString(m.styles.Highlighted.Render(string(runes[i])))
+		} else {
+			sb.WriteRune(runes[i])
+		}
+	}
+	sb.WriteString(tail)
+	return sb.String()
+}
+
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -0,0 +1,154 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingZstd     = "zstd"
+	EncodingGzip     = "gzip"
+	EncodingIdentity = "identity"
+	// The content encodings that the client and server both support, in order of preference
+	SupportedEncodings = EncodingZstd + ", " + EncodingGzip
+	// The largest response that clients will decompress, so that a small compressed body can't exhaust memory.
+	// Bootstraps contain a user's whole history, so this is far larger than what the backend accepts in requests.
+	MaxDecompressedSize = 512 * 1024 * 1024
+)
+
+const (
+	// Sent by clients to list the encodings that they can decrypt history entries in
+	EntryEncodingsHeader = "X-Hishtory-Entry-Encodings"
+	// Sent by the backend to tell clients which encoding to encrypt new history entries in. Entries are only
+	// compressed once all of a user's devices can decrypt compressed entries.
+	EntryEncodingHeader = "X-Hishtory-Entry-Encoding"
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// NegotiateEncoding picks the preferred encoding out of an Accept-Encoding header, or identity if none of the
+// supported encodings are accepted
+func NegotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if len(fields) > 1 && strings.ReplaceAll(strings.TrimSpace(fields[1]), " ", "") == "q=0" {
+			continue
+		}
+		accepted[encoding] = true
+	}
+	for _, encoding := range []string{EncodingZstd, EncodingGzip} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return EncodingIdentity
+}
+
+// NewCompressingWriter wraps w so that everything written to it is compressed with the given encoding. The returned
+// writer must be closed to flush the compressed data.
+func NewCompressingWriter(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "", EncodingIdentity:
+		return nopWriteCloser{w}, nil
+	case EncodingZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %#v", encoding)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// NewDecompressingReader wraps r so that it decompresses data compressed with the given encoding. Reads fail once
+// more than maxSize bytes have been decompressed.
+func NewDecompressingReader(r io.Reader, encoding string, maxSize int64) (io.ReadCloser, error) {
+	switch encoding {
+	case "", EncodingIdentity:
+		return io.NopCloser(r), nil
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		if err != nil {
+			return nil, err
+		}
+		return &limitedReadCloser{r: decoder, max: maxSize, close: decoder.Close}, nil
+	case EncodingGzip:
+		decoder, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &limitedReadCloser{r: decoder, max: maxSize, close: func() { decoder.Close() }}, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %#v", encoding)
+	}
+}
+
+type limitedReadCloser struct {
+	r     io.Reader
+	n     int64
+	max   int64
+	close func()
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, fmt.Errorf("decompressed data is larger than the maximum of %d bytes", l.max)
+	}
+	return n, err
+}
+
+func (l *limitedReadCloser) Close() error {
+	l.close()
+	return nil
+}
+
+// Compress compresses data with the given encoding
+func Compress(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewCompressingWriter(&buf, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress data: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress decompresses data that was compressed with the given encoding
+func Decompress(data []byte, encoding string) ([]byte, error) {
+	r, err := NewDecompressingReader(bytes.NewReader(data), encoding, MaxDecompressedSize)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress data: %v", err)
+	}
+	return decompressed, nil
+}
+
+// IsZstdCompressed returns whether data starts with the magic number of a zstd frame
+func IsZstdCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, zstdMagic)
+}
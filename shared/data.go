@@ -1,12 +1,22 @@
 package shared
 
 import (
+	"crypto/sha256"
 	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"time"
 )
 
+const (
+	// The content type of bootstrap responses that contain one JSON encoded EncHistoryEntry per line
+	NdjsonContentType = "application/x-ndjson"
+	// The header that bootstrap responses use to say how many entries they contain, so that clients can display
+	// progress while streaming them
+	TotalEntriesHeader = "X-Hishtory-Total-Entries"
+)
+
 type EncHistoryEntry struct {
 	EncryptedData []byte    `json:"enc_data"`
 	Nonce         []byte    `json:"nonce"`
@@ -15,6 +25,10 @@ type EncHistoryEntry struct {
 	Date          time.Time `json:"time"`
 	EncryptedId   string    `json:"id"`
 	ReadCount     int       `json:"read_count"`
+	// A per-device sequence number that increases monotonically in the order entries are committed. Clients
+	// sync by requesting the entries with a sequence number greater than the last one they persisted. Zero
+	// for entries that were stored before sequence numbers were introduced.
+	Seq int64 `json:"seq" gorm:"not null; default:0"`
 }
 
 /*
@@ -22,6 +36,8 @@ Manually created the indices:
 CREATE INDEX CONCURRENTLY device_id_idx ON enc_history_entries USING btree(device_id);
 CREATE INDEX CONCURRENTLY read_count_idx ON enc_history_entries USING btree(read_count);
 CREATE INDEX CONCURRENTLY redact_idx ON enc_history_entries USING btree(user_id, device_id, date);
+CREATE INDEX CONCURRENTLY seq_idx ON enc_history_entries USING btree(device_id, seq);
+CREATE INDEX CONCURRENTLY bootstrap_idx ON enc_history_entries USING btree(user_id, device_id, encrypted_id);
 */
 
 type Device struct {
@@ -33,6 +49,31 @@ type Device struct {
 	// david@daviddworken.com and I can clear it from your device entries.
 	RegistrationIp   string    `json:"registration_ip"`
 	RegistrationDate time.Time `json:"registration_date"`
+	// A name the user gave the device to make it easier to identify
+	Name string `json:"name" gorm:"not null; default:''"`
+	// Revoked devices can't make requests and no longer receive history entries
+	IsRevoked bool `json:"is_revoked" gorm:"not null; default:false"`
+	// Whether the device last said that it can decrypt compressed history entries
+	SupportsCompressedEntries bool `json:"supports_compressed_entries" gorm:"not null; default:false"`
+	// The SHA-256 hashes of the device's token, and of the token that proves knowledge of the user secret
+	TokenHash     string `json:"-" gorm:"not null; default:''"`
+	UserTokenHash string `json:"-" gorm:"not null; default:''"`
+	// The last sequence number that was assigned to an entry for this device
+	LastSeq int64 `json:"last_seq" gorm:"not null; default:0"`
+	// The last sequence number that the device has confirmed it persisted, entries up to and
+	// including it can be deleted
+	AckedSeq int64 `json:"acked_seq" gorm:"not null; default:0"`
+}
+
+const MaxDeviceNameLength = 64
+
+// DeviceInfo describes one of a user's devices for `hishtory devices list`
+type DeviceInfo struct {
+	DeviceId         string    `json:"device_id"`
+	Name             string    `json:"name"`
+	RegistrationDate time.Time `json:"registration_date"`
+	LastUsed         time.Time `json:"last_used"`
+	IsRevoked        bool      `json:"is_revoked"`
 }
 
 type DumpRequest struct {
@@ -96,6 +137,12 @@ type Feedback struct {
 	Feedback string    `json:"feedback"`
 }
 
+// HashToken hashes an authentication token so that the backend doesn't need to store the token itself
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
 func Chunks[k any](slice []k, chunkSize int) [][]k {
 	var chunks [][]k
 	for i := 0; i < len(slice); i += chunkSize {
@@ -0,0 +1,37 @@
+package shared
+
+import "fmt"
+
+// Machine readable codes for the errors that the backend responds with
+const (
+	ErrorCodeBadRequest               = "bad_request"
+	ErrorCodeUnauthorized             = "unauthorized"
+	ErrorCodeForbidden                = "forbidden"
+	ErrorCodeDeviceRevoked            = "device_revoked"
+	ErrorCodeDeviceTokenNotRegistered = "device_token_not_registered"
+	ErrorCodeUserLimitReached         = "user_limit_reached"
+	ErrorCodeNotFound                 = "not_found"
+	ErrorCodeUnsupportedEncoding      = "unsupported_encoding"
+	ErrorCodeRateLimited              = "rate_limited"
+	ErrorCodeQuotaExceeded            = "quota_exceeded"
+	ErrorCodeInternal                 = "internal_error"
+)
+
+// ApiError is the JSON body of every unsuccessful response from the backend
+type ApiError struct {
+	// The HTTP status code of the response, which isn't part of the body
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *ApiError) Error() string {
+	msg := fmt.Sprintf("status_code=%d", e.StatusCode)
+	if e.Code != "" {
+		msg += ", code=" + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}